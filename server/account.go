@@ -0,0 +1,472 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type accountDataSection struct {
+	name  string
+	query string
+}
+
+// every table holding data tied to a player uuid; each "?" is bound to the uuid
+var accountDataSections = []accountDataSection{
+	{"account", "SELECT uuid, user, ip, timestampRegistered, timestampLoggedIn, badge, badgeSlotRows, badgeSlotCols, screenshotLimit FROM accounts WHERE uuid = ?"},
+	{"player", "SELECT uuid, rank, banned, muted FROM players WHERE uuid = ?"},
+	{"roles", "SELECT role FROM playerRoles WHERE uuid = ?"},
+	{"playerGameData", "SELECT * FROM playerGameData WHERE uuid = ?"},
+	{"chatMessages", "SELECT * FROM chatMessages WHERE uuid = ? ORDER BY timestamp"},
+	{"chatMessageEdits", "SELECT * FROM chatMessageEdits WHERE (editorUuid = ? AND action = 'edit') OR msgId IN (SELECT msgId FROM chatMessages WHERE uuid = ?) ORDER BY timestamp"},
+	{"allGamesChatMessages", "SELECT * FROM allGamesChatMessages WHERE uuid = ? ORDER BY timestamp"},
+	{"directMessages", "SELECT * FROM directMessages WHERE uuid = ? OR targetUuid = ? ORDER BY timestamp"},
+	{"dmSettings", "SELECT * FROM playerDmSettings WHERE uuid = ?"},
+	{"screenshots", "SELECT * FROM playerScreenshots WHERE uuid = ?"},
+	{"screenshotLikes", "SELECT * FROM playerScreenshotLikes WHERE uuid = ?"},
+	{"badges", "SELECT * FROM playerBadges WHERE uuid = ?"},
+	{"badgePresets", "SELECT * FROM playerBadgePresets WHERE uuid = ?"},
+	{"tags", "SELECT * FROM playerTags WHERE uuid = ?"},
+	{"friends", "SELECT * FROM playerFriends WHERE uuid = ? OR targetUuid = ?"},
+	{"blocks", "SELECT * FROM playerBlocks WHERE uuid = ?"},
+	{"reports", "SELECT uuid, targetUuid, msgId, game, reason, originalMsg, timestampReported FROM playerReports WHERE uuid = ?"},
+	{"pushSubscriptions", "SELECT endpoint FROM pushSubscriptions WHERE uuid = ?"},
+	{"partyMemberships", "SELECT * FROM partyMembers WHERE uuid = ?"},
+	{"partyInvites", "SELECT * FROM partyInvites WHERE uuid = ? OR inviterUuid = ?"},
+	{"partyJoinRequests", "SELECT * FROM partyJoinRequests WHERE uuid = ?"},
+	{"partyInviteLinks", "SELECT partyId, expiry FROM partyInviteLinks WHERE creatorUuid = ?"},
+	{"partyRoleChanges", "SELECT * FROM partyRoleChanges WHERE uuid = ? OR actorUuid = ?"},
+	{"schedules", "SELECT * FROM schedules WHERE ownerUuid = ?"},
+	{"scheduleFollows", "SELECT * FROM playerScheduleFollows WHERE uuid = ?"},
+	{"gameLocations", "SELECT * FROM playerGameLocations WHERE uuid = ?"},
+	{"eventCompletions", "SELECT * FROM eventCompletions WHERE uuid = ?"},
+	{"timeTrials", "SELECT * FROM playerTimeTrials WHERE uuid = ?"},
+	{"minigameScores", "SELECT * FROM playerMinigameScores WHERE uuid = ?"},
+	{"moderationActions", "SELECT * FROM playerModerationActions WHERE uuid = ?"},
+	{"sanctions", "SELECT * FROM playerSanctions WHERE uuid = ?"},
+	{"loginLockouts", "SELECT * FROM playerLoginLockouts WHERE uuid = ?"},
+	{"identitySignals", "SELECT kind, firstSeen, lastSeen FROM playerIdentitySignals WHERE uuid = ?"},
+}
+
+// statements run when an account is deleted; each "?" is bound to the uuid
+var accountDeletionQueries = []string{
+	"DELETE FROM playerSessions WHERE uuid = ?",
+	"DELETE FROM pushSubscriptions WHERE uuid = ?",
+	// before chatMessages, which the player's own messages are found through
+	"DELETE FROM chatMessageEdits WHERE (editorUuid = ? AND action = 'edit') OR msgId IN (SELECT msgId FROM chatMessages WHERE uuid = ?)",
+	"DELETE FROM chatMessages WHERE uuid = ?",
+	"DELETE FROM allGamesChatMessages WHERE uuid = ?",
+	"DELETE FROM directMessages WHERE uuid = ? OR targetUuid = ?",
+	"DELETE FROM playerDmSettings WHERE uuid = ?",
+	"DELETE FROM playerScreenshotLikes WHERE uuid = ? OR screenshotId IN (SELECT id FROM playerScreenshots WHERE uuid = ?)",
+	"DELETE FROM playerScreenshots WHERE uuid = ?",
+	"DELETE FROM playerBadges WHERE uuid = ?",
+	"DELETE FROM playerBadgePresets WHERE uuid = ?",
+	"DELETE FROM playerTags WHERE uuid = ?",
+	"DELETE FROM playerFriends WHERE uuid = ? OR targetUuid = ?",
+	"DELETE FROM playerBlocks WHERE uuid = ? OR targetUuid = ?",
+	// reports and notes are moderation records and stay, including those the player filed,
+	// which their report limits and credibility are worked out from
+	"DELETE FROM reportClaims WHERE claimerUuid = ?",
+	"UPDATE reportNotes SET authorUuid = NULL WHERE authorUuid = ?",
+	// parties were already left on servers that could be reached; this covers the rest
+	"DELETE FROM parties WHERE owner = ? AND NOT EXISTS (SELECT * FROM partyMembers pm WHERE pm.partyId = parties.id AND pm.uuid <> ?)",
+	"UPDATE parties p SET p.owner = (SELECT pm.uuid FROM partyMembers pm WHERE pm.partyId = p.id AND pm.uuid <> ? ORDER BY pm.role = 'officer' DESC, pm.id LIMIT 1) WHERE p.owner = ?",
+	"DELETE FROM partyMembers WHERE uuid = ?",
+	"DELETE FROM partyInvites WHERE uuid = ? OR inviterUuid = ?",
+	"DELETE FROM partyJoinRequests WHERE uuid = ?",
+	"DELETE FROM partyInviteLinks WHERE creatorUuid = ?",
+	"DELETE FROM partyRoleChanges WHERE uuid = ?",
+	"UPDATE partyRoleChanges SET actorUuid = NULL WHERE actorUuid = ?",
+	"DELETE FROM playerScheduleFollows WHERE uuid = ? OR scheduleId IN (SELECT id FROM schedules WHERE ownerUuid = ?)",
+	"DELETE FROM schedules WHERE ownerUuid = ?",
+	"DELETE FROM playerGameLocations WHERE uuid = ?",
+	"DELETE FROM eventCompletions WHERE uuid = ?",
+	"DELETE FROM playerEventLocations WHERE uuid = ?",
+	"DELETE FROM playerTimeTrials WHERE uuid = ?",
+	"DELETE FROM playerMinigameScores WHERE uuid = ?",
+	"DELETE FROM playerModerationActions WHERE uuid = ?",
+	"DELETE FROM playerRoles WHERE uuid = ?",
+	// kept for banned players, along with their players row below
+	"DELETE FROM playerSanctions WHERE uuid = ? AND NOT EXISTS (SELECT * FROM players WHERE uuid = ? AND banned = 1)",
+	"DELETE FROM playerLoginLockouts WHERE uuid = ?",
+	// like the players row below, banned players' signals stay so their alts can still be found
+	"DELETE FROM playerIdentitySignals WHERE uuid = ? AND NOT EXISTS (SELECT * FROM players WHERE uuid = ? AND banned = 1)",
+	"DELETE FROM playerGameData WHERE uuid = ?",
+	"DELETE FROM accounts WHERE uuid = ?",
+	// banned players keep an anonymous row so the ban still applies to the uuid
+	"UPDATE players SET ip = NULL WHERE uuid = ? AND banned = 1",
+	"DELETE FROM players WHERE uuid = ? AND banned = 0",
+	"DELETE FROM accountDeletions WHERE uuid = ?",
+}
+
+func initAccounts() {
+	// Use main server to process account deletions for all games
+	if isMainServer {
+		logInitTask("accounts")
+
+		scheduler.Cron("30 * * * *").Do(processAccountDeletions)
+	}
+}
+
+func handleAccount(w http.ResponseWriter, r *http.Request) {
+	commandParam := r.URL.Query().Get("command")
+	if commandParam == "" {
+		handleError(w, r, "command not specified")
+		return
+	}
+
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		handleError(w, r, "token not specified")
+		return
+	}
+
+	uuid, name, _, _, _, _ := getPlayerDataFromToken(token)
+	if uuid == "" {
+		handleError(w, r, "invalid token")
+		return
+	}
+
+	switch commandParam {
+	case "export":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"ynoproject-%s.zip\"", name))
+
+		err := writeAccountDataArchive(w, uuid)
+		if err != nil {
+			// headers are already sent at this point, so the archive is left truncated
+			writeErrLog(uuid, r.URL.Path, err.Error())
+		}
+		return
+	case "delete":
+		if r.Method != "POST" {
+			handleError(w, r, "unsupported HTTP method")
+			return
+		}
+
+		r.ParseForm()
+		password := r.Form.Get("password")
+		if password == "" || len(password) > 72 {
+			handleError(w, r, "bad response")
+			return
+		}
+
+		if !checkLoginThrottle(w, r, name) {
+			return
+		}
+
+		var userPassHash string
+		db.QueryRow("SELECT pass FROM accounts WHERE uuid = ?", uuid).Scan(&userPassHash)
+
+		if userPassHash == "" || bcrypt.CompareHashAndPassword([]byte(userPassHash), []byte(password)) != nil {
+			recordFailedLogin(name, getIp(r))
+			handleError(w, r, "bad login")
+			return
+		}
+
+		resetLoginThrottle(name, getIp(r))
+
+		scheduled, err := requestAccountDeletion(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		w.Write([]byte(scheduled.Format(time.RFC3339)))
+		return
+	case "canceldelete":
+		err := cancelAccountDeletion(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+	case "deletestatus":
+		scheduled, err := getAccountDeletionSchedule(uuid)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return
+			}
+			handleInternalError(w, r, err)
+			return
+		}
+
+		w.Write([]byte(scheduled.Format(time.RFC3339)))
+		return
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+func writeAccountDataArchive(w io.Writer, uuid string) error {
+	archive := zip.NewWriter(w)
+
+	for _, section := range accountDataSections {
+		rows, err := queryAccountDataRows(section.query, uuid)
+		if err != nil {
+			return errors.Join(fmt.Errorf("export %s", section.name), err)
+		}
+
+		file, err := archive.Create("data/" + section.name + ".json")
+		if err != nil {
+			return err
+		}
+
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "\t")
+
+		err = enc.Encode(rows)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, directory := range []string{"screenshots/", "screenshots/temp/"} {
+		entries, err := os.ReadDir(directory + uuid)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+
+			err = copyFileToArchive(archive, directory+uuid+"/"+entry.Name(), directory+entry.Name())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for game := range gameIdToName {
+		err := copyFileToArchive(archive, "saves/"+game+"/"+uuid+".osd", "saves/"+game+".osd")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func copyFileToArchive(archive *zip.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	entry, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, file)
+
+	return err
+}
+
+func queryAccountDataRows(query, uuid string) ([]map[string]any, error) {
+	rows := []map[string]any{}
+
+	results, err := db.Query(query, getAccountQueryArgs(query, uuid)...)
+	if err != nil {
+		return rows, err
+	}
+
+	defer results.Close()
+
+	columns, err := results.Columns()
+	if err != nil {
+		return rows, err
+	}
+
+	for results.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		err := results.Scan(pointers...)
+		if err != nil {
+			return rows, err
+		}
+
+		row := make(map[string]any, len(columns))
+		for i, column := range columns {
+			if bytes, ok := values[i].([]byte); ok {
+				row[column] = string(bytes)
+			} else {
+				row[column] = values[i]
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func getAccountQueryArgs(query, uuid string) (args []any) {
+	for range strings.Count(query, "?") {
+		args = append(args, uuid)
+	}
+
+	return args
+}
+
+func requestAccountDeletion(uuid string) (scheduled time.Time, err error) {
+	scheduled = time.Now().UTC().Add(config.account.deletionCoolingOff)
+
+	_, err = db.Exec("INSERT INTO accountDeletions (uuid, timestampRequested, timestampScheduled) VALUES (?, UTC_TIMESTAMP(), ?) ON DUPLICATE KEY UPDATE timestampScheduled = timestampScheduled", uuid, scheduled)
+	if err != nil {
+		return scheduled, err
+	}
+
+	return getAccountDeletionSchedule(uuid)
+}
+
+func cancelAccountDeletion(uuid string) error {
+	_, err := db.Exec("DELETE FROM accountDeletions WHERE uuid = ?", uuid)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func getAccountDeletionSchedule(uuid string) (scheduled time.Time, err error) {
+	err = db.QueryRow("SELECT timestampScheduled FROM accountDeletions WHERE uuid = ?", uuid).Scan(&scheduled)
+	if err != nil {
+		return scheduled, err
+	}
+
+	return scheduled.UTC(), nil
+}
+
+func (c *SessionClient) sendAccountDeletionNotice() error {
+	scheduled, err := getAccountDeletionSchedule(c.uuid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	systemMessage(fmt.Sprintf("Your account is scheduled for deletion on %s. You can cancel this from your account settings until then.", scheduled.Format("2006-01-02 15:04 MST")), c.uuid)
+
+	return nil
+}
+
+func processAccountDeletions() {
+	results, err := db.Query("SELECT uuid FROM accountDeletions WHERE timestampScheduled <= UTC_TIMESTAMP()")
+	if err != nil {
+		log.Printf("processAccountDeletions: %s", err)
+		return
+	}
+
+	var uuids []string
+	for results.Next() {
+		var uuid string
+		if err := results.Scan(&uuid); err != nil {
+			log.Printf("processAccountDeletions/rows: %s", err)
+			break
+		}
+		uuids = append(uuids, uuid)
+	}
+
+	results.Close()
+
+	for _, uuid := range uuids {
+		if err := deleteAccountData(uuid); err != nil {
+			log.Printf("error deleting account data for %s: %s", uuid, err)
+		}
+	}
+}
+
+func deleteAccountData(uuid string) error {
+	var errs []error
+
+	// disconnect the player and drop cached state everywhere before the rows go away
+	if err := purgePlayerInAllGames(uuid); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, query := range accountDeletionQueries {
+		_, err := db.Exec(query, getAccountQueryArgs(query, uuid)...)
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+	}
+
+	for _, directory := range []string{"screenshots/", "screenshots/temp/"} {
+		if err := os.RemoveAll(directory + uuid); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// in case a sibling server was unreachable
+	for game := range gameIdToName {
+		if err := os.Remove("saves/" + game + "/" + uuid + ".osd"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// drops everything this game server holds in memory or on disk for uuid
+func purgePlayerUnchecked(uuid string) error {
+	if client, ok := clients.Load(uuid); ok {
+		if client.roomC != nil {
+			client.roomC.cancel()
+		}
+		client.cancel()
+	}
+
+	partiesMutex.Lock()
+	err := leaveHostedParties(uuid)
+	partiesMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = clearGameSaveData(uuid)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -18,25 +18,76 @@
 package server
 
 import (
+	"database/sql"
 	"encoding/json"
 	"net/http"
+	"strings"
 	"time"
 )
 
 func adminGetPlayers(w http.ResponseWriter, r *http.Request) {
-	_, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
+	uuid, _, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, permViewPlayers) {
 		handleError(w, r, "access denied")
 		return
 	}
 
+	// alts take a query per player, so they're only looked up on request
+	withAlts := r.URL.Query().Has("alts")
+
 	response := make([]PlayerInfo, 0, clients.GetAmount())
 	for _, client := range clients.Get() {
-		response = append(response, PlayerInfo{
-			Uuid: client.uuid,
-			Name: client.name,
-			Rank: client.rank,
-		})
+		playerInfo := PlayerInfo{
+			Uuid:        client.uuid,
+			Name:        client.name,
+			Rank:        client.rank,
+			Game:        config.gameName,
+			ShadowMuted: client.shadowMuted,
+		}
+
+		if withAlts {
+			playerInfo.Alts, _ = getLinkedIdentities(client.uuid)
+		}
+
+		if client.account {
+			playerInfo.Roles = client.roles
+
+			failedLogins, lockedUntil := loginThrottle.State(getAccountLoginKey(client.name))
+			playerInfo.FailedLogins = failedLogins
+			if lockedUntil.After(time.Now()) {
+				playerInfo.LockedUntil = &lockedUntil
+			}
+		}
+
+		response = append(response, playerInfo)
+	}
+
+	// sibling servers don't report moderation state over the presence bus
+	shadowMutedUuids, err := getShadowMutedUuids()
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	// players on sibling game servers, as last reported over the presence bus
+	for _, event := range remotePresence.GetAll() {
+		if clients.Exists(event.Uuid) {
+			continue
+		}
+
+		playerInfo := PlayerInfo{
+			Uuid:        event.Uuid,
+			Name:        event.Name,
+			Rank:        event.Rank,
+			Game:        event.Game,
+			ShadowMuted: shadowMutedUuids[event.Uuid],
+		}
+
+		if withAlts {
+			playerInfo.Alts, _ = getLinkedIdentities(event.Uuid)
+		}
+
+		response = append(response, playerInfo)
 	}
 
 	responseJson, err := json.Marshal(response)
@@ -49,8 +100,8 @@ func adminGetPlayers(w http.ResponseWriter, r *http.Request) {
 }
 
 func adminGetBansMutes(w http.ResponseWriter, r *http.Request) {
-	_, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
+	uuid, _, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, permViewPlayers) {
 		handleError(w, r, "access denied")
 		return
 	}
@@ -64,9 +115,70 @@ func adminGetBansMutes(w http.ResponseWriter, r *http.Request) {
 	w.Write(responseJson)
 }
 
+// lockout state for an account whether or not it's connected; accounts under attack usually aren't
+func adminGetLoginState(w http.ResponseWriter, r *http.Request) {
+	uuid, _, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, permViewPlayers) {
+		handleError(w, r, "access denied")
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		handleError(w, r, "user not specified")
+		return
+	}
+
+	userUuid, err := getUuidFromName(user)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+	if userUuid == "" {
+		handleError(w, r, "invalid user specified")
+		return
+	}
+
+	playerInfo := PlayerInfo{
+		Uuid: userUuid,
+		Name: user,
+	}
+
+	failedLogins, lockedUntil := loginThrottle.State(getAccountLoginKey(user))
+	playerInfo.FailedLogins = failedLogins
+
+	// lockouts recorded by other game servers
+	var recordedLockedUntil sql.NullTime
+	err = db.QueryRow("SELECT MAX(expiry) FROM playerLoginLockouts WHERE uuid = ? AND expiry > UTC_TIMESTAMP()", userUuid).Scan(&recordedLockedUntil)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+	if recordedLockedUntil.Valid && recordedLockedUntil.Time.After(lockedUntil) {
+		lockedUntil = recordedLockedUntil.Time
+	}
+
+	if lockedUntil.After(time.Now()) {
+		playerInfo.LockedUntil = &lockedUntil
+	}
+
+	responseJson, err := json.Marshal(playerInfo)
+	if err != nil {
+		handleError(w, r, "error while marshaling")
+		return
+	}
+
+	w.Write(responseJson)
+}
+
 func adminBanMute(w http.ResponseWriter, r *http.Request) {
-	uuid, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
+	perm := permBan
+	if strings.HasSuffix(r.URL.Path, "mute") {
+		perm = permMute
+	}
+
+	uuid, name, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, perm) {
 		handleError(w, r, "access denied")
 		return
 	}
@@ -115,6 +227,10 @@ func adminBanMute(w http.ResponseWriter, r *http.Request) {
 		err = tryMutePlayer(uuid, targetUuid, false, broadcast)
 	case "/admin/unmute":
 		err = tryUnmutePlayer(uuid, targetUuid)
+	case "/admin/shadowmute":
+		err = trySetPlayerShadowMuted(uuid, targetUuid, true)
+	case "/admin/unshadowmute":
+		err = trySetPlayerShadowMuted(uuid, targetUuid, false)
 	case "/admin/tempban":
 		if expiry == nil {
 			handleError(w, r, "tempban requires expiry")
@@ -133,12 +249,19 @@ func adminBanMute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var auditExpiry *time.Time
+	if r.URL.Path == "/admin/tempban" || r.URL.Path == "/admin/tempmute" {
+		auditExpiry = expiry
+	}
+
+	writeModAuditLog(uuid, name, targetUuid, strings.TrimPrefix(r.URL.Path, "/admin/"), query.Get("reason"), auditSourceWeb, auditExpiry)
+
 	w.WriteHeader(200)
 }
 
 func adminChangeUsername(w http.ResponseWriter, r *http.Request) {
-	uuid, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
+	uuid, name, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, permChangeUsername) {
 		handleError(w, r, "access denied")
 		return
 	}
@@ -171,12 +294,14 @@ func adminChangeUsername(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	writeModAuditLog(uuid, name, userUuid, "changeusername", user+" -> "+newUser, auditSourceWeb, nil)
+
 	w.Write([]byte("ok"))
 }
 
 func adminResetPw(w http.ResponseWriter, r *http.Request) {
-	_, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
+	uuid, name, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, permResetPassword) {
 		handleError(w, r, "access denied")
 		return
 	}
@@ -197,8 +322,7 @@ func adminResetPw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	userRank := getPlayerRank(userUuid)
-	if userRank >= rank {
+	if !canActOn(uuid, userUuid, permResetPassword) {
 		handleError(w, r, "target rank too high")
 		return
 	}
@@ -209,12 +333,14 @@ func adminResetPw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	writeModAuditLog(uuid, name, userUuid, "resetpw", "", auditSourceWeb, nil)
+
 	w.Write([]byte(newPw))
 }
 
 func adminManageBadge(w http.ResponseWriter, r *http.Request) {
-	_, _, rank, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
-	if rank == 0 {
+	uuid, name, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, permGrantBadge) {
 		handleError(w, r, "access denied")
 		return
 	}
@@ -274,5 +400,104 @@ func adminManageBadge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	writeModAuditLog(uuid, name, uuidParam, strings.TrimPrefix(r.URL.Path, "/admin/"), idParam, auditSourceWeb, nil)
+
+	w.Write([]byte("ok"))
+}
+
+func adminDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	uuid, name, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, permDeleteMessages) {
+		handleError(w, r, "access denied")
+		return
+	}
+
+	msgId := r.URL.Query().Get("msgId")
+	if msgId == "" {
+		handleError(w, r, "msgId not specified")
+		return
+	}
+
+	authorUuid, partyId, _, err := getChatMessageInfo(msgId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			handleError(w, r, "message not found")
+			return
+		}
+		handleInternalError(w, r, err)
+		return
+	}
+
+	if authorUuid != uuid && !canActOn(uuid, authorUuid, permDeleteMessages) {
+		handleError(w, r, "insufficient rank")
+		return
+	}
+
+	err = removeChatMessage(msgId, uuid, name, authorUuid, partyId, auditSourceWeb)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+func adminManageRole(w http.ResponseWriter, r *http.Request) {
+	uuid, name, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, permManageRoles) {
+		handleError(w, r, "access denied")
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		handleError(w, r, "user not specified")
+		return
+	}
+
+	userUuid, err := getUuidFromName(user)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+	if userUuid == "" {
+		handleError(w, r, "invalid user specified")
+		return
+	}
+
+	roleParam := r.URL.Query().Get("role")
+	if roleParam == "" {
+		handleError(w, r, "role not specified")
+		return
+	}
+
+	role := getRole(roleParam)
+	if role == nil {
+		handleError(w, r, "role not found")
+		return
+	}
+
+	// staff can only hand out or take away roles below their own
+	if role.Priority >= getPlayerRolePriority(uuid) || !canActOn(uuid, userUuid, permManageRoles) {
+		handleError(w, r, "target rank too high")
+		return
+	}
+
+	if r.URL.Path == "/admin/grantrole" {
+		err = grantPlayerRole(userUuid, role.Name)
+	} else {
+		err = revokePlayerRole(userUuid, role.Name)
+	}
+	if err == errRankRole {
+		handleError(w, r, err.Error())
+		return
+	}
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	writeModAuditLog(uuid, name, userUuid, strings.TrimPrefix(r.URL.Path, "/admin/"), role.Name, auditSourceWeb, nil)
+
 	w.Write([]byte("ok"))
 }
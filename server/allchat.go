@@ -0,0 +1,193 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// a message for the opt-in channel shared by every game, as relayed between servers
+type AllGamesChatMessage struct {
+	MsgId    string
+	Game     string
+	Uuid     string
+	Name     string
+	System   string
+	Rank     int
+	Account  bool
+	Badge    string
+	Medals   [5]int
+	Contents string
+}
+
+func (c *SessionClient) handleAc(msg []string) error {
+	if len(msg) != 2 {
+		return errors.New("segment count mismatch")
+	}
+
+	c.allGamesChat = msg[1] == "1"
+
+	return nil
+}
+
+func (c *SessionClient) handleAsay(msg []string) error {
+	if !c.allGamesChat {
+		return errors.New("all games chat not enabled")
+	}
+
+	if c.muted {
+		return errors.New("player is muted")
+	}
+
+	if len(msg) != 2 {
+		return errors.New("segment count mismatch")
+	}
+
+	if c.name == "" {
+		return errors.New("no name set")
+	}
+
+	msgContents, verdict, flags, err := c.filterChatMessage(strings.TrimSpace(msg[1]))
+	if err != nil {
+		return err
+	}
+
+	if msgContents == "" || len(msgContents) > 150 {
+		return errors.New("invalid message")
+	}
+
+	if len(flags) > 0 && !c.banned {
+		go c.reportFlaggedChatMessage("", msgContents, flags)
+	}
+
+	chatMsg := &AllGamesChatMessage{
+		MsgId:    randString(12),
+		Game:     config.gameName,
+		Uuid:     c.uuid,
+		Name:     c.name,
+		System:   c.system,
+		Rank:     c.rank,
+		Account:  c.account,
+		Badge:    c.badge,
+		Medals:   c.medals,
+		Contents: msgContents,
+	}
+
+	if c.banned || c.shadowMuted || verdict == chatFilterDrop {
+		// so it looks like it went through
+		c.outbox <- chatMsg.build()
+		return nil
+	}
+
+	err = writeAllGamesChatMessage(chatMsg)
+	if err != nil {
+		return err
+	}
+
+	deliverAllGamesChatMessage(chatMsg, c.blockedUsers)
+
+	forEachGame(func(game string) error {
+		if game == config.gameName {
+			return nil
+		}
+
+		return ipcCall(game, "IPC.RelayChat", *chatMsg, false)
+	})
+
+	return nil
+}
+
+func (m *AllGamesChatMessage) build() []byte {
+	return buildMsg("asay", m.Uuid, m.Name, m.System, m.Rank, m.Account, m.Badge, m.Medals[:], m.Game, m.Contents, m.MsgId)
+}
+
+// checks a message from a sibling server against this server's own rules before delivering it
+func receiveAllGamesChatMessage(chatMsg *AllGamesChatMessage) error {
+	// moderation state may have changed after the origin server checked it
+	if banned, muted := getPlayerModerationStatus(chatMsg.Uuid); banned || muted {
+		return nil
+	}
+
+	// each game has its own filter list
+	filtered := wordFilter.Filter(chatMsg.Contents)
+	if filtered.Blocked {
+		return nil
+	}
+
+	chatMsg.Contents = filtered.Contents
+
+	blockedUuids, err := getPlayerBlockedUuids(chatMsg.Uuid)
+	if err != nil {
+		return err
+	}
+
+	deliverAllGamesChatMessage(chatMsg, blockedUuids)
+
+	return nil
+}
+
+func deliverAllGamesChatMessage(chatMsg *AllGamesChatMessage, senderBlockedUuids map[string]bool) {
+	msg := chatMsg.build()
+
+	for _, client := range clients.Get() {
+		if !client.allGamesChat {
+			continue
+		}
+
+		if senderBlockedUuids[client.uuid] || client.blockedUsers[chatMsg.Uuid] {
+			continue
+		}
+
+		client.trySend(msg)
+	}
+}
+
+// returns everyone the player has blocked or been blocked by, in any game
+func getPlayerBlockedUuids(uuid string) (map[string]bool, error) {
+	blockedUuids := make(map[string]bool)
+
+	results, err := db.Query("SELECT targetUuid FROM playerBlocks WHERE uuid = ? UNION SELECT uuid FROM playerBlocks WHERE targetUuid = ?", uuid, uuid)
+	if err != nil {
+		return blockedUuids, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var blockedUuid string
+
+		err := results.Scan(&blockedUuid)
+		if err != nil {
+			return blockedUuids, err
+		}
+
+		blockedUuids[blockedUuid] = true
+	}
+
+	return blockedUuids, nil
+}
+
+func writeAllGamesChatMessage(chatMsg *AllGamesChatMessage) error {
+	_, err := db.Exec("INSERT INTO allGamesChatMessages (msgId, game, uuid, contents, timestamp) VALUES (?, ?, ?, ?, UTC_TIMESTAMP())", chatMsg.MsgId, chatMsg.Game, chatMsg.Uuid, chatMsg.Contents)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
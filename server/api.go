@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"html"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
@@ -38,12 +39,20 @@ type PlayerInfo struct {
 	Uuid            string `json:"uuid"`
 	Name            string `json:"name"`
 	Rank            int    `json:"rank"`
+	Game            string `json:"game,omitempty"`
 	Badge           string `json:"badge"`
 	BadgeSlotRows   int    `json:"badgeSlotRows"`
 	BadgeSlotCols   int    `json:"badgeSlotCols"`
 	ScreenshotLimit int    `json:"screenshotLimit"`
 	Medals          [5]int `json:"medals"`
 	LocationIds     []int  `json:"locationIds"`
+
+	// moderator-only fields
+	Roles        []string          `json:"roles,omitempty"`
+	ShadowMuted  bool              `json:"shadowMuted,omitempty"`
+	FailedLogins int               `json:"failedLogins,omitempty"`
+	LockedUntil  *time.Time        `json:"lockedUntil,omitempty"`
+	Alts         []*LinkedIdentity `json:"alts,omitempty"`
 }
 
 type PlayerListData struct {
@@ -70,6 +79,8 @@ type PlayerListFullData struct {
 
 	Online     bool      `json:"online"`
 	LastActive time.Time `json:"lastActive"`
+
+	Game string `json:"game,omitempty"` // only set where players from other games can appear
 }
 
 const (
@@ -89,6 +100,7 @@ func initApi() {
 	http.HandleFunc("/room", handleRoom)
 
 	http.HandleFunc("/admin/getplayers", adminGetPlayers)
+	http.HandleFunc("/admin/getloginstate", adminGetLoginState)
 	http.HandleFunc("/admin/getbans", adminGetBansMutes)
 	http.HandleFunc("/admin/getmutes", adminGetBansMutes)
 	http.HandleFunc("/admin/ban", adminBanMute)
@@ -97,11 +109,25 @@ func initApi() {
 	http.HandleFunc("/admin/unmute", adminBanMute)
 	http.HandleFunc("/admin/tempban", adminBanMute)
 	http.HandleFunc("/admin/tempmute", adminBanMute)
+	http.HandleFunc("/admin/shadowmute", adminBanMute)
+	http.HandleFunc("/admin/unshadowmute", adminBanMute)
 	http.HandleFunc("/admin/dban", adminBanMute)
 	http.HandleFunc("/admin/changeusername", adminChangeUsername)
 	http.HandleFunc("/admin/resetpw", adminResetPw)
 	http.HandleFunc("/admin/grantbadge", adminManageBadge)
 	http.HandleFunc("/admin/revokebadge", adminManageBadge)
+	http.HandleFunc("/admin/grantrole", adminManageRole)
+	http.HandleFunc("/admin/revokerole", adminManageRole)
+	http.HandleFunc("/admin/auditlog", adminGetAuditLog)
+	http.HandleFunc("/admin/deletemsg", adminDeleteMessage)
+	http.HandleFunc("/admin/reports", adminReports)
+	http.HandleFunc("/admin/reports/case", adminReports)
+	http.HandleFunc("/admin/reports/claim", adminReports)
+	http.HandleFunc("/admin/reports/unclaim", adminReports)
+	http.HandleFunc("/admin/reports/note", adminReports)
+	http.HandleFunc("/admin/reports/resolve", adminReports)
+	http.HandleFunc("/admin/warn", adminSanction)
+	http.HandleFunc("/admin/sanction", adminSanction)
 
 	http.HandleFunc("/api/party", handleParty)
 	http.HandleFunc("/api/savesync", handleSaveSync)
@@ -112,6 +138,7 @@ func initApi() {
 	http.HandleFunc("/api/login", handleLogin)
 	http.HandleFunc("/api/logout", handleLogout)
 	http.HandleFunc("/api/changepw", handleChangePw)
+	http.HandleFunc("/api/account", handleAccount)
 
 	http.HandleFunc("/api/addplayerfriend", handleAddPlayerFriend)
 	http.HandleFunc("/api/removeplayerfriend", handleRemovePlayerFriend)
@@ -121,6 +148,9 @@ func initApi() {
 	http.HandleFunc("/api/blocklist", handleBlockList)
 
 	http.HandleFunc("/api/chathistory", handleChatHistory)
+	http.HandleFunc("/api/chatsearch", handleChatSearch)
+	http.HandleFunc("/api/chatcontext", handleChatContext)
+	http.HandleFunc("/api/dm", handleDm)
 	http.HandleFunc("/api/clearchathistory", handleClearChatHistory)
 
 	http.HandleFunc("/api/gamelocations", handleGameLocations)
@@ -145,14 +175,13 @@ func initApi() {
 
 func handleParty(w http.ResponseWriter, r *http.Request) {
 	var uuid string
-	var rank int
 	var banned bool
 
 	token := r.Header.Get("Authorization")
 	if token == "" {
 		uuid, banned, _ = getOrCreatePlayerData(getIp(r))
 	} else {
-		uuid, _, rank, _, banned, _ = getPlayerDataFromToken(token)
+		uuid, _, _, _, banned, _ = getPlayerDataFromToken(token)
 		if uuid == "" {
 			handleError(w, r, "invalid token")
 			return
@@ -170,6 +199,26 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// bcrypt is slow, so new passes are hashed before partiesMutex is taken
+	var passHash string
+	if commandParam == "create" || commandParam == "update" {
+		if passParam := r.URL.Query().Get("pass"); passParam != "" && r.URL.Query().Get("public") == "" {
+			if len(passParam) > 72 {
+				handleError(w, r, "pass too long")
+				return
+			}
+			var err error
+			passHash, err = hashPartyPass(passParam)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+		}
+	}
+
+	partiesMutex.Lock()
+	defer partiesMutex.Unlock()
+
 	switch commandParam {
 	case "id":
 		partyId, err := getPlayerPartyId(uuid)
@@ -180,7 +229,7 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(strconv.Itoa(partyId)))
 		return
 	case "list":
-		partyListData, err := getAllPartyData()
+		partyListData, err := getPublicPartyData()
 		if err != nil {
 			handleInternalError(w, r, err)
 			return
@@ -261,13 +310,13 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 		}
 		var pass string
 		if !public {
-			passParam := r.URL.Query().Get("pass")
-			if passParam != "" {
-				if len(passParam) > 255 {
-					handleError(w, r, "pass too long")
-					return
+			if passHash != "" {
+				pass = passHash
+			} else if !create {
+				// the hash never leaves the server, so an empty pass on update keeps the current one
+				if party, ok := parties[partyId]; ok && !party.Public {
+					pass = party.Pass
 				}
-				pass = passParam
 			}
 		}
 		themeParam := r.URL.Query().Get("theme")
@@ -279,10 +328,25 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 			handleError(w, r, "invalid system name for theme")
 			return
 		}
+		themePolicy := partyThemePolicyOwner
+		if !create {
+			if party, ok := parties[partyId]; ok && party.ThemePolicy != "" {
+				themePolicy = party.ThemePolicy
+			}
+		}
+		if themePolicyParam := r.URL.Query().Get("themePolicy"); themePolicyParam != "" {
+			if !isValidPartyThemePolicy(themePolicyParam) {
+				handleError(w, r, "invalid theme policy")
+				return
+			}
+			themePolicy = themePolicyParam
+		}
 		if create {
-			partyId, err = createPartyData(nameParam, public, pass, themeParam, description, uuid)
+			// can only be chosen when creating the party
+			crossGame := r.URL.Query().Get("crossGame") != ""
+			partyId, err = createPartyData(nameParam, public, crossGame, pass, themeParam, themePolicy, description, uuid)
 		} else {
-			err = updatePartyData(partyId, nameParam, public, pass, themeParam, description, uuid)
+			err = updatePartyData(partyId, nameParam, public, pass, themeParam, themePolicy, description, uuid)
 		}
 		if err != nil {
 			handleInternalError(w, r, err)
@@ -308,42 +372,103 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 			handleError(w, r, "invalid partyId value")
 			return
 		}
-		if rank == 0 {
-			party, ok := parties[partyId]
+		err = ensurePartyCached(partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		party := parties[partyId]
+		if !party.Public && !can(uuid, permJoinPrivateParty) {
+			passParam := r.URL.Query().Get("pass")
+			if passParam == "" {
+				handleError(w, r, "pass not specified")
+				return
+			}
+			ok, wait := checkPartyJoinPass(partyId, uuid, getIp(r), passParam)
+			if wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "too many attempts", http.StatusTooManyRequests)
+				return
+			}
 			if !ok {
-				handleInternalError(w, r, errors.New("party id not in cache"))
+				http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
 				return
 			}
-			if !party.Public {
-				passParam := r.URL.Query().Get("pass")
-				if passParam == "" {
-					handleError(w, r, "pass not specified")
-					return
-				}
-				if party.Pass != "" && passParam != party.Pass {
-					http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
-					return
-				}
+		}
+		err = switchPlayerParty(partyId, uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+	case "invite", "link":
+		partyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if partyId == 0 {
+			handleError(w, r, "player not in a party")
+			return
+		}
+		if !isPartyOfficer(partyId, uuid) {
+			handleError(w, r, "attempted party invite from non-officer")
+			return
+		}
+		if commandParam == "link" {
+			token, err := createPartyInviteLink(partyId, uuid)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
 			}
+			w.Write([]byte(token))
+			return
 		}
-		playerPartyId, err := getPlayerPartyId(uuid)
+		playerParam := r.URL.Query().Get("player")
+		if playerParam == "" {
+			handleError(w, r, "player not specified")
+			return
+		}
+		err = createPartyInvite(partyId, uuid, playerParam)
 		if err != nil {
 			handleInternalError(w, r, err)
 			return
 		}
-		if playerPartyId != 0 {
-			err = handlePartyMemberLeave(partyId, uuid)
+	case "accept", "decline", "request":
+		partyIdParam := r.URL.Query().Get("partyId")
+		if partyIdParam == "" {
+			handleError(w, r, "partyId not specified")
+			return
+		}
+		partyId, err := strconv.Atoi(partyIdParam)
+		if err != nil {
+			handleError(w, r, "invalid partyId value")
+			return
+		}
+		if commandParam == "request" {
+			err = createPartyJoinRequest(partyId, uuid)
 			if err != nil {
 				handleInternalError(w, r, err)
 				return
 			}
+			break
 		}
-		err = joinPlayerParty(partyId, uuid)
+		invited, err := consumePartyInvite(partyId, uuid)
 		if err != nil {
 			handleInternalError(w, r, err)
 			return
 		}
-	case "leave":
+		if !invited {
+			handleError(w, r, "no pending invite")
+			return
+		}
+		if commandParam == "accept" {
+			err = switchPlayerParty(partyId, uuid)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+		}
+	case "approve", "deny":
 		partyId, err := getPlayerPartyId(uuid)
 		if err != nil {
 			handleInternalError(w, r, err)
@@ -353,13 +478,71 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 			handleError(w, r, "player not in a party")
 			return
 		}
-		err = handlePartyMemberLeave(partyId, uuid)
+		if !isPartyOfficer(partyId, uuid) {
+			handleError(w, r, "attempted join request response from non-officer")
+			return
+		}
+		playerParam := r.URL.Query().Get("player")
+		if playerParam == "" {
+			handleError(w, r, "player not specified")
+			return
+		}
+		approve := commandParam == "approve"
+		requested, err := consumePartyJoinRequest(partyId, playerParam)
 		if err != nil {
 			handleInternalError(w, r, err)
 			return
 		}
-	case "kick", "transfer":
-		kick := commandParam == "kick"
+		if !requested {
+			handleError(w, r, "no pending join request")
+			return
+		}
+		kind := partyInviteDenied
+		if approve {
+			err = switchPlayerParty(partyId, playerParam)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+			kind = partyInviteApproved
+		}
+		sendPartyInviteNotice(playerParam, kind, partyId, parties[partyId].Name, uuid, getNameFromUuid(uuid))
+	case "invites":
+		partyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		invitesJson, err := getPendingPartyInvitesJson(uuid, partyId)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		w.Write(invitesJson)
+		return
+	case "redeem":
+		tokenParam := r.URL.Query().Get("token")
+		if tokenParam == "" {
+			handleError(w, r, "token not specified")
+			return
+		}
+		partyId, err := consumePartyInviteLink(tokenParam)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if partyId == 0 {
+			handleError(w, r, "invalid or expired invite link")
+			return
+		}
+		err = switchPlayerParty(partyId, uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		w.Write([]byte(strconv.Itoa(partyId)))
+		return
+	case "leave":
 		partyId, err := getPlayerPartyId(uuid)
 		if err != nil {
 			handleInternalError(w, r, err)
@@ -369,14 +552,26 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 			handleError(w, r, "player not in a party")
 			return
 		}
-		ownerUuid, err := getPartyOwnerUuid(partyId)
+		err = handlePartyMemberLeave(partyId, uuid)
 		if err != nil {
 			handleInternalError(w, r, err)
 			return
 		}
-		if ownerUuid != uuid {
+	case "kick", "transfer":
+		kick := commandParam == "kick"
+		partyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if partyId == 0 {
+			handleError(w, r, "player not in a party")
+			return
+		}
+		role := getPartyRole(partyId, uuid)
+		if role != partyRoleOwner && !(kick && role == partyRoleOfficer) {
 			if kick {
-				handleError(w, r, "attempted party kick non-owner")
+				handleError(w, r, "attempted party kick non-officer")
 			} else {
 				handleError(w, r, "attempted owner transfer from non-owner")
 			}
@@ -400,14 +595,137 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
+		if kick && role != partyRoleOwner && getPartyRole(partyId, playerParam) != partyRoleMember {
+			handleError(w, r, "officers can only kick members")
+			return
+		}
 		if kick {
 			err = leavePlayerParty(playerParam)
 		} else {
-			err = setPartyOwner(partyId, playerParam)
+			err = setPartyOwner(partyId, playerParam, uuid)
 		}
 		if err != nil {
 			handleInternalError(w, r, nil)
 		}
+	case "role":
+		partyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if partyId == 0 {
+			handleError(w, r, "player not in a party")
+			return
+		}
+		if getPartyRole(partyId, uuid) != partyRoleOwner {
+			handleError(w, r, "attempted role change from non-owner")
+			return
+		}
+		playerParam := r.URL.Query().Get("player")
+		if playerParam == "" {
+			handleError(w, r, "player not specified")
+			return
+		}
+		targetRole := getPartyRole(partyId, playerParam)
+		if targetRole != partyRoleOfficer && targetRole != partyRoleMember {
+			handleError(w, r, "specified player not a member of the party")
+			return
+		}
+		roleParam := r.URL.Query().Get("role")
+		if roleParam != partyRoleOfficer && roleParam != partyRoleMember {
+			handleError(w, r, "invalid role")
+			return
+		}
+		if roleParam == targetRole {
+			break
+		}
+		err = setPartyMemberRole(partyId, playerParam, roleParam, uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+	case "retention":
+		partyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if partyId == 0 {
+			handleError(w, r, "player not in a party")
+			return
+		}
+		if getPartyRole(partyId, uuid) != partyRoleOwner {
+			handleError(w, r, "attempted retention change from non-owner")
+			return
+		}
+		days, err := strconv.Atoi(r.URL.Query().Get("days"))
+		if err != nil || days < 1 || days > config.party.maxChatRetentionDays {
+			handleError(w, r, "invalid days value")
+			return
+		}
+		err = setPartyChatRetention(partyId, days)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+	case "setdescription", "settheme", "pin", "unpin":
+		partyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if partyId == 0 {
+			handleError(w, r, "player not in a party")
+			return
+		}
+		if commandParam == "settheme" {
+			if !canChangePartyTheme(partyId, uuid) {
+				handleError(w, r, "not allowed to change the party theme")
+				return
+			}
+			themeParam := r.URL.Query().Get("theme")
+			if themeParam == "" {
+				handleError(w, r, "theme not specified")
+				return
+			}
+			if !assets.IsValidSystem(themeParam, true) {
+				handleError(w, r, "invalid system name for theme")
+				return
+			}
+			err = setPartyTheme(partyId, themeParam)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+			break
+		}
+		if !isPartyOfficer(partyId, uuid) {
+			handleError(w, r, "attempted party edit from non-officer")
+			return
+		}
+		switch commandParam {
+		case "setdescription":
+			err = setPartyDescription(partyId, html.EscapeString(r.URL.Query().Get("description")))
+		case "pin":
+			msgIdParam := r.URL.Query().Get("msgId")
+			if msgIdParam == "" {
+				handleError(w, r, "msgId not specified")
+				return
+			}
+			var msgPartyId int
+			_, msgPartyId, _, err = getChatMessageInfo(msgIdParam)
+			if err != nil || msgPartyId != partyId {
+				handleError(w, r, "message not found")
+				return
+			}
+			err = setPartyPinnedMessage(partyId, msgIdParam)
+		case "unpin":
+			err = setPartyPinnedMessage(partyId, "")
+		}
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
 	case "disband":
 		partyId, err := getPlayerPartyId(uuid)
 		if err != nil {
@@ -436,6 +754,27 @@ func handleParty(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok"))
 }
 
+// leaves the player's current party, if any, and joins partyId
+func switchPlayerParty(partyId int, playerUuid string) error {
+	playerPartyId, err := getPlayerPartyId(playerUuid)
+	if err != nil {
+		return err
+	}
+
+	if playerPartyId == partyId {
+		return errors.New("player already in party")
+	}
+
+	if playerPartyId != 0 {
+		err = handlePartyMemberLeave(playerPartyId, playerUuid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return joinPlayerParty(partyId, playerUuid)
+}
+
 func handlePartyMemberLeave(partyId int, playerUuid string) error {
 	ownerUuid, err := getPartyOwnerUuid(partyId)
 	if err != nil {
@@ -575,7 +914,6 @@ func handleVm(w http.ResponseWriter, r *http.Request) {
 func handleBadge(w http.ResponseWriter, r *http.Request) {
 	var uuid string
 	var name string
-	var rank int
 	var badge string
 	var badgeSlotRows int
 	var badgeSlotCols int
@@ -597,7 +935,7 @@ func handleBadge(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		uuid, name, rank, badge, banned, _ = getPlayerDataFromToken(token)
+		uuid, name, _, badge, banned, _ = getPlayerDataFromToken(token)
 		if uuid == "" {
 			handleError(w, r, "invalid token")
 			return
@@ -643,7 +981,7 @@ func handleBadge(w http.ResponseWriter, r *http.Request) {
 					handleInternalError(w, r, err)
 					return
 				}
-				badgeData, err := getPlayerBadgeData(uuid, rank, tags, true, true)
+				badgeData, err := getPlayerBadgeData(uuid, tags, true, true)
 				if err != nil {
 					handleInternalError(w, r, err)
 					return
@@ -662,7 +1000,7 @@ func handleBadge(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 
-			if rank < 2 && !unlocked {
+			if !unlocked && !can(uuid, permViewHiddenBadges) {
 				handleError(w, r, "specified badge is locked")
 				return
 			}
@@ -716,7 +1054,7 @@ func handleBadge(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if r.URL.Query().Get("simple") == "true" {
-			simpleBadgeData, err := getSimplePlayerBadgeData(uuid, rank, tags, token != "")
+			simpleBadgeData, err := getSimplePlayerBadgeData(uuid, tags, token != "")
 			if err != nil {
 				handleInternalError(w, r, err)
 				return
@@ -732,7 +1070,7 @@ func handleBadge(w http.ResponseWriter, r *http.Request) {
 				handleError(w, r, "cannot retrieve player badge data for guest player")
 				return
 			}
-			badgeData, err := getPlayerBadgeData(uuid, rank, tags, true, false)
+			badgeData, err := getPlayerBadgeData(uuid, tags, true, false)
 			if err != nil {
 				handleInternalError(w, r, err)
 				return
@@ -763,7 +1101,7 @@ func handleBadge(w http.ResponseWriter, r *http.Request) {
 			}
 			newTags = lastUnlocked.UTC().After(sinceTimestamp)
 		}
-		newUnlockedBadgeIds, err := getPlayerNewUnlockedBadgeIds(uuid, rank, tags)
+		newUnlockedBadgeIds, err := getPlayerNewUnlockedBadgeIds(uuid, tags)
 		if err != nil {
 			handleInternalError(w, r, err)
 			return
@@ -892,6 +1230,12 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		uuid, _, _ = getOrCreatePlayerData(ip)
 	}
 
+	// the identity graph keeps the link to the ip after it's cleared below
+	err := recordIpIdentitySignals(uuid, ip)
+	if err != nil {
+		writeErrLog(uuid, r.URL.Path, err.Error())
+	}
+
 	db.Exec("UPDATE players SET ip = NULL WHERE ip = ?", ip) // set ip to null to disable ip-based login
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -914,18 +1258,27 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkLoginThrottle(w, r, user) {
+		return
+	}
+
 	var userPassHash string
 	db.QueryRow("SELECT pass FROM accounts WHERE user = ?", user).Scan(&userPassHash)
 
 	if userPassHash == "" || bcrypt.CompareHashAndPassword([]byte(userPassHash), []byte(password)) != nil {
+		recordFailedLogin(user, getIp(r))
 		handleError(w, r, "bad login")
 		return
 	}
 
+	resetLoginThrottle(user, getIp(r))
+
 	token := randString(32)
 	db.Exec("INSERT INTO playerSessions (sessionId, uuid, expiration) (SELECT ?, uuid, DATE_ADD(NOW(), INTERVAL 30 DAY) FROM accounts WHERE user = ?)", token, user)
 	db.Exec("UPDATE accounts SET timestampLoggedIn = NOW() WHERE user = ?", user)
 
+	recordLoginIdentitySignals(user, getIp(r), r.Header.Get("Authorization"))
+
 	w.Write([]byte(token))
 }
 
@@ -955,13 +1308,13 @@ func handleChangePw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, loginUser, rank, _, _, _, _ := getPlayerInfoFromToken(token)
+	loginUuid, loginUser, _, _, _, _, _ := getPlayerInfoFromToken(token)
 
 	// GET params user, new password
 	user, newPassword := r.URL.Query().Get("user"), r.URL.Query().Get("newPassword")
 
 	var username string
-	if rank < 1 || user == "" {
+	if user == "" || !can(loginUuid, permResetPassword) {
 		username = loginUser
 
 		// GET param password
@@ -972,19 +1325,36 @@ func handleChangePw(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if !checkLoginThrottle(w, r, username) {
+			return
+		}
+
 		var userPassHash string
 		db.QueryRow("SELECT pass FROM accounts WHERE user = ?", username).Scan(&userPassHash)
 
 		if userPassHash == "" || bcrypt.CompareHashAndPassword([]byte(userPassHash), []byte(password)) != nil {
+			recordFailedLogin(username, getIp(r))
 			handleError(w, r, "bad login")
 			return
 		}
+
+		resetLoginThrottle(username, getIp(r))
 	} else {
 		if !isOkString(user) || newPassword == "" || len(newPassword) > 72 {
 			handleError(w, r, "bad response")
 			return
 		}
 
+		userUuid, err := getUuidFromName(user)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if userUuid == "" || !canActOn(loginUuid, userUuid, permResetPassword) {
+			handleError(w, r, "access denied")
+			return
+		}
+
 		username = user
 	}
 
@@ -1085,6 +1455,8 @@ func handleAddRemovePlayerFriend(w http.ResponseWriter, r *http.Request, isAdd b
 		return
 	}
 
+	refreshFriendPresence(uuid, targetUuid)
+
 	w.Write([]byte("ok"))
 }
 
@@ -1128,6 +1500,7 @@ func handleBlockPlayer(w http.ResponseWriter, r *http.Request) {
 	}
 	// after blocking, remove friend
 	_ = removePlayerFriend(uuid, targetUuid)
+	refreshFriendPresence(uuid, targetUuid)
 
 	// "disconnect" them NOW!!!
 	if client, ok := clients.Load(uuid); ok {
@@ -1381,6 +1754,11 @@ func handleChatHistory(w http.ResponseWriter, r *http.Request) {
 		uuid = getUuidFromToken(token)
 	}
 
+	if r.URL.Query().Get("scope") == "party" {
+		handlePartyChatHistory(w, r, uuid)
+		return
+	}
+
 	lastMsgId := r.URL.Query().Get("lastMsgId")
 
 	if lastMsgId != "" && len(lastMsgId) != 12 {
@@ -1599,3 +1977,55 @@ func queryWiki(action string, queryString string) (response string, err error) {
 
 	return response, nil
 }
+
+func handlePartyChatHistory(w http.ResponseWriter, r *http.Request, uuid string) {
+	// only current members can read a party's history
+	partyId, err := getPlayerPartyId(uuid)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+	if partyId == 0 {
+		handleError(w, r, "player not in a party")
+		return
+	}
+
+	before := r.URL.Query().Get("before")
+	if before != "" && len(before) != 12 {
+		handleError(w, r, "invalid before")
+		return
+	}
+
+	limit := 50
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil {
+			handleError(w, r, "invalid limit value")
+			return
+		}
+	}
+
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+
+	search := strings.TrimSpace(r.URL.Query().Get("search"))
+	if len(search) > 100 {
+		handleError(w, r, "search too long")
+		return
+	}
+
+	chatHistory, err := getPartyChatMessageHistory(partyId, limit, before, search)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	chatHistoryJson, err := json.Marshal(chatHistory)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write(chatHistoryJson)
+}
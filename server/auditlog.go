@@ -0,0 +1,156 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	auditSourceWeb     = "web"
+	auditSourceDiscord = "discord"
+	auditSourceChat    = "chat"
+	auditSourceSystem  = "system"
+)
+
+type ModAuditEntry struct {
+	Id         int        `json:"id"`
+	ActorUuid  string     `json:"actorUuid,omitempty"`
+	ActorName  string     `json:"actorName"`
+	TargetUuid string     `json:"targetUuid"`
+	TargetName string     `json:"targetName"`
+	Action     string     `json:"action"`
+	Reason     string     `json:"reason,omitempty"`
+	Expiry     *time.Time `json:"expiry,omitempty"`
+	Game       string     `json:"game,omitempty"`
+	Source     string     `json:"source"`
+	Timestamp  time.Time  `json:"timestamp"`
+}
+
+// appends an entry to the moderation audit log; the log is never updated or pruned.
+// actorUuid is empty for actions taken outside of the game, such as from the Discord bot
+func writeModAuditLog(actorUuid, actorName, targetUuid, action, reason, source string, expiry *time.Time) {
+	var actorUuidArg, expiryArg any
+	if actorUuid != "" {
+		actorUuidArg = actorUuid
+	}
+	if expiry != nil {
+		expiryArg = expiry.UTC()
+	}
+
+	game := config.gameName
+	if source == auditSourceDiscord {
+		// actions from the bot apply to every game
+		game = ""
+	}
+
+	_, err := db.Exec("INSERT INTO modAuditLog (actorUuid, actorName, targetUuid, targetName, action, reason, expiry, game, source, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())",
+		actorUuidArg, actorName, targetUuid, getNameFromUuid(targetUuid), action, reason, expiryArg, game, source)
+	if err != nil {
+		eprintf("AUDIT", "failed to record %s on %s by %s: %s", action, targetUuid, actorName, err)
+	}
+}
+
+func adminGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	uuid, _, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, permViewAuditLog) {
+		handleError(w, r, "access denied")
+		return
+	}
+
+	query := r.URL.Query()
+
+	sqlQuery := "SELECT id, COALESCE(actorUuid, ''), actorName, targetUuid, targetName, action, reason, expiry, game, source, timestamp FROM modAuditLog WHERE 1"
+	var args []any
+
+	// actor and target accept either a uuid or a username
+	if actor := query.Get("actor"); actor != "" {
+		actorUuid, _ := getUuidFromName(actor)
+		sqlQuery += " AND (actorUuid = ? OR actorUuid = ? OR actorName = ?)"
+		args = append(args, actor, actorUuid, actor)
+	}
+
+	if target := query.Get("target"); target != "" {
+		targetUuid, _ := getUuidFromName(target)
+		sqlQuery += " AND (targetUuid = ? OR targetUuid = ?)"
+		args = append(args, target, targetUuid)
+	}
+
+	for _, filter := range []string{"action", "source", "game"} {
+		if value := query.Get(filter); value != "" {
+			sqlQuery += " AND " + filter + " = ?"
+			args = append(args, value)
+		}
+	}
+
+	if after, err := time.Parse(time.RFC3339, query.Get("after")); err == nil {
+		sqlQuery += " AND timestamp >= ?"
+		args = append(args, after.UTC())
+	}
+
+	if before, err := time.Parse(time.RFC3339, query.Get("before")); err == nil {
+		sqlQuery += " AND timestamp < ?"
+		args = append(args, before.UTC())
+	}
+
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 100
+	}
+
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	sqlQuery += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	results, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	defer results.Close()
+
+	entries := []*ModAuditEntry{}
+
+	for results.Next() {
+		entry := &ModAuditEntry{}
+
+		err := results.Scan(&entry.Id, &entry.ActorUuid, &entry.ActorName, &entry.TargetUuid, &entry.TargetName, &entry.Action, &entry.Reason, &entry.Expiry, &entry.Game, &entry.Source, &entry.Timestamp)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		entries = append(entries, entry)
+	}
+
+	entriesJson, err := json.Marshal(entries)
+	if err != nil {
+		handleError(w, r, "error while marshaling")
+		return
+	}
+
+	w.Write(entriesJson)
+}
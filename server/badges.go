@@ -327,7 +327,7 @@ func (c *RoomClient) checkRoomConditions(trigger string, value string) {
 }
 
 func (c *RoomClient) checkCondition(condition *Condition, roomId int, minigames []*Minigame, trigger string, value string) {
-	if condition.Disabled && c.session.rank < 2 {
+	if condition.Disabled && !can(c.session.uuid, permViewHiddenBadges) {
 		return
 	}
 
@@ -458,7 +458,7 @@ func (c *RoomClient) checkConditionCoords(condition *Condition) bool {
 			((condition.MapY1 == -1 || condition.MapY1 <= c.y) && (condition.MapY2 == -1 || condition.MapY2 >= c.y)))
 }
 
-func getPlayerBadgeData(playerUuid string, playerRank int, playerTags []string, account bool, simple bool) (playerBadges []*PlayerBadge, err error) {
+func getPlayerBadgeData(playerUuid string, playerTags []string, account bool, simple bool) (playerBadges []*PlayerBadge, err error) {
 	var playerExp int
 	var playerEventLocationCount int
 	var playerEventLocationCompletion int
@@ -508,9 +508,12 @@ func getPlayerBadgeData(playerUuid string, playerRank int, playerTags []string,
 		}
 	}
 
+	viewDevBadges := can(playerUuid, permViewDevBadges)
+	viewHiddenBadges := can(playerUuid, permViewHiddenBadges)
+
 	for game, gameBadges := range badges {
 		for badgeId, gameBadge := range gameBadges {
-			if gameBadge.Dev && playerRank == 0 {
+			if gameBadge.Dev && !viewDevBadges {
 				continue
 			}
 
@@ -623,7 +626,7 @@ func getPlayerBadgeData(playerUuid string, playerRank int, playerTags []string,
 				if !playerBadge.Hidden {
 					playerBadgeCount++
 				}
-			} else if !simple && gameBadge.Hidden && playerRank < 2 {
+			} else if !simple && gameBadge.Hidden && !viewHiddenBadges {
 				continue
 			}
 
@@ -700,8 +703,8 @@ func getPlayerBadgeData(playerUuid string, playerRank int, playerTags []string,
 	return playerBadges, nil
 }
 
-func getSimplePlayerBadgeData(playerUuid string, playerRank int, playerTags []string, account bool) (playerBadges []*SimplePlayerBadge, err error) {
-	badgeData, err := getPlayerBadgeData(playerUuid, playerRank, playerTags, account, true)
+func getSimplePlayerBadgeData(playerUuid string, playerTags []string, account bool) (playerBadges []*SimplePlayerBadge, err error) {
+	badgeData, err := getPlayerBadgeData(playerUuid, playerTags, account, true)
 	if err != nil {
 		return playerBadges, err
 	}
@@ -714,8 +717,8 @@ func getSimplePlayerBadgeData(playerUuid string, playerRank int, playerTags []st
 	return playerBadges, nil
 }
 
-func getPlayerNewUnlockedBadgeIds(playerUuid string, playerRank int, playerTags []string) (badgeIds []string, err error) {
-	badgeData, err := getPlayerBadgeData(playerUuid, playerRank, playerTags, true, true)
+func getPlayerNewUnlockedBadgeIds(playerUuid string, playerTags []string) (badgeIds []string, err error) {
+	badgeData, err := getPlayerBadgeData(playerUuid, playerTags, true, true)
 	if err != nil {
 		return badgeIds, err
 	}
@@ -0,0 +1,285 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ChatCommand struct {
+	usage       string
+	description string
+	perm        string // empty if anyone can use it
+	run         func(c *SessionClient, args []string) (reply string, err error)
+}
+
+var chatCommands map[string]*ChatCommand
+
+func initChatCommands() {
+	chatCommands = map[string]*ChatCommand{
+		"help": {
+			usage:       "/help",
+			description: "lists the commands available to you",
+			run:         runHelpCommand,
+		},
+		"roll": {
+			usage:       "/roll [sides]",
+			description: "rolls a die, 100 sided unless specified",
+			run:         runRollCommand,
+		},
+		"online": {
+			usage:       "/online",
+			description: "shows how many players are online",
+			run:         runOnlineCommand,
+		},
+		"where": {
+			usage:       "/where <friend>",
+			description: "shows where a friend is",
+			run:         runWhereCommand,
+		},
+		"w": {
+			usage:       "/w <name> <message>",
+			description: "sends a direct message",
+			run:         runWhisperCommand,
+		},
+		"report": {
+			usage:       "/report <name> <reason number>",
+			description: "reports a player to the moderators",
+			run:         runReportCommand,
+		},
+		"mute": {
+			usage:       "/mute <name> <duration> [reason]",
+			description: "mutes a player in every game, e.g. /mute name 1h spam",
+			perm:        permMute,
+			run:         runMuteCommand,
+		},
+	}
+}
+
+// runs a chat message starting with "/" as a command; replies only go to the sender and nothing is stored
+func (c *SessionClient) handleChatCommand(msg string) error {
+	fields := strings.Fields(strings.TrimPrefix(msg, "/"))
+	if len(fields) == 0 {
+		return errors.New("empty command")
+	}
+
+	command, ok := chatCommands[strings.ToLower(fields[0])]
+	if !ok || (command.perm != "" && !can(c.uuid, command.perm)) {
+		systemMessage(fmt.Sprintf("Unknown command /%s. Use /help to list commands.", fields[0]), c.uuid)
+		return nil
+	}
+
+	reply, err := command.run(c, fields[1:])
+	if err != nil {
+		systemMessage(err.Error(), c.uuid)
+		return nil
+	}
+
+	if reply != "" {
+		systemMessage(reply, c.uuid)
+	}
+
+	return nil
+}
+
+func runHelpCommand(c *SessionClient, _ []string) (string, error) {
+	var names []string
+	for name, command := range chatCommands {
+		if command.perm == "" || can(c.uuid, command.perm) {
+			names = append(names, name)
+		}
+	}
+
+	slices.Sort(names)
+
+	var lines []string
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s - %s", chatCommands[name].usage, chatCommands[name].description))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+func runRollCommand(_ *SessionClient, args []string) (string, error) {
+	sides := 100
+	if len(args) > 0 {
+		var err error
+		sides, err = strconv.Atoi(args[0])
+		if err != nil || sides < 2 || sides > 1000000 {
+			return "", errors.New("Usage: " + chatCommands["roll"].usage)
+		}
+	}
+
+	return fmt.Sprintf("You rolled %d (1-%d).", rand.Intn(sides)+1, sides), nil
+}
+
+func runOnlineCommand(_ *SessionClient, _ []string) (string, error) {
+	local := clients.GetAmount()
+
+	total := local
+	for _, event := range remotePresence.GetAll() {
+		if !clients.Exists(event.Uuid) {
+			total++
+		}
+	}
+
+	return fmt.Sprintf("%d players online here, %d across all games.", local, total), nil
+}
+
+func runWhereCommand(c *SessionClient, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("Usage: " + chatCommands["where"].usage)
+	}
+
+	friendUuid, err := getUuidFromName(args[0])
+	if err != nil || friendUuid == "" {
+		return "", errors.New("No player with that name.")
+	}
+
+	if !presence.isWatching(c.uuid, friendUuid) {
+		return "", errors.New("You can only look up your friends.")
+	}
+
+	if client, ok := clients.Load(friendUuid); ok {
+		if client.roomC == nil || client.hideLocation || client.private {
+			return fmt.Sprintf("%s is online.", client.name), nil
+		}
+
+		if len(client.roomC.locations) == 0 {
+			return fmt.Sprintf("%s is on map %s.", client.name, client.roomC.mapId), nil
+		}
+
+		return fmt.Sprintf("%s is in %s.", client.name, strings.Join(client.roomC.locations, ", ")), nil
+	}
+
+	if event, ok := remotePresence.Get(friendUuid); ok {
+		game := event.Game
+		if gameName, ok := gameIdToName[game]; ok {
+			game = gameName
+		}
+
+		return fmt.Sprintf("%s is playing %s.", event.Name, game), nil
+	}
+
+	return fmt.Sprintf("%s is offline.", args[0]), nil
+}
+
+func runWhisperCommand(c *SessionClient, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("Usage: " + chatCommands["w"].usage)
+	}
+
+	targetUuid, err := getUuidFromName(args[0])
+	if err != nil || targetUuid == "" {
+		return "", errors.New("No player with that name.")
+	}
+
+	err = c.handleDm([]string{"dm", targetUuid, strings.Join(args[1:], " ")})
+	if err != nil {
+		return "", fmt.Errorf("Could not send message: %s", err)
+	}
+
+	return "", nil
+}
+
+func runReportCommand(c *SessionClient, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("Usage: " + chatCommands["report"].usage)
+	}
+
+	targetUuid, err := getUuidFromName(args[0])
+	if err != nil || targetUuid == "" {
+		return "", errors.New("No player with that name.")
+	}
+
+	reason := ":" + args[1]
+	if _, ok := reportReasons[reason]; !ok {
+		var reasons []string
+		for i := 1; i <= len(reportReasons); i++ {
+			reasons = append(reasons, fmt.Sprintf("%d: %s", i, getReadableReportReason(":"+strconv.Itoa(i))))
+		}
+		return "", errors.New("Unknown reason. Reasons are " + strings.Join(reasons, "; ") + ".")
+	}
+
+	if targetUuid == c.uuid {
+		return "", errors.New("You cannot report yourself.")
+	}
+
+	if c.banned {
+		return "Your report has been sent to the moderators.", nil
+	}
+
+	msgId, originalMsg, err := createReport(c.uuid, targetUuid, reason, "", "")
+	if err == errDuplicateReport {
+		return "", errors.New("You have already reported this player.")
+	}
+	if err == errReportRateLimited {
+		return "", errors.New("You have sent too many reports. Try again later.")
+	}
+	if err != nil {
+		writeErrLog(c.uuid, "sess", "createReport failed: "+err.Error())
+		return "", errors.New("Could not send report.")
+	}
+
+	err = sendReportLog(targetUuid, msgId, originalMsg)
+	if err != nil {
+		writeErrLog(c.uuid, "sess", "sendReportMessage failed: "+err.Error())
+	}
+
+	return "Your report has been sent to the moderators.", nil
+}
+
+func runMuteCommand(c *SessionClient, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("Usage: " + chatCommands["mute"].usage)
+	}
+
+	targetUuid, err := getUuidFromName(args[0])
+	if err != nil || targetUuid == "" {
+		return "", errors.New("No player with that name.")
+	}
+
+	if !canActOn(c.uuid, targetUuid, permMute) {
+		return "", errors.New("Insufficient rank.")
+	}
+
+	duration, err := time.ParseDuration(args[1])
+	if err != nil || duration <= 0 {
+		return "", errors.New("Invalid duration; use a value such as 30m, 1h or 24h.")
+	}
+
+	reason := strings.Join(args[2:], " ")
+	expiry := time.Now().Add(duration)
+
+	mutePlayerInAllGamesUnchecked(targetUuid, true, false)
+
+	err = registerModAction(targetUuid, actionMute, expiry, reason)
+	if err != nil {
+		return "", err
+	}
+
+	writeModAuditLog(c.uuid, c.name, targetUuid, "tempmute", reason, auditSourceChat, &expiry)
+
+	return fmt.Sprintf("%s has been muted until %s.", args[0], expiry.UTC().Format("2006-01-02 15:04 MST")), nil
+}
@@ -0,0 +1,303 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	chatFilterAllow = iota
+	chatFilterRewrite
+	chatFilterFlag
+	chatFilterDrop // shadow drop; only the sender sees the message
+)
+
+type ChatFilterResult struct {
+	verdict  int
+	contents string // replacement contents for chatFilterRewrite
+	reason   string // why the message was flagged or dropped
+}
+
+// each filter inspects the message as rewritten by the filters before it
+type ChatFilter func(c *SessionClient, contents string) (ChatFilterResult, error)
+
+var (
+	chatFilters = []ChatFilter{
+		slowModeChatFilter,
+		repetitionChatFilter,
+		linkChatFilter,
+		floodChatFilter,
+		capsChatFilter,
+		wordChatFilter,
+	}
+
+	chatLinkPattern   = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+	chatInvitePattern = regexp.MustCompile(`(?i)\b(?:discord(?:app)?\.(?:gg|com/invite)|dsc\.gg)/\S+`)
+)
+
+type recentChatMessage struct {
+	contents  string
+	timestamp time.Time
+}
+
+// runs the message through every chat filter. a non-nil error means the message was rejected
+// and the sender has been told why
+func (c *SessionClient) filterChatMessage(contents string) (filtered string, verdict int, flags []string, err error) {
+	filtered = contents
+	verdict = chatFilterAllow
+
+	for _, filter := range chatFilters {
+		result, err := filter(c, filtered)
+		if err != nil {
+			systemMessage(err.Error(), c.uuid)
+			return "", chatFilterDrop, flags, err
+		}
+
+		switch result.verdict {
+		case chatFilterRewrite:
+			filtered = result.contents
+		case chatFilterFlag, chatFilterDrop:
+			if result.contents != "" {
+				filtered = result.contents
+			}
+			if result.reason != "" {
+				flags = append(flags, result.reason)
+			}
+		}
+
+		verdict = max(verdict, result.verdict)
+	}
+
+	c.recentChatMessages = append(c.recentChatMessages, recentChatMessage{contents, time.Now()})
+	if len(c.recentChatMessages) > 5 {
+		c.recentChatMessages = c.recentChatMessages[1:]
+	}
+
+	if verdict != chatFilterDrop {
+		c.lastChatTime = time.Now()
+	}
+
+	return filtered, verdict, flags, nil
+}
+
+// auto-reports a message that passed the filters but looked suspicious
+func (c *SessionClient) reportFlaggedChatMessage(msgId, contents string, flags []string) {
+	reason := "Automatic: " + strings.Join(flags, ", ")
+
+	msgId, originalMsg, err := createReport(systemReporterUuid, c.uuid, reason, msgId, contents)
+	if err == errDuplicateReport {
+		return
+	}
+	if err != nil {
+		writeErrLog(c.uuid, "sess", "createReport failed: "+err.Error())
+		return
+	}
+
+	err = sendReportLog(c.uuid, msgId, originalMsg)
+	if err != nil {
+		writeErrLog(c.uuid, "sess", "sendReportMessage failed: "+err.Error())
+	}
+}
+
+// new accounts and guests have to wait between messages
+func slowModeChatFilter(c *SessionClient, _ string) (ChatFilterResult, error) {
+	if config.chat.slowMode == 0 {
+		return ChatFilterResult{}, nil
+	}
+
+	if c.account && time.Since(c.registered) > config.chat.newAccountAge {
+		return ChatFilterResult{}, nil
+	}
+
+	if wait := config.chat.slowMode - time.Since(c.lastChatTime); wait > 0 {
+		return ChatFilterResult{}, fmt.Errorf("Slow mode is on for new players. Please wait %d seconds.", int(wait.Seconds())+1)
+	}
+
+	return ChatFilterResult{}, nil
+}
+
+func repetitionChatFilter(c *SessionClient, contents string) (ChatFilterResult, error) {
+	normalized := strings.ToLower(strings.Join(strings.Fields(contents), " "))
+
+	var repeats int
+	for _, recent := range c.recentChatMessages {
+		if time.Since(recent.timestamp) > config.chat.repeatWindow {
+			continue
+		}
+
+		if strings.ToLower(strings.Join(strings.Fields(recent.contents), " ")) == normalized {
+			repeats++
+		}
+	}
+
+	switch {
+	case repeats >= config.chat.repeatFlagLimit:
+		return ChatFilterResult{verdict: chatFilterDrop, reason: "repeated message spam"}, nil
+	case repeats >= config.chat.repeatLimit:
+		return ChatFilterResult{verdict: chatFilterDrop}, nil
+	}
+
+	return ChatFilterResult{}, nil
+}
+
+// invites to other communities are dropped and flagged, other links outside the allowlist are removed
+func linkChatFilter(_ *SessionClient, contents string) (ChatFilterResult, error) {
+	if chatInvitePattern.MatchString(contents) {
+		return ChatFilterResult{verdict: chatFilterDrop, reason: "invite link"}, nil
+	}
+
+	var removed bool
+	rewritten := chatLinkPattern.ReplaceAllStringFunc(contents, func(link string) string {
+		if isChatLinkAllowed(link) {
+			return link
+		}
+		removed = true
+		return "[link removed]"
+	})
+
+	if !removed {
+		return ChatFilterResult{}, nil
+	}
+
+	return ChatFilterResult{verdict: chatFilterRewrite, contents: rewritten}, nil
+}
+
+func isChatLinkAllowed(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "https://" + link
+	}
+
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+
+	return slices.ContainsFunc(config.chat.linkAllowlist, func(domain string) bool {
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	})
+}
+
+// collapses long runs of a single character and strips stacked combining marks (zalgo)
+func floodChatFilter(_ *SessionClient, contents string) (ChatFilterResult, error) {
+	runes := []rune(contents)
+
+	var b strings.Builder
+	var marks, strippedMarks int
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		if unicode.Is(unicode.Mn, r) {
+			marks++
+			if marks > 2 {
+				strippedMarks++
+				continue
+			}
+			b.WriteRune(r)
+			continue
+		}
+		marks = 0
+
+		run := 1
+		for i+run < len(runes) && runes[i+run] == r {
+			run++
+		}
+
+		// runs of 10 or more are cut down to 3
+		if run >= 10 {
+			b.WriteString(strings.Repeat(string(r), 3))
+			i += run - 1
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+	rewritten := b.String()
+
+	if strippedMarks > 20 {
+		return ChatFilterResult{verdict: chatFilterFlag, contents: rewritten, reason: "zalgo text"}, nil
+	}
+
+	if rewritten == contents {
+		return ChatFilterResult{}, nil
+	}
+
+	return ChatFilterResult{verdict: chatFilterRewrite, contents: rewritten}, nil
+}
+
+func capsChatFilter(_ *SessionClient, contents string) (ChatFilterResult, error) {
+	var letters, upper int
+	for _, r := range chatLinkPattern.ReplaceAllString(contents, "") {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+
+	if letters < 8 || float64(upper)/float64(letters) <= config.chat.capsRatio {
+		return ChatFilterResult{}, nil
+	}
+
+	// links are left alone since their paths are case-sensitive
+	var b strings.Builder
+	var last int
+	for _, span := range chatLinkPattern.FindAllStringIndex(contents, -1) {
+		b.WriteString(strings.ToLower(contents[last:span[0]]))
+		b.WriteString(contents[span[0]:span[1]])
+		last = span[1]
+	}
+	b.WriteString(strings.ToLower(contents[last:]))
+
+	return ChatFilterResult{verdict: chatFilterRewrite, contents: b.String()}, nil
+}
+
+func wordChatFilter(_ *SessionClient, contents string) (ChatFilterResult, error) {
+	result := wordFilter.Filter(contents)
+
+	switch {
+	case result.Blocked:
+		return ChatFilterResult{verdict: chatFilterDrop}, nil
+	case len(result.Flagged) > 0:
+		return ChatFilterResult{verdict: chatFilterFlag, contents: result.Contents, reason: "filtered words: " + strings.Join(result.Flagged, ", ")}, nil
+	case result.Contents != contents:
+		return ChatFilterResult{verdict: chatFilterRewrite, contents: result.Contents}, nil
+	}
+
+	return ChatFilterResult{}, nil
+}
+
+func getAccountRegistrationTime(uuid string) (time.Time, error) {
+	var age int
+	err := db.QueryRow("SELECT TIMESTAMPDIFF(SECOND, timestampRegistered, NOW()) FROM accounts WHERE uuid = ?", uuid).Scan(&age)
+	if err != nil {
+		return time.Time{}, errors.Join(errors.New("could not read registration time"), err)
+	}
+
+	return time.Now().Add(-time.Duration(age) * time.Second), nil
+}
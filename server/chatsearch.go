@@ -0,0 +1,469 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const chatMessagePageSelectClause = "SELECT cm.msgId, cm.game, cm.uuid, cm.mapId, cm.prevMapId, cm.prevLocations, cm.x, cm.y, cm.contents, cm.timestamp, cm.timestampEdited IS NOT NULL, cm.partyId IS NOT NULL, COALESCE(a.user, pgd.name), pd.rank, CASE WHEN a.user IS NULL THEN 0 ELSE 1 END, COALESCE(a.badge, ''), pgd.systemName, pgd.medalCountBronze, pgd.medalCountSilver, pgd.medalCountGold, pgd.medalCountPlatinum, pgd.medalCountDiamond FROM chatMessages cm JOIN players pd ON pd.uuid = cm.uuid JOIN playerGameData pgd ON pgd.uuid = cm.uuid AND pgd.game = cm.game LEFT JOIN accounts a ON a.uuid = cm.uuid "
+
+// leaves out messages from players blocked either way by the viewer; takes the viewer's uuid twice
+const chatMessageNotBlockedClause = " AND NOT EXISTS (SELECT * FROM playerBlocks pb WHERE (pb.uuid = ? AND pb.targetUuid = cm.uuid) OR (pb.uuid = cm.uuid AND pb.targetUuid = ?))"
+
+var (
+	recentChatSearches      = make(map[string][]time.Time)
+	recentChatSearchesMutex sync.Mutex
+)
+
+func initChatSearch() {
+	scheduler.Every(10).Minutes().Do(pruneRecentChatSearches)
+}
+
+// escapes LIKE wildcards so search text matches literally
+var likeReplacer = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// reads rows selected with chatMessagePageSelectClause; a row past limit means there is another page
+func scanChatMessagePage(results *sql.Rows, limit int, page *ChatHistoryPage) error {
+	players := make(map[string]bool)
+	for _, player := range page.Players {
+		players[player.Uuid] = true
+	}
+
+	for results.Next() {
+		chatMessage := &ChatMessage{}
+		var chatPlayer ChatPlayer
+
+		err := results.Scan(&chatMessage.MsgId, &chatMessage.Game, &chatMessage.Uuid, &chatMessage.MapId, &chatMessage.PrevMapId, &chatMessage.PrevLocations, &chatMessage.X, &chatMessage.Y, &chatMessage.Contents, &chatMessage.Timestamp, &chatMessage.Edited, &chatMessage.Party, &chatPlayer.Name, &chatPlayer.Rank, &chatPlayer.Account, &chatPlayer.Badge, &chatPlayer.SystemName, &chatPlayer.Medals[0], &chatPlayer.Medals[1], &chatPlayer.Medals[2], &chatPlayer.Medals[3], &chatPlayer.Medals[4])
+		if err != nil {
+			return err
+		}
+
+		if limit > 0 && len(page.Messages) == limit {
+			page.Cursor = page.Messages[limit-1].MsgId
+			break
+		}
+
+		page.Messages = append(page.Messages, chatMessage)
+
+		if !players[chatMessage.Uuid] {
+			players[chatMessage.Uuid] = true
+			chatPlayer.Uuid = chatMessage.Uuid
+			page.Players = append(page.Players, &chatPlayer)
+		}
+	}
+
+	return nil
+}
+
+func newChatHistoryPage() *ChatHistoryPage {
+	return &ChatHistoryPage{
+		Players:  []*ChatPlayer{},
+		Messages: []*ChatMessage{},
+	}
+}
+
+// a page of party chat, newest first from before the cursor message; search matches contents and author names
+func getPartyChatMessageHistory(partyId int, limit int, beforeMsgId string, search string) (*ChatHistoryPage, error) {
+	page := newChatHistoryPage()
+
+	query := chatMessagePageSelectClause + "WHERE cm.partyId = ? AND cm.deleted = 0 AND pd.banned = 0"
+	args := []any{partyId}
+
+	if beforeMsgId != "" {
+		query += " AND (cm.timestamp, cm.msgId) < (SELECT cmb.timestamp, cmb.msgId FROM chatMessages cmb WHERE cmb.msgId = ? AND cmb.partyId = ?)"
+		args = append(args, beforeMsgId, partyId)
+	}
+
+	if search != "" {
+		pattern := "%" + likeReplacer.Replace(search) + "%"
+		query += " AND (cm.contents LIKE ? OR COALESCE(a.user, pgd.name) LIKE ?)"
+		args = append(args, pattern, pattern)
+	}
+
+	query += " ORDER BY cm.timestamp DESC, cm.msgId DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return page, err
+	}
+
+	defer results.Close()
+
+	err = scanChatMessagePage(results, limit, page)
+	if err != nil {
+		return page, err
+	}
+
+	// oldest first, like the regular chat history
+	slices.Reverse(page.Messages)
+
+	return page, nil
+}
+
+type ChatSearchQuery struct {
+	Viewer     string // messages from players blocked either way are left out
+	Game       string // empty for every game
+	Author     string
+	MapId      string
+	Text       string
+	From, To   time.Time
+	Before     string
+	Limit      int
+	ShowBanned bool
+}
+
+// searches global chat, newest first
+func searchChatMessages(q ChatSearchQuery) (*ChatHistoryPage, error) {
+	page := newChatHistoryPage()
+
+	query := chatMessagePageSelectClause + "WHERE cm.partyId IS NULL AND cm.deleted = 0"
+	var args []any
+
+	if !q.ShowBanned {
+		query += " AND pd.banned = 0"
+	}
+
+	if q.Viewer != "" {
+		query += chatMessageNotBlockedClause
+		args = append(args, q.Viewer, q.Viewer)
+	}
+
+	if q.Game != "" {
+		query += " AND cm.game = ?"
+		args = append(args, q.Game)
+	}
+
+	if q.Author != "" {
+		query += " AND COALESCE(a.user, pgd.name) LIKE ?"
+		args = append(args, likeReplacer.Replace(q.Author)+"%")
+	}
+
+	if q.MapId != "" {
+		query += " AND cm.mapId = ?"
+		args = append(args, q.MapId)
+	}
+
+	if q.Text != "" {
+		query += " AND cm.contents LIKE ?"
+		args = append(args, "%"+likeReplacer.Replace(q.Text)+"%")
+	}
+
+	if !q.From.IsZero() {
+		query += " AND cm.timestamp >= ?"
+		args = append(args, q.From.UTC())
+	}
+
+	if !q.To.IsZero() {
+		query += " AND cm.timestamp <= ?"
+		args = append(args, q.To.UTC())
+	}
+
+	if q.Before != "" {
+		query += " AND (cm.timestamp, cm.msgId) < (SELECT cmb.timestamp, cmb.msgId FROM chatMessages cmb WHERE cmb.msgId = ?)"
+		args = append(args, q.Before)
+	}
+
+	query += " ORDER BY cm.timestamp DESC, cm.msgId DESC LIMIT ?"
+	args = append(args, q.Limit+1)
+
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return page, err
+	}
+
+	defer results.Close()
+
+	err = scanChatMessagePage(results, q.Limit, page)
+	if err != nil {
+		return page, err
+	}
+
+	return page, nil
+}
+
+// returns up to before messages leading up to msgId, the message itself and up to after messages following it,
+// from the same channel (global chat of the same game, or the same party). like search, messages from players
+// blocked either way by viewer are left out; an empty viewer sees everything
+func getChatMessageContext(viewer string, msgId string, partyId int, game string, before, after int, showBanned bool) (*ChatHistoryPage, error) {
+	page := newChatHistoryPage()
+
+	whereClause := "WHERE cm.deleted = 0"
+	var args []any
+
+	if partyId != 0 {
+		whereClause += " AND cm.partyId = ?"
+		args = append(args, partyId)
+	} else {
+		whereClause += " AND cm.partyId IS NULL AND cm.game = ?"
+		args = append(args, game)
+	}
+
+	if !showBanned {
+		// the reported message itself is always shown
+		whereClause += " AND (pd.banned = 0 OR cm.msgId = ?)"
+		args = append(args, msgId)
+	}
+
+	if viewer != "" {
+		whereClause += chatMessageNotBlockedClause
+		args = append(args, viewer, viewer)
+	}
+
+	targetClause := "(SELECT cmt.timestamp, cmt.msgId FROM chatMessages cmt WHERE cmt.msgId = ? AND cmt.game = ?)"
+
+	if before > 0 {
+		results, err := db.Query(chatMessagePageSelectClause+whereClause+" AND (cm.timestamp, cm.msgId) < "+targetClause+" ORDER BY cm.timestamp DESC, cm.msgId DESC LIMIT ?", append(slices.Clone(args), msgId, game, before)...)
+		if err != nil {
+			return page, err
+		}
+
+		err = scanChatMessagePage(results, 0, page)
+		results.Close()
+		if err != nil {
+			return page, err
+		}
+
+		slices.Reverse(page.Messages)
+	}
+
+	results, err := db.Query(chatMessagePageSelectClause+whereClause+" AND (cm.timestamp, cm.msgId) >= "+targetClause+" ORDER BY cm.timestamp, cm.msgId LIMIT ?", append(slices.Clone(args), msgId, game, after+1)...)
+	if err != nil {
+		return page, err
+	}
+
+	defer results.Close()
+
+	err = scanChatMessagePage(results, 0, page)
+	if err != nil {
+		return page, err
+	}
+
+	return page, nil
+}
+
+// limits how many searches an account can run per minute, since text searches can't use an index
+func checkChatSearchRateLimit(uuid string) bool {
+	recentChatSearchesMutex.Lock()
+	defer recentChatSearchesMutex.Unlock()
+
+	now := time.Now()
+
+	recentSearches := slices.DeleteFunc(recentChatSearches[uuid], func(t time.Time) bool {
+		return now.Sub(t) > time.Minute
+	})
+
+	if len(recentSearches) >= config.chat.searchesPerMinute {
+		recentChatSearches[uuid] = recentSearches
+		return false
+	}
+
+	recentChatSearches[uuid] = append(recentSearches, now)
+
+	return true
+}
+
+func pruneRecentChatSearches() {
+	recentChatSearchesMutex.Lock()
+	defer recentChatSearchesMutex.Unlock()
+
+	for uuid, recentSearches := range recentChatSearches {
+		if len(recentSearches) == 0 || time.Since(recentSearches[len(recentSearches)-1]) > time.Minute {
+			delete(recentChatSearches, uuid)
+		}
+	}
+}
+
+func handleChatSearch(w http.ResponseWriter, r *http.Request) {
+	// searching is limited to accounts so it can be rate limited per player
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		handleError(w, r, "token not specified")
+		return
+	}
+
+	uuid := getUuidFromToken(token)
+	if uuid == "" {
+		handleError(w, r, "invalid token")
+		return
+	}
+
+	if !checkChatSearchRateLimit(uuid) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many searches", http.StatusTooManyRequests)
+		return
+	}
+
+	query := r.URL.Query()
+
+	q := ChatSearchQuery{
+		Viewer:     uuid,
+		Game:       config.gameName,
+		Author:     strings.TrimSpace(query.Get("author")),
+		MapId:      query.Get("mapId"),
+		Text:       strings.TrimSpace(query.Get("q")),
+		Before:     query.Get("before"),
+		Limit:      50,
+		ShowBanned: can(uuid, permViewPlayers),
+	}
+
+	if game := query.Get("game"); game == "all" {
+		q.Game = ""
+	} else if game != "" {
+		q.Game = game
+	}
+
+	if len(q.Author) > 50 || len(q.Text) > 100 {
+		handleError(w, r, "search too long")
+		return
+	}
+
+	if q.MapId != "" && len(q.MapId) != 4 {
+		handleError(w, r, "invalid mapId")
+		return
+	}
+
+	if q.Before != "" && len(q.Before) != 12 {
+		handleError(w, r, "invalid before")
+		return
+	}
+
+	for param, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if value := query.Get(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				handleError(w, r, "invalid "+param+" value")
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	// nothing older is kept anyway, and bounding the timestamp keeps text searches from scanning the whole table
+	if oldest := time.Now().Add(-time.Duration(config.chat.retentionDays) * 24 * time.Hour); q.From.Before(oldest) {
+		q.From = oldest
+	}
+
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil {
+			handleError(w, r, "invalid limit value")
+			return
+		}
+		q.Limit = limit
+	}
+
+	if q.Limit <= 0 || q.Limit > 100 {
+		q.Limit = 100
+	}
+
+	page, err := searchChatMessages(q)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	pageJson, err := json.Marshal(page)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write(pageJson)
+}
+
+func handleChatContext(w http.ResponseWriter, r *http.Request) {
+	// guests can still jump to global chat messages, just without their blocks applied
+	var uuid string
+	if token := r.Header.Get("Authorization"); token != "" {
+		uuid = getUuidFromToken(token)
+	}
+
+	query := r.URL.Query()
+
+	msgId := query.Get("msgId")
+	if len(msgId) != 12 {
+		handleError(w, r, "invalid msgId")
+		return
+	}
+
+	game := query.Get("game")
+	if game == "" {
+		game = config.gameName
+	}
+
+	before, after := 10, 10
+	for param, n := range map[string]*int{"before": &before, "after": &after} {
+		if value := query.Get(param); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				handleError(w, r, "invalid "+param+" value")
+				return
+			}
+			*n = min(parsed, 50)
+		}
+	}
+
+	var partyId int
+	err := db.QueryRow("SELECT COALESCE(partyId, 0) FROM chatMessages WHERE msgId = ? AND game = ? AND deleted = 0", msgId, game).Scan(&partyId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			handleError(w, r, "message not found")
+			return
+		}
+		handleInternalError(w, r, err)
+		return
+	}
+
+	isModerator := can(uuid, permViewPlayers)
+
+	// party chat stays private to its members, except for moderators looking into reports
+	if partyId != 0 && !isModerator {
+		playerPartyId, err := getPlayerPartyId(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if playerPartyId != partyId {
+			handleError(w, r, "access denied")
+			return
+		}
+	}
+
+	page, err := getChatMessageContext(uuid, msgId, partyId, game, before, after, isModerator)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	pageJson, err := json.Marshal(page)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	w.Write(pageJson)
+}
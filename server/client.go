@@ -79,10 +79,12 @@ type SessionClient struct {
 	name    string
 	uuid    string
 	rank    int
+	roles   []string
 	badge   string
 	medals  [5]int
 
 	muted, banned bool
+	shadowMuted   bool
 
 	sprite      string
 	spriteIndex int
@@ -94,10 +96,18 @@ type SessionClient struct {
 
 	hideLocation       bool
 	hideUnnamedPlayers bool
+	allGamesChat       bool
 	partyId            int
 
-	onlineFriends map[string]bool
-	blockedUsers  map[string]bool
+	// updated from other clients' goroutines as friends come and go; use the accessors
+	onlineFriends      map[string]bool
+	onlineFriendsMutex sync.RWMutex
+	blockedUsers       map[string]bool
+
+	registered         time.Time
+	lastChatTime       time.Time
+	recentChatMessages []recentChatMessage
+	recentDmTimes      []time.Time
 }
 
 func (c *SessionClient) msgReader() {
@@ -162,6 +172,9 @@ func (c *SessionClient) disconnect() {
 	// unregister
 	clients.Delete(c.uuid)
 
+	presence.Unwatch(c.uuid)
+	c.publishPresence(presenceOffline)
+
 	// close conn, ends reader and processor
 	c.conn.Close()
 
@@ -175,7 +188,32 @@ func (c *SessionClient) disconnect() {
 
 func (c *SessionClient) isPrivatedTo(other *SessionClient) bool {
 	return (c.private || other.private) && ((c.singleplayer || other.singleplayer) ||
-		(other.partyId == 0 || c.partyId != other.partyId) && !c.onlineFriends[other.uuid])
+		(other.partyId == 0 || c.partyId != other.partyId) && !c.isOnlineFriend(other.uuid))
+}
+
+func (c *SessionClient) isOnlineFriend(uuid string) bool {
+	c.onlineFriendsMutex.RLock()
+	defer c.onlineFriendsMutex.RUnlock()
+
+	return c.onlineFriends[uuid]
+}
+
+func (c *SessionClient) setOnlineFriends(onlineFriends map[string]bool) {
+	c.onlineFriendsMutex.Lock()
+	defer c.onlineFriendsMutex.Unlock()
+
+	c.onlineFriends = onlineFriends
+}
+
+func (c *SessionClient) setOnlineFriend(uuid string, online bool) {
+	c.onlineFriendsMutex.Lock()
+	defer c.onlineFriendsMutex.Unlock()
+
+	if online {
+		c.onlineFriends[uuid] = true
+	} else {
+		delete(c.onlineFriends, uuid)
+	}
 }
 
 func (c *SessionClient) isBlockedWith(other *SessionClient) bool {
@@ -42,14 +42,73 @@ type Config struct {
 	screenshotWebhook string
 
 	moderation struct {
-		botToken  string
-		guildId   string
-		channelId string
-		modRoleId string
+		botToken        string
+		guildId         string
+		channelId       string
+		modRoleId       string
+		reportsPerHour  int
+		reportsPerDay   int
+		lowCredibility  float64
+		altLinkScore    int
+		altAction       string
+		altMuteDuration time.Duration
+		identitySecret  string
 	}
 
 	ipc struct {
-		deadline time.Duration
+		deadline  time.Duration
+		socketDir string
+		secret    string
+		retries   int
+	}
+
+	login struct {
+		freeAttempts     int
+		backoffBase      time.Duration
+		backoffMax       time.Duration
+		lockoutThreshold int
+		lockoutDuration  time.Duration
+		resetAfter       time.Duration
+	}
+
+	account struct {
+		deletionCoolingOff time.Duration
+	}
+
+	sanctions struct {
+		ladder []SanctionStep
+		window time.Duration
+	}
+
+	presence struct {
+		reconcileInterval time.Duration
+	}
+
+	dm struct {
+		retention time.Duration
+	}
+
+	party struct {
+		inviteExpiry         time.Duration
+		linkExpiry           time.Duration
+		maxMarkers           int
+		markerMaxDuration    time.Duration
+		chatRetentionDays    int
+		maxChatRetentionDays int
+	}
+
+	chat struct {
+		editWindow        time.Duration
+		slowMode          time.Duration
+		newAccountAge     time.Duration
+		repeatWindow      time.Duration
+		repeatLimit       int
+		repeatFlagLimit   int
+		capsRatio         float64
+		linkAllowlist     []string
+		retentionDays     int
+		dmsPerMinute      int
+		searchesPerMinute int
 	}
 
 	logging struct {
@@ -87,16 +146,75 @@ type ConfigFile struct {
 	ScreenshotWebhook string `yaml:"screenshot_webhook"`
 
 	Moderation *struct {
-		BotToken  string `yaml:"bot_token"`
-		ChannelID string `yaml:"channel_id"`
-		GuildID   string `yaml:"guild_id"`
-		ModRoleID string `yaml:"mod_role_id"`
+		BotToken       string  `yaml:"bot_token"`
+		ChannelID      string  `yaml:"channel_id"`
+		GuildID        string  `yaml:"guild_id"`
+		ModRoleID      string  `yaml:"mod_role_id"`
+		ReportsPerHour int     `yaml:"reports_per_hour"`
+		ReportsPerDay  int     `yaml:"reports_per_day"`
+		LowCredibility float64 `yaml:"low_credibility"`
+		AltLinkScore   int     `yaml:"alt_link_score"`
+		AltAction      string  `yaml:"alt_action"`
+		AltMuteHours   int     `yaml:"alt_mute_hours"`
+		IdentitySecret string  `yaml:"identity_secret"`
 	} `yaml:"moderation"`
 
 	Ipc *struct {
-		DeadlineMs int `yaml:"deadline_ms"`
+		DeadlineMs int    `yaml:"deadline_ms"`
+		SocketDir  string `yaml:"socket_dir"`
+		Secret     string `yaml:"secret"`
+		Retries    *int   `yaml:"retries"`
 	} `yaml:"ipc"`
 
+	Login struct {
+		FreeAttempts     int `yaml:"free_attempts"`
+		BackoffBaseMs    int `yaml:"backoff_base_ms"`
+		BackoffMaxMs     int `yaml:"backoff_max_ms"`
+		LockoutThreshold int `yaml:"lockout_threshold"`
+		LockoutMinutes   int `yaml:"lockout_minutes"`
+		ResetMinutes     int `yaml:"reset_minutes"`
+	} `yaml:"login"`
+
+	Account struct {
+		DeletionCoolingOffDays int `yaml:"deletion_cooling_off_days"`
+	} `yaml:"account"`
+
+	Sanctions struct {
+		Ladder     []string `yaml:"ladder"`
+		WindowDays int      `yaml:"window_days"`
+	} `yaml:"sanctions"`
+
+	Presence struct {
+		ReconcileSeconds int `yaml:"reconcile_seconds"`
+	} `yaml:"presence"`
+
+	Dm struct {
+		RetentionDays int `yaml:"retention_days"`
+	} `yaml:"dm"`
+
+	Party struct {
+		InviteExpiryHours    int `yaml:"invite_expiry_hours"`
+		LinkExpiryMinutes    int `yaml:"link_expiry_minutes"`
+		MaxMarkers           int `yaml:"max_markers"`
+		MarkerMaxMinutes     int `yaml:"marker_max_minutes"`
+		ChatRetentionDays    int `yaml:"chat_retention_days"`
+		MaxChatRetentionDays int `yaml:"max_chat_retention_days"`
+	} `yaml:"party"`
+
+	Chat struct {
+		EditWindowSeconds   int      `yaml:"edit_window_seconds"`
+		SlowModeSeconds     int      `yaml:"slow_mode_seconds"`
+		NewAccountHours     int      `yaml:"new_account_hours"`
+		RepeatWindowSeconds int      `yaml:"repeat_window_seconds"`
+		RepeatLimit         int      `yaml:"repeat_limit"`
+		RepeatFlagLimit     int      `yaml:"repeat_flag_limit"`
+		CapsRatio           float64  `yaml:"caps_ratio"`
+		LinkAllowlist       []string `yaml:"link_allowlist"`
+		RetentionDays       int      `yaml:"retention_days"`
+		DmsPerMinute        int      `yaml:"dms_per_minute"`
+		SearchesPerMinute   int      `yaml:"searches_per_minute"`
+	} `yaml:"chat"`
+
 	VapidKeys struct {
 		Private string `yaml:"private"`
 		Public  string `yaml:"public"`
@@ -180,17 +298,207 @@ func parseConfigFile(filename string) *Config {
 	config.chatWebhook = configFile.ChatWebhook
 	config.screenshotWebhook = configFile.ScreenshotWebhook
 
+	config.moderation.reportsPerHour = 5
+	config.moderation.reportsPerDay = 20
+	config.moderation.lowCredibility = 0.25
+	config.moderation.altLinkScore = 3
+	config.moderation.altMuteDuration = 24 * time.Hour
 	if mod := configFile.Moderation; mod != nil {
 		config.moderation.botToken = mod.BotToken
 		config.moderation.channelId = mod.ChannelID
 		config.moderation.modRoleId = mod.ModRoleID
 		config.moderation.guildId = mod.GuildID
+		if mod.ReportsPerHour != 0 {
+			config.moderation.reportsPerHour = mod.ReportsPerHour
+		}
+		if mod.ReportsPerDay != 0 {
+			config.moderation.reportsPerDay = mod.ReportsPerDay
+		}
+		if mod.LowCredibility != 0 {
+			config.moderation.lowCredibility = mod.LowCredibility
+		}
+		if mod.AltLinkScore != 0 {
+			config.moderation.altLinkScore = mod.AltLinkScore
+		}
+		config.moderation.altAction = mod.AltAction
+		if mod.AltMuteHours != 0 {
+			config.moderation.altMuteDuration = time.Duration(mod.AltMuteHours) * time.Hour
+		}
+		config.moderation.identitySecret = mod.IdentitySecret
 	}
 
+	config.ipc.deadline = 100 * time.Millisecond
+	config.ipc.socketDir = "/tmp/yno"
+	config.ipc.retries = 2
 	if ipc := configFile.Ipc; ipc != nil {
-		config.ipc.deadline = time.Duration(ipc.DeadlineMs) * time.Millisecond
+		if ipc.DeadlineMs != 0 {
+			config.ipc.deadline = time.Duration(ipc.DeadlineMs) * time.Millisecond
+		}
+		if ipc.SocketDir != "" {
+			config.ipc.socketDir = ipc.SocketDir
+		}
+		if ipc.Retries != nil {
+			config.ipc.retries = *ipc.Retries
+		}
+		config.ipc.secret = ipc.Secret
+	}
+
+	if configFile.Login.FreeAttempts != 0 {
+		config.login.freeAttempts = configFile.Login.FreeAttempts
+	} else {
+		config.login.freeAttempts = 5
+	}
+	if configFile.Login.BackoffBaseMs != 0 {
+		config.login.backoffBase = time.Duration(configFile.Login.BackoffBaseMs) * time.Millisecond
+	} else {
+		config.login.backoffBase = 1 * time.Second
+	}
+	if configFile.Login.BackoffMaxMs != 0 {
+		config.login.backoffMax = time.Duration(configFile.Login.BackoffMaxMs) * time.Millisecond
+	} else {
+		config.login.backoffMax = 5 * time.Minute
+	}
+	if configFile.Login.LockoutThreshold != 0 {
+		config.login.lockoutThreshold = configFile.Login.LockoutThreshold
+	} else {
+		config.login.lockoutThreshold = 20
+	}
+	if configFile.Login.LockoutMinutes != 0 {
+		config.login.lockoutDuration = time.Duration(configFile.Login.LockoutMinutes) * time.Minute
+	} else {
+		config.login.lockoutDuration = 30 * time.Minute
+	}
+	if configFile.Login.ResetMinutes != 0 {
+		config.login.resetAfter = time.Duration(configFile.Login.ResetMinutes) * time.Minute
+	} else {
+		config.login.resetAfter = 1 * time.Hour
+	}
+
+	if configFile.Account.DeletionCoolingOffDays != 0 {
+		config.account.deletionCoolingOff = time.Duration(configFile.Account.DeletionCoolingOffDays) * 24 * time.Hour
+	} else {
+		config.account.deletionCoolingOff = 14 * 24 * time.Hour
+	}
+
+	for _, stepString := range configFile.Sanctions.Ladder {
+		step, err := parseSanctionStep(stepString)
+		if err != nil {
+			panic(err)
+		}
+
+		config.sanctions.ladder = append(config.sanctions.ladder, step)
+	}
+	if len(config.sanctions.ladder) == 0 {
+		config.sanctions.ladder = []SanctionStep{
+			{sanctionWarn, 0},
+			{sanctionMute, 1 * time.Hour},
+			{sanctionMute, 24 * time.Hour},
+			{sanctionBan, 7 * 24 * time.Hour},
+		}
+	}
+	if configFile.Sanctions.WindowDays != 0 {
+		config.sanctions.window = time.Duration(configFile.Sanctions.WindowDays) * 24 * time.Hour
+	} else {
+		config.sanctions.window = 90 * 24 * time.Hour
+	}
+
+	if configFile.Presence.ReconcileSeconds != 0 {
+		config.presence.reconcileInterval = time.Duration(configFile.Presence.ReconcileSeconds) * time.Second
+	} else {
+		config.presence.reconcileInterval = 2 * time.Minute
+	}
+
+	if configFile.Dm.RetentionDays != 0 {
+		config.dm.retention = time.Duration(configFile.Dm.RetentionDays) * 24 * time.Hour
+	} else {
+		config.dm.retention = 30 * 24 * time.Hour
+	}
+
+	if configFile.Party.InviteExpiryHours != 0 {
+		config.party.inviteExpiry = time.Duration(configFile.Party.InviteExpiryHours) * time.Hour
+	} else {
+		config.party.inviteExpiry = 24 * time.Hour
+	}
+	if configFile.Party.LinkExpiryMinutes != 0 {
+		config.party.linkExpiry = time.Duration(configFile.Party.LinkExpiryMinutes) * time.Minute
+	} else {
+		config.party.linkExpiry = time.Hour
+	}
+	if configFile.Party.MaxMarkers != 0 {
+		config.party.maxMarkers = configFile.Party.MaxMarkers
+	} else {
+		config.party.maxMarkers = 5
+	}
+	if configFile.Party.MarkerMaxMinutes != 0 {
+		config.party.markerMaxDuration = time.Duration(configFile.Party.MarkerMaxMinutes) * time.Minute
+	} else {
+		config.party.markerMaxDuration = time.Hour
+	}
+	if configFile.Party.ChatRetentionDays != 0 {
+		config.party.chatRetentionDays = configFile.Party.ChatRetentionDays
+	} else {
+		config.party.chatRetentionDays = 7
+	}
+	if configFile.Party.MaxChatRetentionDays != 0 {
+		config.party.maxChatRetentionDays = configFile.Party.MaxChatRetentionDays
+	} else {
+		config.party.maxChatRetentionDays = 90
+	}
+
+	if configFile.Chat.EditWindowSeconds != 0 {
+		config.chat.editWindow = time.Duration(configFile.Chat.EditWindowSeconds) * time.Second
+	} else {
+		config.chat.editWindow = 5 * time.Minute
+	}
+	if configFile.Chat.SlowModeSeconds != 0 {
+		config.chat.slowMode = time.Duration(configFile.Chat.SlowModeSeconds) * time.Second
+	} else {
+		config.chat.slowMode = 5 * time.Second
+	}
+	if configFile.Chat.NewAccountHours != 0 {
+		config.chat.newAccountAge = time.Duration(configFile.Chat.NewAccountHours) * time.Hour
+	} else {
+		config.chat.newAccountAge = 24 * time.Hour
+	}
+	if configFile.Chat.RepeatWindowSeconds != 0 {
+		config.chat.repeatWindow = time.Duration(configFile.Chat.RepeatWindowSeconds) * time.Second
+	} else {
+		config.chat.repeatWindow = 30 * time.Second
+	}
+	if configFile.Chat.RepeatLimit != 0 {
+		config.chat.repeatLimit = configFile.Chat.RepeatLimit
+	} else {
+		config.chat.repeatLimit = 2
+	}
+	if configFile.Chat.RepeatFlagLimit != 0 {
+		config.chat.repeatFlagLimit = configFile.Chat.RepeatFlagLimit
+	} else {
+		config.chat.repeatFlagLimit = 4
+	}
+	if configFile.Chat.CapsRatio != 0 {
+		config.chat.capsRatio = configFile.Chat.CapsRatio
+	} else {
+		config.chat.capsRatio = 0.7
+	}
+	if len(configFile.Chat.LinkAllowlist) != 0 {
+		config.chat.linkAllowlist = configFile.Chat.LinkAllowlist
+	} else {
+		config.chat.linkAllowlist = []string{"ynoproject.net"}
+	}
+	if configFile.Chat.RetentionDays != 0 {
+		config.chat.retentionDays = configFile.Chat.RetentionDays
+	} else {
+		config.chat.retentionDays = 1
+	}
+	if configFile.Chat.DmsPerMinute != 0 {
+		config.chat.dmsPerMinute = configFile.Chat.DmsPerMinute
+	} else {
+		config.chat.dmsPerMinute = 10
+	}
+	if configFile.Chat.SearchesPerMinute != 0 {
+		config.chat.searchesPerMinute = configFile.Chat.SearchesPerMinute
 	} else {
-		config.ipc.deadline = 100 * time.Millisecond
+		config.chat.searchesPerMinute = 10
 	}
 
 	if configFile.Logging.MaxSize != 0 {
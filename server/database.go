@@ -86,7 +86,7 @@ func getPlayerRank(uuid string) (rank int) {
 }
 
 func tryBanPlayer(senderUuid string, recipientUuid string, disconnect, broadcast bool) error { // called by api only
-	if getPlayerRank(senderUuid) <= getPlayerRank(recipientUuid) {
+	if !canActOn(senderUuid, recipientUuid, permBan) {
 		return errors.New("insufficient rank")
 	}
 
@@ -157,7 +157,7 @@ func banPlayerUnchecked(recipientUuid string, updateDb, disconnect, temporary, b
 }
 
 func tryUnbanPlayer(senderUuid string, recipientUuid string) error { // called by api only
-	if getPlayerRank(senderUuid) <= getPlayerRank(recipientUuid) {
+	if !canActOn(senderUuid, recipientUuid, permBan) {
 		return errors.New("insufficient rank")
 	}
 
@@ -180,7 +180,7 @@ func unbanPlayerUnchecked(recipientUuid string) error {
 }
 
 func tryMutePlayer(senderUuid string, recipientUuid string, temporary, broadcast bool) error { // called by api only
-	if getPlayerRank(senderUuid) <= getPlayerRank(recipientUuid) {
+	if !canActOn(senderUuid, recipientUuid, permMute) {
 		return errors.New("insufficient rank")
 	}
 
@@ -225,8 +225,52 @@ func mutePlayerUnchecked(recipientUuid string, updateDb, temporary, broadcast bo
 	return nil
 }
 
+func trySetPlayerShadowMuted(senderUuid string, recipientUuid string, shadowMuted bool) error { // called by api only
+	if !canActOn(senderUuid, recipientUuid, permMute) {
+		return errors.New("insufficient rank")
+	}
+
+	if senderUuid == recipientUuid {
+		return errors.New("attempted self-shadow mute")
+	}
+
+	return setPlayerShadowMuted(recipientUuid, shadowMuted)
+}
+
+// shadow muted players' messages are only echoed back to them, so they can't tell they've been muted
+func setPlayerShadowMuted(uuid string, shadowMuted bool) error {
+	_, err := db.Exec("UPDATE players SET shadowMuted = ? WHERE uuid = ?", shadowMuted, uuid)
+	if err != nil {
+		return err
+	}
+
+	// games that can't be reached pick the change up from the database on reconnect
+	forEachGame(func(game string) error {
+		return shadowMutePlayerInGameUnchecked(game, uuid, shadowMuted)
+	})
+
+	return nil
+}
+
+func shadowMutePlayerUnchecked(uuid string, shadowMuted bool) error {
+	if client, ok := clients.Load(uuid); ok {
+		client.shadowMuted = shadowMuted
+	}
+
+	return nil
+}
+
+func getPlayerShadowMuted(uuid string) (shadowMuted bool) {
+	err := db.QueryRow("SELECT shadowMuted FROM players WHERE uuid = ?", uuid).Scan(&shadowMuted)
+	if err != nil {
+		return false
+	}
+
+	return shadowMuted
+}
+
 func tryUnmutePlayer(senderUuid string, recipientUuid string) error { // called by api only
-	if getPlayerRank(senderUuid) <= getPlayerRank(recipientUuid) {
+	if !canActOn(senderUuid, recipientUuid, permMute) {
 		return errors.New("insufficient rank")
 	}
 
@@ -250,7 +294,7 @@ func unmutePlayerUnchecked(recipientUuid string) error {
 }
 
 func tryChangePlayerUsername(senderUuid string, recipientUuid string, newUsername string) error { // called by api only
-	if getPlayerRank(senderUuid) <= getPlayerRank(recipientUuid) {
+	if !canActOn(senderUuid, recipientUuid, permChangeUsername) {
 		return errors.New("insufficient rank")
 	}
 
@@ -273,6 +317,8 @@ func tryChangePlayerUsername(senderUuid string, recipientUuid string, newUsernam
 		if client.roomC != nil {
 			client.roomC.broadcast(buildMsg("name", client.id, newUsername)) // broadcast name change to room if client is in one
 		}
+
+		client.publishPresence(presenceName)
 	}
 
 	return nil
@@ -305,7 +351,7 @@ func getPlayerModerationStatus(uuid string) (banned bool, muted bool) {
 }
 
 func tryBlockPlayer(uuid string, targetUuid string) error { // called by api only
-	if getPlayerRank(uuid) < getPlayerRank(targetUuid) {
+	if getPlayerRolePriority(uuid) < getPlayerRolePriority(targetUuid) {
 		return errors.New("insufficient rank")
 	}
 
@@ -473,13 +519,13 @@ func getChatMessageHistory(uuid string, globalMsgLimit, partyMsgLimit int, lastM
 
 	var query string
 
-	selectClause := "SELECT cm.msgId, cm.uuid, cm.mapId, cm.prevMapId, cm.prevLocations, cm.x, cm.y, cm.contents, cm.timestamp, "
+	selectClause := "SELECT cm.msgId, cm.uuid, cm.mapId, cm.prevMapId, cm.prevLocations, cm.x, cm.y, cm.contents, cm.timestamp, cm.timestampEdited IS NOT NULL, "
 	globalSelectClause := selectClause + "0"
 	partySelectClause := selectClause + "1"
 
 	fromClause := " FROM chatMessages cm JOIN players pd ON pd.uuid = cm.uuid JOIN playerGameData pgd ON pgd.uuid = pd.uuid AND pgd.game = cm.game "
 
-	whereClause := "WHERE cm.game = ? AND pd.banned = 0"
+	whereClause := "WHERE cm.game = ? AND pd.banned = 0 AND cm.deleted = 0"
 
 	if lastMsgId != "" {
 		whereClause += " AND cm.timestamp > (SELECT cm2.timestamp FROM chatMessages cm2 WHERE cm2.msgId = ?)"
@@ -526,7 +572,7 @@ func getChatMessageHistory(uuid string, globalMsgLimit, partyMsgLimit int, lastM
 	for messageResults.Next() {
 		var chatMessage ChatMessage
 
-		err := messageResults.Scan(&chatMessage.MsgId, &chatMessage.Uuid, &chatMessage.MapId, &chatMessage.PrevMapId, &chatMessage.PrevLocations, &chatMessage.X, &chatMessage.Y, &chatMessage.Contents, &chatMessage.Timestamp, &chatMessage.Party)
+		err := messageResults.Scan(&chatMessage.MsgId, &chatMessage.Uuid, &chatMessage.MapId, &chatMessage.PrevMapId, &chatMessage.PrevLocations, &chatMessage.X, &chatMessage.Y, &chatMessage.Contents, &chatMessage.Timestamp, &chatMessage.Edited, &chatMessage.Party)
 		if err != nil {
 			return &chatHistory, err
 		}
@@ -579,8 +625,54 @@ func getChatMessageHistory(uuid string, globalMsgLimit, partyMsgLimit int, lastM
 	return &chatHistory, nil
 }
 
+// returns the author, party (0 for global chat) and send time of a message in this game that hasn't been deleted
+func getChatMessageInfo(msgId string) (uuid string, partyId int, timestamp time.Time, err error) {
+	err = db.QueryRow("SELECT uuid, COALESCE(partyId, 0), timestamp FROM chatMessages WHERE msgId = ? AND game = ? AND deleted = 0", msgId, config.gameName).Scan(&uuid, &partyId, &timestamp)
+	return uuid, partyId, timestamp, err
+}
+
+// previous contents are kept in chatMessageEdits so edits and removals can be reviewed
+func editChatMessage(msgId, editorUuid, contents string) error {
+	_, err := db.Exec("INSERT INTO chatMessageEdits (msgId, game, editorUuid, action, previousContents, timestamp) SELECT msgId, game, ?, 'edit', contents, UTC_TIMESTAMP() FROM chatMessages WHERE msgId = ? AND game = ?", editorUuid, msgId, config.gameName)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE chatMessages SET contents = ?, timestampEdited = UTC_TIMESTAMP() WHERE msgId = ? AND game = ?", contents, msgId, config.gameName)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func deleteChatMessage(msgId, editorUuid string) error {
+	_, err := db.Exec("INSERT INTO chatMessageEdits (msgId, game, editorUuid, action, previousContents, timestamp) SELECT msgId, game, ?, 'delete', contents, UTC_TIMESTAMP() FROM chatMessages WHERE msgId = ? AND game = ?", editorUuid, msgId, config.gameName)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE chatMessages SET deleted = 1 WHERE msgId = ? AND game = ?", msgId, config.gameName)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func deleteOldChatMessages() error {
-	_, err := db.Exec("DELETE FROM chatMessages WHERE timestamp < DATE_SUB(UTC_TIMESTAMP(), INTERVAL 1 DAY)")
+	_, err := db.Exec("DELETE FROM chatMessages WHERE partyId IS NULL AND timestamp < DATE_SUB(UTC_TIMESTAMP(), INTERVAL ? DAY)", config.chat.retentionDays)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM allGamesChatMessages WHERE timestamp < DATE_SUB(UTC_TIMESTAMP(), INTERVAL ? DAY)", config.chat.retentionDays)
+	if err != nil {
+		return err
+	}
+
+	// party chat is kept for as long as its owner chose, and dropped along with the party
+	_, err = db.Exec("DELETE cm FROM chatMessages cm LEFT JOIN parties p ON p.id = cm.partyId WHERE cm.partyId IS NOT NULL AND (p.id IS NULL OR cm.timestamp < DATE_SUB(UTC_TIMESTAMP(), INTERVAL COALESCE(p.chatRetentionDays, ?) DAY))", config.party.chatRetentionDays)
 	if err != nil {
 		return err
 	}
@@ -1535,7 +1627,13 @@ func getBannedMutedPlayers(banned bool) (players []PlayerInfo) {
 		actionStr = "muted"
 	}
 
-	results, err := db.Query("SELECT uuid, rank FROM players WHERE " + actionStr + " = 1")
+	// shadow mutes are listed with mutes, since both keep a player's messages from others
+	query := "SELECT uuid, rank, shadowMuted FROM players WHERE " + actionStr + " = 1"
+	if !banned {
+		query += " OR shadowMuted = 1"
+	}
+
+	results, err := db.Query(query)
 	if err != nil {
 		return players
 	}
@@ -1545,22 +1643,48 @@ func getBannedMutedPlayers(banned bool) (players []PlayerInfo) {
 	for results.Next() {
 		var uuid string
 		var rank int
+		var shadowMuted bool
 
-		err := results.Scan(&uuid, &rank)
+		err := results.Scan(&uuid, &rank, &shadowMuted)
 		if err != nil {
 			return players
 		}
 
 		players = append(players, PlayerInfo{
-			Uuid: uuid,
-			Name: getNameFromUuid(uuid),
-			Rank: rank,
+			Uuid:        uuid,
+			Name:        getNameFromUuid(uuid),
+			Rank:        rank,
+			ShadowMuted: shadowMuted,
 		})
 	}
 
 	return players
 }
 
+func getShadowMutedUuids() (uuids map[string]bool, err error) {
+	results, err := db.Query("SELECT uuid FROM players WHERE shadowMuted = 1")
+	if err != nil {
+		return nil, err
+	}
+
+	defer results.Close()
+
+	uuids = make(map[string]bool)
+
+	for results.Next() {
+		var uuid string
+
+		err := results.Scan(&uuid)
+		if err != nil {
+			return nil, err
+		}
+
+		uuids[uuid] = true
+	}
+
+	return uuids, nil
+}
+
 func getUuidFromName(name string) (uuid string, err error) {
 	err = db.QueryRow("SELECT uuid FROM accounts WHERE user = ?", name).Scan(&uuid)
 	if err != nil {
@@ -0,0 +1,414 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DirectMessage struct {
+	MsgId      string    `json:"msgId"`
+	Uuid       string    `json:"uuid"`
+	Name       string    `json:"name"`
+	TargetUuid string    `json:"targetUuid"`
+	Game       string    `json:"game"`
+	Contents   string    `json:"contents"`
+	Timestamp  time.Time `json:"timestamp"`
+	Read       bool      `json:"read"`
+}
+
+type DirectMessageThread struct {
+	Uuid   string `json:"uuid"`
+	Name   string `json:"name"`
+	Unread int    `json:"unread"`
+}
+
+func initDirectMessages() {
+	// Use main server to clear out old messages for all games
+	if isMainServer {
+		logInitTask("direct messages")
+
+		scheduler.Cron("15 * * * *").Do(deleteOldDirectMessages)
+	}
+}
+
+func (c *SessionClient) handleDm(msg []string) error {
+	if !c.account {
+		return errors.New("not logged in")
+	}
+
+	if c.muted {
+		return errors.New("player is muted")
+	}
+
+	if len(msg) != 3 {
+		return errors.New("segment count mismatch")
+	}
+
+	targetUuid := msg[1]
+	if targetUuid == c.uuid {
+		return errors.New("attempted to message self")
+	}
+
+	err := c.checkDmRateLimit()
+	if err != nil {
+		systemMessage(err.Error(), c.uuid)
+		return err
+	}
+
+	msgContents, verdict, flags, err := c.filterChatMessage(strings.TrimSpace(msg[2]))
+	if err != nil {
+		return err
+	}
+
+	if msgContents == "" || len(msgContents) > 500 {
+		return errors.New("invalid message")
+	}
+
+	if len(flags) > 0 && !c.banned {
+		go c.reportFlaggedChatMessage("", msgContents, flags)
+	}
+
+	dm := &DirectMessage{
+		MsgId:      randString(12),
+		Uuid:       c.uuid,
+		Name:       c.name,
+		TargetUuid: targetUuid,
+		Game:       config.gameName,
+		Contents:   msgContents,
+		Timestamp:  time.Now().UTC(),
+	}
+
+	if c.banned || c.shadowMuted || verdict == chatFilterDrop {
+		// so it looks like it went through
+		c.outbox <- dm.build()
+		return nil
+	}
+
+	err = checkDirectMessageAllowed(c.uuid, targetUuid)
+	if err != nil {
+		return err
+	}
+
+	err = writeDirectMessage(dm)
+	if err != nil {
+		return err
+	}
+
+	c.outbox <- dm.build()
+
+	if deliverDirectMessage(dm) {
+		return nil
+	}
+
+	err = sendPushNotification(&Notification{
+		Title: c.name,
+		Body:  msgContents,
+		Metadata: NotificationMetadata{
+			Category: "social",
+			Type:     "directMessages",
+			YnoIcon:  "chat",
+		},
+	}, []string{targetUuid})
+	if err != nil {
+		writeErrLog(c.uuid, "sess", err.Error())
+	}
+
+	return nil
+}
+
+// limits how many direct messages a player can send per minute, across all recipients
+func (c *SessionClient) checkDmRateLimit() error {
+	now := time.Now()
+
+	c.recentDmTimes = slices.DeleteFunc(c.recentDmTimes, func(t time.Time) bool {
+		return now.Sub(t) > time.Minute
+	})
+
+	if len(c.recentDmTimes) >= config.chat.dmsPerMinute {
+		return errors.New("You are sending direct messages too quickly. Please wait a moment.")
+	}
+
+	c.recentDmTimes = append(c.recentDmTimes, now)
+
+	return nil
+}
+
+func (dm *DirectMessage) build() []byte {
+	return buildMsg("dm", dm.MsgId, dm.Uuid, dm.Name, dm.TargetUuid, dm.Game, dm.Contents)
+}
+
+// enforces blocks and the recipient's friends-only preference
+func checkDirectMessageAllowed(uuid, targetUuid string) error {
+	var targetAccount, friendsOnly bool
+	err := db.QueryRow("SELECT COUNT(*) > 0, COALESCE((SELECT friendsOnly FROM playerDmSettings WHERE uuid = ?), 0) FROM accounts WHERE uuid = ?", targetUuid, targetUuid).Scan(&targetAccount, &friendsOnly)
+	if err != nil {
+		return err
+	}
+
+	if !targetAccount {
+		return errors.New("recipient has no account")
+	}
+
+	if isPlayerBlocked(uuid, targetUuid) || isPlayerBlocked(targetUuid, uuid) {
+		return errors.New("blocked")
+	}
+
+	if friendsOnly {
+		var accepted bool
+		err := db.QueryRow("SELECT COUNT(*) > 0 FROM playerFriends WHERE uuid = ? AND targetUuid = ? AND accepted = 1", targetUuid, uuid).Scan(&accepted)
+		if err != nil {
+			return err
+		}
+
+		if !accepted {
+			return errors.New("recipient only accepts messages from friends")
+		}
+	}
+
+	return nil
+}
+
+// reports whether the recipient was online to receive the message, here or in another game
+func deliverDirectMessage(dm *DirectMessage) bool {
+	if receiveDirectMessage(dm) {
+		return true
+	}
+
+	event, ok := remotePresence.Get(dm.TargetUuid)
+	if !ok {
+		return false
+	}
+
+	return ipcCall(event.Game, "IPC.DeliverDm", *dm, false) == nil
+}
+
+func receiveDirectMessage(dm *DirectMessage) bool {
+	client, ok := clients.Load(dm.TargetUuid)
+	if !ok {
+		return false
+	}
+
+	// the sender's game may have a different filter list
+	filtered := wordFilter.Filter(dm.Contents)
+	if filtered.Blocked {
+		// counts as handled; the recipient just never sees it
+		return true
+	}
+
+	received := *dm
+	received.Contents = filtered.Contents
+
+	client.trySend(received.build())
+
+	return true
+}
+
+func writeDirectMessage(dm *DirectMessage) error {
+	_, err := db.Exec("INSERT INTO directMessages (msgId, uuid, targetUuid, game, contents, timestamp) VALUES (?, ?, ?, ?, ?, ?)", dm.MsgId, dm.Uuid, dm.TargetUuid, dm.Game, dm.Contents, dm.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func deleteOldDirectMessages() error {
+	_, err := db.Exec("DELETE FROM directMessages WHERE timestamp < ?", time.Now().UTC().Add(-config.dm.retention))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// returns messages exchanged with otherUuid, newest first, older than before if set
+func getDirectMessageHistory(uuid, otherUuid string, before time.Time, limit int) (dms []*DirectMessage, err error) {
+	query := "SELECT dm.msgId, dm.uuid, COALESCE(a.user, ''), dm.targetUuid, dm.game, dm.contents, dm.timestamp, dm.readTimestamp IS NOT NULL FROM directMessages dm LEFT JOIN accounts a ON a.uuid = dm.uuid WHERE ((dm.uuid = ? AND dm.targetUuid = ?) OR (dm.uuid = ? AND dm.targetUuid = ?))"
+	args := []any{uuid, otherUuid, otherUuid, uuid}
+
+	if !before.IsZero() {
+		query += " AND dm.timestamp < ?"
+		args = append(args, before.UTC())
+	}
+
+	query += " ORDER BY dm.timestamp DESC LIMIT ?"
+	args = append(args, limit)
+
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return dms, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		dm := &DirectMessage{}
+
+		err := results.Scan(&dm.MsgId, &dm.Uuid, &dm.Name, &dm.TargetUuid, &dm.Game, &dm.Contents, &dm.Timestamp, &dm.Read)
+		if err != nil {
+			return dms, err
+		}
+
+		dms = append(dms, dm)
+	}
+
+	return dms, nil
+}
+
+func getDirectMessageThreads(uuid string) (threads []*DirectMessageThread, err error) {
+	results, err := db.Query("SELECT t.otherUuid, COALESCE(a.user, ''), SUM(t.unread) FROM (SELECT CASE WHEN uuid = ? THEN targetUuid ELSE uuid END AS otherUuid, CASE WHEN targetUuid = ? AND readTimestamp IS NULL THEN 1 ELSE 0 END AS unread, timestamp FROM directMessages WHERE uuid = ? OR targetUuid = ?) t LEFT JOIN accounts a ON a.uuid = t.otherUuid GROUP BY t.otherUuid, a.user ORDER BY MAX(t.timestamp) DESC", uuid, uuid, uuid, uuid)
+	if err != nil {
+		return threads, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		thread := &DirectMessageThread{}
+
+		err := results.Scan(&thread.Uuid, &thread.Name, &thread.Unread)
+		if err != nil {
+			return threads, err
+		}
+
+		threads = append(threads, thread)
+	}
+
+	return threads, nil
+}
+
+func handleDm(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		handleError(w, r, "token not specified")
+		return
+	}
+
+	uuid, _, _, _, banned, _ := getPlayerDataFromToken(token)
+	if uuid == "" {
+		handleError(w, r, "invalid token")
+		return
+	}
+
+	if banned {
+		handleError(w, r, "player is banned")
+		return
+	}
+
+	query := r.URL.Query()
+
+	switch query.Get("command") {
+	case "threads":
+		threads, err := getDirectMessageThreads(uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		if threads == nil {
+			threads = []*DirectMessageThread{}
+		}
+
+		threadsJson, err := json.Marshal(threads)
+		if err != nil {
+			handleError(w, r, "error while marshaling")
+			return
+		}
+
+		w.Write(threadsJson)
+		return
+	case "history":
+		otherUuid := query.Get("uuid")
+		if otherUuid == "" {
+			handleError(w, r, "uuid not specified")
+			return
+		}
+
+		var before time.Time
+		if beforeParam := query.Get("before"); beforeParam != "" {
+			var err error
+			before, err = time.Parse(time.RFC3339, beforeParam)
+			if err != nil {
+				handleError(w, r, "invalid before value")
+				return
+			}
+		}
+
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > 100 {
+			limit = 100
+		}
+
+		dms, err := getDirectMessageHistory(uuid, otherUuid, before, limit)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		if dms == nil {
+			dms = []*DirectMessage{}
+		}
+
+		// viewing the conversation counts as reading it
+		_, err = db.Exec("UPDATE directMessages SET readTimestamp = UTC_TIMESTAMP() WHERE uuid = ? AND targetUuid = ? AND readTimestamp IS NULL", otherUuid, uuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		dmsJson, err := json.Marshal(dms)
+		if err != nil {
+			handleError(w, r, "error while marshaling")
+			return
+		}
+
+		w.Write(dmsJson)
+		return
+	case "settings":
+		friendsOnly := query.Get("friendsOnly")
+		if friendsOnly == "" {
+			err := db.QueryRow("SELECT COALESCE((SELECT friendsOnly FROM playerDmSettings WHERE uuid = ?), 0)", uuid).Scan(&friendsOnly)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+
+			w.Write([]byte(fmt.Sprintf("{\"friendsOnly\":%t}", friendsOnly == "1")))
+			return
+		}
+
+		_, err := db.Exec("INSERT INTO playerDmSettings (uuid, friendsOnly) VALUES (?, ?) ON DUPLICATE KEY UPDATE friendsOnly = ?", uuid, friendsOnly == "1", friendsOnly == "1")
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
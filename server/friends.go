@@ -32,14 +32,14 @@ func sendFriendsUpdate() {
 			}
 		}
 
-		client.onlineFriends = onlineFriends
+		client.setOnlineFriends(onlineFriends)
 
 		playerFriendDataJson, err := json.Marshal(playerFriendData)
 		if err != nil {
 			continue
 		}
 
-		client.outbox <- buildMsg("pf", playerFriendDataJson)
+		client.trySend(buildMsg("pf", playerFriendDataJson))
 	}
 }
 
@@ -129,6 +129,20 @@ func getPlayerFriendData(uuid string) (playerFriends []*PlayerFriend, err error)
 
 				playerFriend.Online = true
 			}
+		} else if event, ok := remotePresence.Get(playerFriend.Uuid); ok && playerFriend.Accepted && !clients.Exists(playerFriend.Uuid) {
+			// live state from the game they're playing right now, ahead of the database
+			playerFriend.Game = event.Game
+			playerFriend.SystemName = event.SystemName
+			playerFriend.SpriteName = event.SpriteName
+			playerFriend.SpriteIndex = event.SpriteIndex
+			playerFriend.Badge = event.Badge
+			playerFriend.Medals = event.Medals
+			playerFriend.MapId = event.MapId
+			playerFriend.PrevMapId = event.PrevMapId
+			playerFriend.PrevLocations = event.PrevLocations
+			playerFriend.X = event.X
+			playerFriend.Y = event.Y
+			playerFriend.Online = true
 		}
 
 		playerFriends = append(playerFriends, playerFriend)
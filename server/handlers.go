@@ -24,6 +24,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (c *RoomClient) handleSr(msg []string) error {
@@ -160,6 +161,8 @@ func (c *RoomClient) handleSpr(msg []string) error {
 
 	c.broadcast(buildMsg("spr", c.session.id, msg[1:]))
 
+	c.session.publishPresence(presenceSprite)
+
 	return nil
 }
 
@@ -254,6 +257,8 @@ func (c *RoomClient) handleSys(msg []string) (err error) {
 
 	c.broadcast(buildMsg("sys", c.session.id, msg[1]))
 
+	c.session.publishPresence(presenceSystem)
+
 	return nil
 }
 
@@ -525,7 +530,7 @@ func (c *RoomClient) handleSs(msg []string) error {
 
 	value := msg[2] == "1"
 
-	if config.gameName == "2kki" && c.session.rank == 0 && switchId == 11 && value {
+	if config.gameName == "2kki" && switchId == 11 && value && !can(c.session.uuid, permBypassDebugChecks) {
 		c.session.cancel()
 	}
 
@@ -537,7 +542,7 @@ func (c *RoomClient) handleSs(msg []string) error {
 	} else {
 		if len(c.room.minigames) != 0 {
 			for m, minigame := range c.room.minigames {
-				if minigame.Dev && c.session.rank < 1 {
+				if minigame.Dev && !can(c.session.uuid, permPlayDevMinigames) {
 					continue
 				}
 				if minigame.SwitchId == switchId && minigame.SwitchValue == value && c.minigameScores[m] < c.varCache[minigame.VarId] {
@@ -675,7 +680,7 @@ func (c *RoomClient) handleSv(msg []string) error {
 	} else {
 		if len(c.room.minigames) != 0 {
 			for m, minigame := range c.room.minigames {
-				if minigame.Dev && c.session.rank < 1 {
+				if minigame.Dev && !can(c.session.uuid, permPlayDevMinigames) {
 					continue
 				}
 				if minigame.VarId == varId && c.minigameScores[m] < value {
@@ -878,6 +883,8 @@ func (c *SessionClient) handleName(msg []string) error {
 		c.roomC.broadcast(buildMsg("name", c.id, c.name)) // broadcast name change to room if client is in one
 	}
 
+	c.publishPresence(presenceName)
+
 	return nil
 }
 
@@ -899,6 +906,8 @@ func (c *SessionClient) handlePloc(msg []string) error {
 
 	c.roomC.checkRoomConditions("prevMap", c.roomC.prevMapId)
 
+	c.publishPresence(presenceMap)
+
 	return nil
 }
 
@@ -928,24 +937,36 @@ func (c *SessionClient) handleSay(msg []string) error {
 		return errors.New("room client does not exist")
 	}
 
-	if c.muted {
-		return errors.New("player is muted")
-	}
-
 	if len(msg) != 2 {
 		return errors.New("segment count mismatch")
 	}
 
+	if strings.HasPrefix(msg[1], "/") {
+		return c.handleChatCommand(msg[1])
+	}
+
+	if c.muted {
+		return errors.New("player is muted")
+	}
+
 	if c.name == "" || c.system == "" {
 		return errors.New("no name or system graphic set")
 	}
 
-	msgContents := wordFilter.ReplaceAllString(strings.TrimSpace(msg[1]), ":2kkiSign:")
+	msgContents, verdict, flags, err := c.filterChatMessage(strings.TrimSpace(msg[1]))
+	if err != nil {
+		return err
+	}
+
 	if msgContents == "" || len(msgContents) > 150 {
 		return errors.New("invalid message")
 	}
 
-	if !c.banned {
+	if len(flags) > 0 && !c.banned {
+		go c.reportFlaggedChatMessage("", msgContents, flags)
+	}
+
+	if !c.banned && !c.shadowMuted && verdict != chatFilterDrop {
 		for _, client := range c.roomC.room.clients {
 			if client.session == c {
 				continue
@@ -970,23 +991,34 @@ func (c *SessionClient) handleSay(msg []string) error {
 }
 
 func (c *SessionClient) handleGPSay(msg []string) error {
-	if c.muted {
-		return errors.New("player is muted")
-	}
-
 	if len(msg) != 2 {
 		return errors.New("segment count mismatch")
 	}
 
+	if strings.HasPrefix(msg[1], "/") {
+		return c.handleChatCommand(msg[1])
+	}
+
+	if c.muted {
+		return errors.New("player is muted")
+	}
+
 	if c.name == "" {
 		return errors.New("no name set")
 	}
 
-	msgContents := wordFilter.ReplaceAllString(strings.TrimSpace(msg[1]), ":2kkiSign:")
+	msgContents, verdict, flags, err := c.filterChatMessage(strings.TrimSpace(msg[1]))
+	if err != nil {
+		return err
+	}
+
 	if msgContents == "" || len(msgContents) > 150 {
 		return errors.New("invalid message")
 	}
 
+	// shadow dropped messages are only echoed back, like those of banned players
+	shadowDropped := c.banned || c.shadowMuted || verdict == chatFilterDrop
+
 	if msg[0] == "psay" && c.partyId == 0 {
 		return errors.New("player not in a party")
 	}
@@ -1007,8 +1039,13 @@ func (c *SessionClient) handleGPSay(msg []string) error {
 
 	msgId := randString(12)
 
+	// dropped messages are never stored, so their flags are reported on their own before returning
+	if shadowDropped && len(flags) > 0 && !c.banned {
+		go c.reportFlaggedChatMessage("", msgContents, flags)
+	}
+
 	if msg[0] == "gsay" {
-		if !c.banned {
+		if !shadowDropped {
 			c.broadcast(buildMsg("p", c.uuid, c.name, c.system, c.rank, c.account, c.badge, c.medals[:]))
 			c.broadcast(buildMsg("gsay", c.uuid, mapId, prevMapId, prevLocations, x, y, msgContents, msgId))
 		} else {
@@ -1021,6 +1058,10 @@ func (c *SessionClient) handleGPSay(msg []string) error {
 			return err
 		}
 
+		if len(flags) > 0 {
+			go c.reportFlaggedChatMessage(msgId, msgContents, flags)
+		}
+
 		if c.account && config.chatWebhook != "" {
 			game := config.gameName
 			if gameName, ok := gameIdToName[game]; ok {
@@ -1033,7 +1074,7 @@ func (c *SessionClient) handleGPSay(msg []string) error {
 			}
 		}
 	} else {
-		if !c.banned {
+		if !shadowDropped {
 			for _, client := range clients.Get() {
 				if client.partyId == c.partyId {
 					if c.isBlockedWith(client) {
@@ -1051,11 +1092,126 @@ func (c *SessionClient) handleGPSay(msg []string) error {
 		if err != nil {
 			return err
 		}
+
+		partiesMutex.Lock()
+		if party, ok := parties[c.partyId]; ok && party.CrossGame {
+			relayPartyChatMessage(c.partyId, c.uuid, msgContents, msgId)
+		}
+		partiesMutex.Unlock()
+
+		if len(flags) > 0 {
+			go c.reportFlaggedChatMessage(msgId, msgContents, flags)
+		}
+	}
+
+	return nil
+}
+
+func (c *SessionClient) handleGdel(msg []string) error {
+	if len(msg) != 2 {
+		return errors.New("segment count mismatch")
+	}
+
+	authorUuid, partyId, timestamp, err := getChatMessageInfo(msg[1])
+	if err != nil {
+		return err
+	}
+
+	if authorUuid == c.uuid {
+		if c.muted || time.Since(timestamp) > config.chat.editWindow {
+			return errors.New("message can no longer be deleted")
+		}
+	} else if !canActOn(c.uuid, authorUuid, permDeleteMessages) {
+		return errors.New("access denied")
+	}
+
+	return removeChatMessage(msg[1], c.uuid, c.name, authorUuid, partyId, auditSourceWeb)
+}
+
+// deletes the message, tells clients to remove it and records who removed it
+func removeChatMessage(msgId, actorUuid, actorName, authorUuid string, partyId int, source string) error {
+	err := deleteChatMessage(msgId, actorUuid)
+	if err != nil {
+		return err
+	}
+
+	sendChatMessageUpdate(partyId, buildMsg("gdel", msgId))
+	relayPartyChatUpdate(partyId, msgId, "")
+
+	if actorUuid != authorUuid {
+		writeModAuditLog(actorUuid, actorName, authorUuid, "delete_message", msgId, source, nil)
+	}
+
+	return nil
+}
+
+func (c *SessionClient) handleGedit(msg []string) error {
+	if c.muted {
+		return errors.New("player is muted")
+	}
+
+	if len(msg) != 3 {
+		return errors.New("segment count mismatch")
+	}
+
+	authorUuid, partyId, timestamp, err := getChatMessageInfo(msg[1])
+	if err != nil {
+		return err
+	}
+
+	if authorUuid != c.uuid {
+		return errors.New("access denied")
+	}
+
+	if time.Since(timestamp) > config.chat.editWindow {
+		return errors.New("message can no longer be edited")
+	}
+
+	msgContents, verdict, flags, err := c.filterChatMessage(strings.TrimSpace(msg[2]))
+	if err != nil {
+		return err
+	}
+
+	if msgContents == "" || len(msgContents) > 150 {
+		return errors.New("invalid message")
+	}
+
+	if c.banned || c.shadowMuted || verdict == chatFilterDrop {
+		if len(flags) > 0 && !c.banned {
+			go c.reportFlaggedChatMessage("", msgContents, flags)
+		}
+
+		// so it looks like it went through
+		c.outbox <- buildMsg("gedit", msg[1], msgContents)
+		return nil
+	}
+
+	err = editChatMessage(msg[1], c.uuid, msgContents)
+	if err != nil {
+		return err
+	}
+
+	sendChatMessageUpdate(partyId, buildMsg("gedit", msg[1], msgContents))
+	relayPartyChatUpdate(partyId, msg[1], msgContents)
+
+	if len(flags) > 0 {
+		go c.reportFlaggedChatMessage(msg[1], msgContents, flags)
 	}
 
 	return nil
 }
 
+// sends an edit or removal to everyone who could have seen the message
+func sendChatMessageUpdate(partyId int, msg []byte) {
+	for _, client := range clients.Get() {
+		if partyId != 0 && client.partyId != partyId {
+			continue
+		}
+
+		client.trySend(msg)
+	}
+}
+
 func (c *SessionClient) handleL(msg []string) error {
 	if c.roomC == nil {
 		return errors.New("room client does not exist")
@@ -1171,6 +1327,9 @@ func (c *SessionClient) handlePt() error {
 		return nil
 	}
 
+	partiesMutex.Lock()
+	defer partiesMutex.Unlock()
+
 	if c.partyId == 0 {
 		return errors.New("player not in a party")
 	}
@@ -41,7 +41,9 @@ type ChatMessage struct {
 	Y             int       `json:"y"`
 	Contents      string    `json:"contents"`
 	Timestamp     time.Time `json:"timestamp"`
+	Edited        bool      `json:"edited"`
 	Party         bool      `json:"party"`
+	Game          string    `json:"game,omitempty"`
 }
 
 type ChatHistory struct {
@@ -49,6 +51,13 @@ type ChatHistory struct {
 	Messages []*ChatMessage `json:"messages"`
 }
 
+// used by the party history, search and context endpoints
+type ChatHistoryPage struct {
+	Players  []*ChatPlayer  `json:"players"`
+	Messages []*ChatMessage `json:"messages"`
+	Cursor   string         `json:"cursor,omitempty"` // pass as before to get the next (older) page
+}
+
 func initHistory() {
 	// Use main server to process chat message cleaning task for all games
 	if isMainServer {
@@ -0,0 +1,335 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	identitySignalIp      = "ip"
+	identitySignalSubnet  = "subnet"
+	identitySignalSession = "session"
+	identitySignalPush    = "push"
+
+	// signals shared by more uuids than this are public networks or the like, not alts
+	maxIdentitySignalUuids = 20
+	// a subnet only links identities when one shows up this soon after the other was last seen
+	identitySubnetWindow = time.Hour
+	// independent signals a banned player's likely alt has to share before config.moderation.altAction applies
+	minAltActionSignals = 2
+)
+
+var identitySignalWeights = map[string]int{
+	identitySignalIp:      3,
+	identitySignalSubnet:  1,
+	identitySignalSession: 4,
+	identitySignalPush:    3,
+}
+
+type LinkedIdentity struct {
+	Uuid    string   `json:"uuid"`
+	Name    string   `json:"name"`
+	Banned  bool     `json:"banned"`
+	Score   int      `json:"score"`
+	Signals []string `json:"signals"`
+}
+
+func initIdentities() {
+	if config.moderation.identitySecret == "" {
+		log.Println("moderation.identity_secret is not set, likely alts will not be tracked")
+	}
+
+	if !isMainServer {
+		return
+	}
+
+	logInitTask("identities")
+
+	scheduler.Every(1).Day().Do(func() {
+		_, err := db.Exec("DELETE FROM playerIdentitySignals WHERE lastSeen < DATE_SUB(NOW(), INTERVAL 180 DAY)")
+		if err != nil {
+			eprintf("IDENTITY", "failed to delete old identity signals: %s", err)
+		}
+	})
+}
+
+// signals are only compared for equality, so they're stored keyed with a secret;
+// a plain hash of an address space as small as IPv4 could simply be reversed
+func recordIdentitySignal(uuid, kind, signal string) error {
+	if signal == "" || config.moderation.identitySecret == "" {
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, []byte(config.moderation.identitySecret))
+	mac.Write([]byte(kind + ":" + signal))
+
+	_, err := db.Exec("INSERT INTO playerIdentitySignals (uuid, kind, signalHash, firstSeen, lastSeen) VALUES (?, ?, ?, NOW(), NOW()) ON DUPLICATE KEY UPDATE lastSeen = NOW()", uuid, kind, hex.EncodeToString(mac.Sum(nil)))
+	return err
+}
+
+func recordIpIdentitySignals(uuid, ip string) error {
+	err := recordIdentitySignal(uuid, identitySignalIp, ip)
+	if err != nil {
+		return err
+	}
+
+	return recordIdentitySignal(uuid, identitySignalSubnet, getIpSubnet(ip))
+}
+
+// links the account to the ip it logged in from, and to the account whose session the browser still held
+func recordLoginIdentitySignals(user, ip, prevToken string) {
+	var uuid string
+	if db.QueryRow("SELECT uuid FROM accounts WHERE user = ?", user).Scan(&uuid) != nil {
+		return
+	}
+
+	err := recordIpIdentitySignals(uuid, ip)
+	if err != nil {
+		writeErrLog(uuid, "login", err.Error())
+	}
+
+	if prevToken == "" {
+		return
+	}
+
+	prevUuid := getUuidFromToken(prevToken)
+	if prevUuid == "" || prevUuid == uuid {
+		return
+	}
+
+	for _, sessionUuid := range []string{prevUuid, uuid} {
+		err := recordIdentitySignal(sessionUuid, identitySignalSession, prevToken)
+		if err != nil {
+			writeErrLog(sessionUuid, "login", err.Error())
+		}
+	}
+}
+
+// the /24 (IPv4) or /48 (IPv6) network of the client's address
+func getIpSubnet(ip string) string {
+	client, _, _ := strings.Cut(ip, ",")
+
+	parsed := net.ParseIP(strings.TrimSpace(client))
+	if parsed == nil {
+		return ""
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+
+	return parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// other uuids sharing signals with uuid whose combined weight reaches config.moderation.altLinkScore, strongest first
+func getLinkedIdentities(uuid string) ([]*LinkedIdentity, error) {
+	results, err := db.Query(`
+SELECT o.uuid, s.kind, s.firstSeen, s.lastSeen, o.firstSeen, o.lastSeen
+FROM playerIdentitySignals s
+JOIN playerIdentitySignals o ON o.kind = s.kind AND o.signalHash = s.signalHash AND o.uuid <> s.uuid
+WHERE s.uuid = ? AND (SELECT COUNT(*) FROM playerIdentitySignals c WHERE c.kind = s.kind AND c.signalHash = s.signalHash) <= ?
+LIMIT 1000`, uuid, maxIdentitySignalUuids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer results.Close()
+
+	linkedIdentities := make(map[string]*LinkedIdentity)
+
+	for results.Next() {
+		var otherUuid, kind string
+		var firstSeen, lastSeen, otherFirstSeen, otherLastSeen time.Time
+
+		err := results.Scan(&otherUuid, &kind, &firstSeen, &lastSeen, &otherFirstSeen, &otherLastSeen)
+		if err != nil {
+			return nil, err
+		}
+
+		if kind == identitySignalSubnet && !isIdentityHandover(firstSeen, lastSeen, otherFirstSeen, otherLastSeen) {
+			continue
+		}
+
+		linkedIdentity, ok := linkedIdentities[otherUuid]
+		if !ok {
+			linkedIdentity = &LinkedIdentity{Uuid: otherUuid}
+			linkedIdentities[otherUuid] = linkedIdentity
+		}
+
+		if !slices.Contains(linkedIdentity.Signals, kind) {
+			linkedIdentity.Signals = append(linkedIdentity.Signals, kind)
+			linkedIdentity.Score += identitySignalWeights[kind]
+		}
+	}
+
+	var likelyAlts []*LinkedIdentity
+
+	for _, linkedIdentity := range linkedIdentities {
+		if linkedIdentity.Score < config.moderation.altLinkScore {
+			continue
+		}
+
+		linkedIdentity.Name = getNameFromUuid(linkedIdentity.Uuid)
+		linkedIdentity.Banned, _ = getPlayerModerationStatus(linkedIdentity.Uuid)
+
+		likelyAlts = append(likelyAlts, linkedIdentity)
+	}
+
+	slices.SortFunc(likelyAlts, func(a, b *LinkedIdentity) int {
+		if a.Score != b.Score {
+			return b.Score - a.Score
+		}
+		return strings.Compare(a.Uuid, b.Uuid)
+	})
+
+	return likelyAlts, nil
+}
+
+// whether either identity first appeared on a network shortly after the other was last seen there
+func isIdentityHandover(firstSeen, lastSeen, otherFirstSeen, otherLastSeen time.Time) bool {
+	nearby := func(a, b time.Time) bool {
+		return a.Sub(b).Abs() <= identitySubnetWindow
+	}
+
+	return nearby(firstSeen, otherLastSeen) || nearby(otherFirstSeen, lastSeen)
+}
+
+// ip and subnet both come from the network the player connects from, so together they only count once
+func countIndependentIdentitySignals(signals []string) (count int) {
+	var network bool
+	for _, signal := range signals {
+		if signal == identitySignalIp || signal == identitySignalSubnet {
+			if network {
+				continue
+			}
+			network = true
+		}
+		count++
+	}
+
+	return count
+}
+
+// flags (and with config.moderation.altAction "mute", temporarily mutes) an identity first seen
+// in the last day that is linked to a banned one by at least minAltActionSignals independent signals.
+// a shared network alone isn't enough, since a whole NAT or CGNAT can sit behind one address
+func checkLinkedBannedIdentities(uuid string) error {
+	if config.moderation.altAction != "flag" && config.moderation.altAction != "mute" {
+		return nil
+	}
+
+	var isNew bool
+	err := db.QueryRow("SELECT COALESCE(MIN(firstSeen) > DATE_SUB(NOW(), INTERVAL 1 DAY), 0) FROM playerIdentitySignals WHERE uuid = ?", uuid).Scan(&isNew)
+	if err != nil || !isNew {
+		return err
+	}
+
+	if banned, _ := getPlayerModerationStatus(uuid); banned {
+		return nil
+	}
+
+	linkedIdentities, err := getLinkedIdentities(uuid)
+	if err != nil {
+		return err
+	}
+
+	var bannedIdentity *LinkedIdentity
+	for _, linkedIdentity := range linkedIdentities {
+		if linkedIdentity.Banned && countIndependentIdentitySignals(linkedIdentity.Signals) >= minAltActionSignals {
+			bannedIdentity = linkedIdentity
+			break
+		}
+	}
+	if bannedIdentity == nil {
+		return nil
+	}
+
+	// this runs on every connect; playerAltActions is keyed by uuid, so only whoever inserts the marker acts on it
+	result, err := db.Exec("INSERT IGNORE INTO playerAltActions (uuid, linkedUuid, action, timestamp) VALUES (?, ?, ?, NOW())", uuid, bannedIdentity.Uuid, config.moderation.altAction)
+	if err != nil {
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil || inserted == 0 {
+		return err
+	}
+
+	reason := fmt.Sprintf("Automatic: likely alt of banned player %s (%s)", bannedIdentity.Name, strings.Join(bannedIdentity.Signals, ", "))
+
+	var expiry *time.Time
+	if config.moderation.altAction == "mute" {
+		muteExpiry := time.Now().Add(config.moderation.altMuteDuration)
+		expiry = &muteExpiry
+
+		err = mutePlayerInAllGamesUnchecked(uuid, true, false)
+		if err != nil {
+			return err
+		}
+
+		err = registerModAction(uuid, actionMute, muteExpiry, reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	writeModAuditLog("", "", uuid, "alt_"+config.moderation.altAction, reason, auditSourceSystem, expiry)
+
+	msgId, originalMsg, err := createReport(systemReporterUuid, uuid, reason, "", "")
+	if err != nil {
+		return err
+	}
+
+	return sendReportLog(uuid, msgId, originalMsg)
+}
+
+// likely alts as listed in the report log
+func getLinkedIdentitiesSummary(uuid string) string {
+	linkedIdentities, err := getLinkedIdentities(uuid)
+	if err != nil {
+		return "-# unavailable"
+	}
+	if len(linkedIdentities) == 0 {
+		return "-# none"
+	}
+
+	var lines []string
+	for i, linkedIdentity := range linkedIdentities {
+		if i == 5 {
+			lines = append(lines, fmt.Sprintf("-# and %d more", len(linkedIdentities)-i))
+			break
+		}
+
+		line := fmt.Sprintf("- %s (`%s`): %s", linkedIdentity.Name, linkedIdentity.Uuid, strings.Join(linkedIdentity.Signals, ", "))
+		if linkedIdentity.Banned {
+			line += " **banned**"
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -18,15 +18,30 @@
 package server
 
 import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// bumped whenever a method is added or its arguments change; servers refuse peers on another version
+//
+// 3: ShadowMute, RefreshParty, RelayPartyChat, RelayPartyChatUpdate, RelayPartyMarker, RelayPartyMarkerRemoval,
+// DeliverDm, CloseReportLog, RefreshRoles
+const ipcProtocolVersion = 3
+
 // "Methods" can be defined on this actor which then can be called by sibling processes.
 type IPC struct{}
 
@@ -50,6 +65,15 @@ func (*IPC) TryMute(args TryMuteArgs, _ *Void) error {
 	return mutePlayerUnchecked(args.TargetUuid, false, args.Temporary, args.Broadcast)
 }
 
+type ShadowMuteArgs struct {
+	TargetUuid  string
+	ShadowMuted bool
+}
+
+func (*IPC) ShadowMute(args ShadowMuteArgs, _ *Void) error {
+	return shadowMutePlayerUnchecked(args.TargetUuid, args.ShadowMuted)
+}
+
 type SendReportLogArgs struct {
 	Uuid, YnoMsgId, OriginalMsg, Game string
 }
@@ -58,6 +82,14 @@ func (*IPC) SendReportLog(args SendReportLogArgs, _ *Void) error {
 	return sendReportLogMainServer(args.Uuid, args.YnoMsgId, args.OriginalMsg, args.Game)
 }
 
+type CloseReportLogArgs struct {
+	TargetUuid, Content string
+}
+
+func (*IPC) CloseReportLog(args CloseReportLogArgs, _ *Void) error {
+	return closeReportLogMainServer(args.TargetUuid, args.Content)
+}
+
 type ScheduleModActionReversalArgs struct {
 	Uuid   string
 	Action int
@@ -68,6 +100,105 @@ func (*IPC) ScheduleModActionReversal(args ScheduleModActionReversalArgs, _ *Voi
 	return scheduleModActionReversalMainServer(args.Uuid, args.Action, args.Expiry, true)
 }
 
+type PurgePlayerArgs struct {
+	Uuid string
+}
+
+func (*IPC) PurgePlayer(args PurgePlayerArgs, _ *Void) error {
+	return purgePlayerUnchecked(args.Uuid)
+}
+
+func (*IPC) PublishPresence(args PresenceEvent, _ *Void) error {
+	receiveRemotePresence(&args)
+	return nil
+}
+
+type SyncPresenceArgs struct {
+	Game   string
+	Events []*PresenceEvent
+}
+
+func (*IPC) SyncPresence(args SyncPresenceArgs, _ *Void) error {
+	remotePresence.sync(args.Game, args.Events)
+	return nil
+}
+
+func (*IPC) RelayChat(args AllGamesChatMessage, _ *Void) error {
+	return receiveAllGamesChatMessage(&args)
+}
+
+func (*IPC) DeliverDm(args DirectMessage, _ *Void) error {
+	if !receiveDirectMessage(&args) {
+		return errors.New("recipient is not connected")
+	}
+	return nil
+}
+
+func (*IPC) RefreshRoles(uuid string, _ *Void) error {
+	return refreshPlayerRolesUnchecked(uuid)
+}
+
+func (*IPC) RefreshParty(partyId int, _ *Void) error {
+	partiesMutex.Lock()
+	defer partiesMutex.Unlock()
+
+	return refreshParty(partyId)
+}
+
+type PartyMarkerArgs struct {
+	PartyId int
+	Marker  PartyMarker
+}
+
+func (*IPC) RelayPartyMarker(args PartyMarkerArgs, _ *Void) error {
+	partiesMutex.Lock()
+	defer partiesMutex.Unlock()
+
+	receivePartyMarker(args.PartyId, &args.Marker)
+	return nil
+}
+
+type PartyMarkerRemovalArgs struct {
+	PartyId   int
+	MarkerIds []int
+}
+
+func (*IPC) RelayPartyMarkerRemoval(args PartyMarkerRemovalArgs, _ *Void) error {
+	partiesMutex.Lock()
+	defer partiesMutex.Unlock()
+
+	receivePartyMarkerRemoval(args.PartyId, args.MarkerIds)
+	return nil
+}
+
+type PartyChatArgs struct {
+	PartyId  int
+	Uuid     string
+	Contents string
+	MsgId    string
+}
+
+func (*IPC) RelayPartyChat(args PartyChatArgs, _ *Void) error {
+	partiesMutex.Lock()
+	defer partiesMutex.Unlock()
+
+	return receivePartyChatMessage(&args)
+}
+
+type PartyChatUpdateArgs struct {
+	PartyId  int
+	MsgId    string
+	Contents string
+}
+
+func (*IPC) RelayPartyChatUpdate(args PartyChatUpdateArgs, _ *Void) error {
+	partiesMutex.Lock()
+	defer partiesMutex.Unlock()
+
+	receivePartyChatUpdate(&args)
+	return nil
+}
+
 func (*IPC) UpdateEventVmInfo(args Void, _ *Void) error {
 	_, err := updateEventVmInfo()
 	return err
@@ -77,106 +208,316 @@ func banPlayerInGameUnchecked(game, uuid string, disconnect, temporary, broadcas
 	if game == config.gameName {
 		return banPlayerUnchecked(uuid, true, disconnect, temporary, broadcast)
 	}
-	client, err := rpc.Dial("unix", fmt.Sprintf("/tmp/yno/%s.sck", game))
-	if err != nil {
-		return errors.Join(errors.New("could not dial rpc socket"), err)
-	}
 
-	defer client.Close()
-	call := client.Go("IPC.TryBan", TryBanArgs{uuid, disconnect, temporary, broadcast}, new(Void), make(chan *rpc.Call, 1))
-	select {
-	case <-call.Done:
-		return call.Error
-	case <-time.After(config.ipc.deadline):
-		return errors.New("banPlayerInGameUnchecked: timed out")
-	}
+	// a retry after a timeout would announce the ban twice
+	return ipcCall(game, "IPC.TryBan", TryBanArgs{uuid, disconnect, temporary, broadcast}, !broadcast)
 }
 
 func mutePlayerInGameUnchecked(game, uuid string, temporary, broadcast bool) error {
 	if game == config.gameName {
 		return mutePlayerUnchecked(uuid, true, temporary, broadcast)
 	}
-	client, err := rpc.Dial("unix", fmt.Sprintf("/tmp/yno/%s.sck", game))
-	if err != nil {
-		return errors.Join(errors.New("could not dial rpc socket"), err)
+
+	return ipcCall(game, "IPC.TryMute", TryMuteArgs{uuid, temporary, broadcast}, !broadcast)
+}
+
+func shadowMutePlayerInGameUnchecked(game, uuid string, shadowMuted bool) error {
+	if game == config.gameName {
+		return shadowMutePlayerUnchecked(uuid, shadowMuted)
+	}
+
+	return ipcCall(game, "IPC.ShadowMute", ShadowMuteArgs{uuid, shadowMuted}, true)
+}
+
+func purgePlayerInGame(game, uuid string) error {
+	if game == config.gameName {
+		return purgePlayerUnchecked(uuid)
 	}
 
-	defer client.Close()
-	call := client.Go("IPC.TryMute", TryMuteArgs{uuid, temporary, broadcast}, new(Void), nil)
-	select {
-	case <-call.Done:
-		return call.Error
-	case <-time.After(config.ipc.deadline):
-		return errors.New("mutePlayerInGameUnchecked: timed out")
+	return ipcCall(game, "IPC.PurgePlayer", PurgePlayerArgs{uuid}, true)
+}
+
+// bans the player in every game at once; games that can't be reached pick the ban up from the database on reconnect
+func banPlayerInAllGamesUnchecked(uuid string, disconnect, temporary, broadcast bool) error {
+	return forEachGame(func(game string) error {
+		return banPlayerInGameUnchecked(game, uuid, disconnect, temporary, broadcast)
+	})
+}
+
+func mutePlayerInAllGamesUnchecked(uuid string, temporary, broadcast bool) error {
+	return forEachGame(func(game string) error {
+		return mutePlayerInGameUnchecked(game, uuid, temporary, broadcast)
+	})
+}
+
+func purgePlayerInAllGames(uuid string) error {
+	return forEachGame(func(game string) error {
+		return purgePlayerInGame(game, uuid)
+	})
+}
+
+// runs fn for every game concurrently and joins the errors, each prefixed with its game
+func forEachGame(fn func(game string) error) error {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var errs []error
+
+	for game := range gameIdToName {
+		wg.Add(1)
+		go func(game string) {
+			defer wg.Done()
+
+			if err := fn(game); err != nil {
+				mutex.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", game, err))
+				mutex.Unlock()
+			}
+		}(game)
 	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
 func sendReportLog(uuid, ynoMsgId, originalMsg string) error {
 	if isMainServer {
 		return sendReportLogMainServer(uuid, ynoMsgId, originalMsg, config.gameName)
 	}
-	client, err := rpc.Dial("unix", fmt.Sprintf("/tmp/yno/%s.sck", mainGameId))
-	if err != nil {
-		return errors.Join(errors.New("could not dial rpc socket"), err)
-	}
 
-	defer client.Close()
-	call := client.Go("IPC.SendReportLog", SendReportLogArgs{uuid, ynoMsgId, originalMsg, config.gameName}, new(Void), make(chan *rpc.Call, 1))
-	select {
-	case <-call.Done:
-		return call.Error
-	case <-time.After(config.ipc.deadline):
-		return errors.New("mutePlayerInGameUnchecked: timed out")
+	return ipcCall(mainGameId, "IPC.SendReportLog", SendReportLogArgs{uuid, ynoMsgId, originalMsg, config.gameName}, false)
+}
+
+func closeReportLog(targetUuid, content string) error {
+	if isMainServer {
+		return closeReportLogMainServer(targetUuid, content)
 	}
+
+	return ipcCall(mainGameId, "IPC.CloseReportLog", CloseReportLogArgs{targetUuid, content}, true)
 }
 
 func scheduleModActionReversal(uuid string, action int, expiry time.Time) error {
 	if isMainServer {
 		return scheduleModActionReversalMainServer(uuid, action, expiry, false)
 	}
-	client, err := rpc.Dial("unix", fmt.Sprintf("/tmp/yno/%s.sck", mainGameId))
+
+	return ipcCall(mainGameId, "IPC.ScheduleModActionReversal", ScheduleModActionReversalArgs{uuid, action, expiry}, false)
+}
+
+func notifyVmUpdated(gameId string) {
+	if !isMainServer {
+		return
+	}
+
+	if err := ipcCall(gameId, "IPC.UpdateEventVmInfo", Void{}, true); err != nil {
+		eprintf("VM", "error notifying %s: %s", gameId, err)
+	}
+}
+
+// one kept-alive connection per sibling server; rpc.Client multiplexes concurrent calls over it
+type IPCPool struct {
+	mutex   sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+var ipcPool = &IPCPool{
+	clients: make(map[string]*rpc.Client),
+}
+
+func (p *IPCPool) Get(game string) (*rpc.Client, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if client, ok := p.clients[game]; ok {
+		return client, nil
+	}
+
+	client, err := dialIpc(game)
 	if err != nil {
-		return errors.Join(errors.New("could not dial rpc socket"), err)
+		return nil, err
 	}
 
-	defer client.Close()
-	call := client.Go("IPC.ScheduleModActionReversal", ScheduleModActionReversalArgs{uuid, action, expiry}, new(Void), make(chan *rpc.Call, 1))
-	select {
-	case <-call.Done:
-		return call.Error
-	case <-time.After(config.ipc.deadline):
-		return errors.New("scheduleModActionReversal: timed out")
+	p.clients[game] = client
+
+	return client, nil
+}
+
+// closes and forgets the connection so the next call redials
+func (p *IPCPool) Drop(game string, client *rpc.Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.clients[game] == client {
+		delete(p.clients, game)
 	}
+
+	client.Close()
 }
 
-func notifyVmUpdated(gameId string) {
-	if !isMainServer {
+// calls method on a sibling server. idempotent calls are retried on a fresh connection,
+// the rest are attempted once since the peer may have acted on a call that timed out
+func ipcCall(game, method string, args any, idempotent bool) (err error) {
+	attempts := 1
+	if idempotent {
+		attempts += config.ipc.retries
+	}
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		var client *rpc.Client
+		client, err = ipcPool.Get(game)
+		if err != nil {
+			continue
+		}
+
+		call := client.Go(method, args, new(Void), make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-time.After(config.ipc.deadline):
+			err = fmt.Errorf("%s: timed out", method)
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		// errors returned by the method itself leave the connection usable
+		if _, ok := err.(rpc.ServerError); ok {
+			return err
+		}
+
+		ipcPool.Drop(game, client)
+	}
+
+	return err
+}
+
+func getIpcSocketPath(game string) string {
+	return filepath.Join(config.ipc.socketDir, game+".sck")
+}
+
+func getIpcHandshakeMac(nonce []byte, game string, version int) string {
+	mac := hmac.New(sha256.New, []byte(config.ipc.secret))
+	fmt.Fprintf(mac, "%x:%s:%d", nonce, game, version)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// the server opens with "YNOIPC <version> <nonce>", the client answers with "<version> <game> <mac>"
+// and the server confirms with "ok" before handing the connection over to net/rpc
+func dialIpc(game string) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("unix", getIpcSocketPath(game), config.ipc.deadline)
+	if err != nil {
+		return nil, errors.Join(errors.New("could not dial rpc socket"), err)
+	}
+
+	conn.SetDeadline(time.Now().Add(config.ipc.deadline))
+
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, errors.Join(errors.New("ipc handshake failed"), err)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "YNOIPC" {
+		conn.Close()
+		return nil, errors.New("ipc handshake failed: unexpected greeting")
+	}
+
+	if version, _ := strconv.Atoi(fields[1]); version != ipcProtocolVersion {
+		conn.Close()
+		return nil, fmt.Errorf("ipc handshake failed: %s speaks protocol version %s, expected %d", game, fields[1], ipcProtocolVersion)
+	}
+
+	nonce, err := hex.DecodeString(fields[2])
+	if err != nil {
+		conn.Close()
+		return nil, errors.Join(errors.New("ipc handshake failed"), err)
+	}
+
+	fmt.Fprintf(conn, "%d %s %s\n", ipcProtocolVersion, config.gameName, getIpcHandshakeMac(nonce, config.gameName, ipcProtocolVersion))
+
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, errors.Join(errors.New("ipc handshake failed"), err)
+	}
+
+	if line = strings.TrimSpace(line); line != "ok" {
+		conn.Close()
+		return nil, fmt.Errorf("ipc handshake rejected by %s: %s", game, line)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return rpc.NewClient(conn), nil
+}
+
+func acceptIpc(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(config.ipc.deadline))
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
 		return
 	}
 
-	client, err := rpc.Dial("unix", fmt.Sprintf("/tmp/yno/%s.sck", gameId))
+	fmt.Fprintf(conn, "YNOIPC %d %x\n", ipcProtocolVersion, nonce)
+
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
 	if err != nil {
-		eprintf("VM", "socket for %s not found", gameId)
+		conn.Close()
 		return
 	}
 
-	defer client.Close()
-	call := client.Go("IPC.UpdateEventVmInfo", Void{}, new(Void), make(chan *rpc.Call, 1))
-	select {
-	case <-call.Done:
-		if err := call.Error; err != nil {
-			eprintf("VM", "error notifying %s: %s", gameId, err)
-		}
-	case <-time.After(config.ipc.deadline):
-		eprintf("VM", "%s not responding to IPC", gameId)
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		fmt.Fprint(conn, "error malformed handshake\n")
+		conn.Close()
+		return
 	}
+
+	version, _ := strconv.Atoi(fields[0])
+	if version != ipcProtocolVersion {
+		fmt.Fprintf(conn, "error unsupported protocol version %s\n", fields[0])
+		conn.Close()
+		return
+	}
+
+	if !hmac.Equal([]byte(fields[2]), []byte(getIpcHandshakeMac(nonce, fields[1], version))) {
+		eprintf("IPC", "rejected connection claiming to be %s: bad secret", fields[1])
+		fmt.Fprint(conn, "error authentication failed\n")
+		conn.Close()
+		return
+	}
+
+	fmt.Fprint(conn, "ok\n")
+
+	conn.SetDeadline(time.Time{})
+
+	// the handshake is strictly request-response, so nothing is left buffered in the reader
+	rpc.ServeConn(conn)
 }
 
 func initRpc() {
-	var err error
-	socketPath := fmt.Sprintf("/tmp/yno/%s.sck", config.gameName)
+	// without a secret, any local process that can reach the socket directory could call sibling servers
+	if config.ipc.secret == "" {
+		log.Fatal("initRpc: ipc.secret must be set")
+	}
 
-	os.MkdirAll("/tmp/yno", 0777)
+	socketPath := getIpcSocketPath(config.gameName)
+
+	if err := os.MkdirAll(config.ipc.socketDir, 0770); err != nil {
+		log.Fatal("initRpc(mkdir):", err)
+	}
+	// MkdirAll leaves an existing directory as it was, which may be world-writable
+	if err := os.Chmod(config.ipc.socketDir, 0770); err != nil {
+		log.Fatal("initRpc(chmod):", err)
+	}
 	os.Remove(socketPath)
 
 	socket, err := net.Listen("unix", socketPath)
@@ -184,11 +525,23 @@ func initRpc() {
 		log.Fatal("initRpc(listen):", err)
 	}
 
-	if err := os.Chmod(socketPath, 0666); err != nil {
+	// sibling servers are expected to run as the same user or share a group
+	if err := os.Chmod(socketPath, 0660); err != nil {
 		log.Fatal("initRpc(chmod):", err)
 	}
 
 	ipc := new(IPC)
 	rpc.Register(ipc)
-	go rpc.Accept(socket)
+
+	go func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				log.Print("initRpc(accept):", err)
+				return
+			}
+
+			go acceptIpc(conn)
+		}
+	}()
 }
@@ -0,0 +1,276 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var loginThrottle = NewLoginThrottle(time.Now)
+
+type LoginThrottle struct {
+	entries map[string]*loginAttempts
+	mutex   sync.Mutex
+
+	// injectable so backoff and lockout timing can be driven by a fake clock
+	now func() time.Time
+}
+
+type loginAttempts struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	lockedUntil  time.Time
+}
+
+func NewLoginThrottle(now func() time.Time) *LoginThrottle {
+	return &LoginThrottle{
+		entries: make(map[string]*loginAttempts),
+		now:     now,
+	}
+}
+
+func getAccountLoginKey(user string) string {
+	return "user:" + strings.ToLower(user)
+}
+
+func getIpLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+// returns how long the caller has to wait before another attempt is allowed for any of the keys
+func (t *LoginThrottle) Check(keys ...string) (wait time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+
+	for _, key := range keys {
+		entry := t.load(key, now)
+		if entry == nil {
+			continue
+		}
+
+		for _, until := range []time.Time{entry.blockedUntil, entry.lockedUntil} {
+			if remaining := until.Sub(now); remaining > wait {
+				wait = remaining
+			}
+		}
+	}
+
+	return wait
+}
+
+// records a failed attempt for key; if lockable is set and the lockout threshold is reached,
+// the key is locked and the lockout expiry is returned
+func (t *LoginThrottle) Fail(key string, lockable bool) (locked bool, lockedUntil time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+
+	entry := t.load(key, now)
+	if entry == nil {
+		entry = &loginAttempts{}
+		t.entries[key] = entry
+	}
+
+	entry.failures++
+	entry.lastFailure = now
+
+	if excess := entry.failures - config.login.freeAttempts; excess > 0 {
+		entry.blockedUntil = now.Add(getLoginBackoff(excess))
+	}
+
+	if lockable && entry.failures >= config.login.lockoutThreshold && !now.Before(entry.lockedUntil) {
+		entry.lockedUntil = now.Add(config.login.lockoutDuration)
+		entry.failures = 0
+
+		return true, entry.lockedUntil
+	}
+
+	return false, time.Time{}
+}
+
+func (t *LoginThrottle) Reset(keys ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(t.entries, key)
+	}
+}
+
+func (t *LoginThrottle) State(key string) (failures int, lockedUntil time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry := t.load(key, t.now())
+	if entry == nil {
+		return 0, time.Time{}
+	}
+
+	return entry.failures, entry.lockedUntil
+}
+
+func (t *LoginThrottle) Prune() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+
+	for key := range t.entries {
+		t.load(key, now)
+	}
+}
+
+// must be called with the mutex held; drops the entry if it has gone stale
+func (t *LoginThrottle) load(key string, now time.Time) *loginAttempts {
+	entry, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if now.Sub(entry.lastFailure) > config.login.resetAfter && !now.Before(entry.lockedUntil) {
+		delete(t.entries, key)
+		return nil
+	}
+
+	return entry
+}
+
+func getLoginBackoff(excessFailures int) time.Duration {
+	backoff := float64(config.login.backoffBase) * math.Pow(2, float64(excessFailures-1))
+	if backoff > float64(config.login.backoffMax) {
+		return config.login.backoffMax
+	}
+
+	return time.Duration(backoff)
+}
+
+func initLogins() {
+	scheduler.Every(10).Minutes().Do(loginThrottle.Prune)
+}
+
+func checkLoginThrottle(w http.ResponseWriter, r *http.Request, user string) bool {
+	wait := loginThrottle.Check(getAccountLoginKey(user), getIpLoginKey(getIp(r)))
+
+	// lockouts set by sibling servers only show up in the database
+	storedWait, err := getStoredLoginLockout(user, getIp(r))
+	if err != nil {
+		writeErrLog(getIp(r), r.URL.Path, "failed to read login lockouts: "+err.Error())
+	}
+	wait = max(wait, storedWait)
+
+	if wait <= 0 {
+		return true
+	}
+
+	writeErrLog(getIp(r), r.URL.Path, "login throttled for "+user)
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "too many attempts", http.StatusTooManyRequests)
+
+	return false
+}
+
+func recordFailedLogin(user, ip string) {
+	loginThrottle.Fail(getIpLoginKey(ip), false)
+
+	locked, lockedUntil := loginThrottle.Fail(getAccountLoginKey(user), true)
+	if !locked {
+		return
+	}
+
+	uuid, err := getUuidFromName(user)
+	if err != nil || uuid == "" {
+		return
+	}
+
+	err = writeLoginLockout(uuid, ip, lockedUntil)
+	if err != nil {
+		eprintf("LOGIN", "failed to record lockout for %s: %s", uuid, err)
+	}
+}
+
+func resetLoginThrottle(user, ip string) {
+	loginThrottle.Reset(getAccountLoginKey(user), getIpLoginKey(ip))
+}
+
+func writeLoginLockout(uuid, ip string, expiry time.Time) error {
+	_, err := db.Exec("INSERT INTO playerLoginLockouts (uuid, ip, timestampLocked, expiry, notified) VALUES (?, ?, UTC_TIMESTAMP(), ?, 0)", uuid, ip, expiry.UTC())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// how long the account, or the address an account was locked from, remains locked according to any server
+func getStoredLoginLockout(user, ip string) (time.Duration, error) {
+	var remainingSeconds int
+	err := db.QueryRow("SELECT COALESCE(MAX(TIMESTAMPDIFF(SECOND, UTC_TIMESTAMP(), expiry)), 0) FROM playerLoginLockouts WHERE (uuid = (SELECT uuid FROM accounts WHERE user = ?) OR ip = ?) AND expiry > UTC_TIMESTAMP()", user, ip).Scan(&remainingSeconds)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(remainingSeconds) * time.Second, nil
+}
+
+func (c *SessionClient) sendLoginLockoutNotices() error {
+	results, err := db.Query("SELECT timestampLocked FROM playerLoginLockouts WHERE uuid = ? AND notified = 0 ORDER BY timestampLocked", c.uuid)
+	if err != nil {
+		return err
+	}
+
+	var notices []string
+
+	for results.Next() {
+		var timestampLocked time.Time
+		err := results.Scan(&timestampLocked)
+		if err != nil {
+			results.Close()
+			return err
+		}
+
+		notices = append(notices, fmt.Sprintf("Your account was temporarily locked on %s after too many failed login attempts. If this wasn't you, please change your password.", timestampLocked.UTC().Format("2006-01-02 15:04 MST")))
+	}
+
+	results.Close()
+
+	if len(notices) == 0 {
+		return nil
+	}
+
+	for _, notice := range notices {
+		systemMessage(notice, c.uuid)
+	}
+
+	_, err = db.Exec("UPDATE playerLoginLockouts SET notified = 1 WHERE uuid = ? AND notified = 0", c.uuid)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
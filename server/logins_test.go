@@ -0,0 +1,162 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func setTestLoginConfig(t *testing.T) {
+	t.Helper()
+
+	prev := config
+	t.Cleanup(func() { config = prev })
+
+	config = &Config{}
+
+	config.login.freeAttempts = 2
+	config.login.backoffBase = time.Second
+	config.login.backoffMax = 8 * time.Second
+	config.login.lockoutThreshold = 5
+	config.login.lockoutDuration = 30 * time.Minute
+	config.login.resetAfter = time.Hour
+}
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	setTestLoginConfig(t)
+
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	throttle := NewLoginThrottle(clock.Now)
+
+	// free attempts, then a doubling backoff
+	expected := []time.Duration{0, 0, time.Second, 2 * time.Second}
+	for i, want := range expected {
+		if locked, _ := throttle.Fail("ip:1", false); locked {
+			t.Fatalf("failure %d: unlockable key was locked", i+1)
+		}
+		if wait := throttle.Check("ip:1"); wait != want {
+			t.Fatalf("failure %d: wait = %s, want %s", i+1, wait, want)
+		}
+	}
+
+	// the backoff is capped
+	for range 10 {
+		throttle.Fail("ip:1", false)
+	}
+	if wait := throttle.Check("ip:1"); wait != config.login.backoffMax {
+		t.Fatalf("capped wait = %s, want %s", wait, config.login.backoffMax)
+	}
+
+	// waiting it out lets the next attempt through
+	clock.Advance(config.login.backoffMax)
+	if wait := throttle.Check("ip:1"); wait != 0 {
+		t.Fatalf("wait after backoff = %s, want 0", wait)
+	}
+
+	// the longest wait of all keys applies
+	if wait := throttle.Check("user:nobody", "ip:1"); wait != 0 {
+		t.Fatalf("wait for unknown key = %s, want 0", wait)
+	}
+}
+
+func TestLoginThrottleLockout(t *testing.T) {
+	setTestLoginConfig(t)
+
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	throttle := NewLoginThrottle(clock.Now)
+
+	for i := 1; i < config.login.lockoutThreshold; i++ {
+		if locked, _ := throttle.Fail("user:a", true); locked {
+			t.Fatalf("locked after %d failures, threshold is %d", i, config.login.lockoutThreshold)
+		}
+		clock.Advance(10 * time.Second)
+	}
+
+	locked, lockedUntil := throttle.Fail("user:a", true)
+	if !locked {
+		t.Fatal("not locked at the threshold")
+	}
+	if want := clock.now.Add(config.login.lockoutDuration); !lockedUntil.Equal(want) {
+		t.Fatalf("lockedUntil = %s, want %s", lockedUntil, want)
+	}
+
+	if wait := throttle.Check("user:a"); wait != config.login.lockoutDuration {
+		t.Fatalf("wait while locked = %s, want %s", wait, config.login.lockoutDuration)
+	}
+	if failures, stateLockedUntil := throttle.State("user:a"); failures != 0 || !stateLockedUntil.Equal(lockedUntil) {
+		t.Fatalf("State = (%d, %s), want (0, %s)", failures, stateLockedUntil, lockedUntil)
+	}
+
+	// the lockout outlives resetAfter
+	clock.Advance(config.login.lockoutDuration - time.Second)
+	throttle.Prune()
+	if wait := throttle.Check("user:a"); wait != time.Second {
+		t.Fatalf("wait just before expiry = %s, want 1s", wait)
+	}
+
+	clock.Advance(time.Second)
+	if wait := throttle.Check("user:a"); wait != 0 {
+		t.Fatalf("wait after expiry = %s, want 0", wait)
+	}
+
+	// the entry is dropped once the lockout is over and the failures are stale
+	clock.Advance(config.login.resetAfter)
+	throttle.Prune()
+	if failures, stateLockedUntil := throttle.State("user:a"); failures != 0 || !stateLockedUntil.IsZero() {
+		t.Fatalf("State after expiry = (%d, %s), want cleared", failures, stateLockedUntil)
+	}
+}
+
+func TestLoginThrottleReset(t *testing.T) {
+	setTestLoginConfig(t)
+
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	throttle := NewLoginThrottle(clock.Now)
+
+	for range 3 {
+		throttle.Fail("user:a", true)
+	}
+
+	// failures are forgotten after resetAfter without another one
+	clock.Advance(config.login.resetAfter + time.Second)
+	if failures, _ := throttle.State("user:a"); failures != 0 {
+		t.Fatalf("failures after resetAfter = %d, want 0", failures)
+	}
+
+	for range 3 {
+		throttle.Fail("user:a", true)
+	}
+
+	throttle.Reset("user:a")
+	if wait := throttle.Check("user:a"); wait != 0 {
+		t.Fatalf("wait after Reset = %s, want 0", wait)
+	}
+}
@@ -87,6 +87,12 @@ func handleRegisterSubscriber(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// a push endpoint belongs to one browser, whichever uuid registers it
+	err = recordIdentitySignal(uuid, identitySignalPush, sub.Endpoint)
+	if err != nil {
+		writeErrLog(uuid, r.URL.Path, err.Error())
+	}
+
 	err = sendPushNotification(&Notification{
 		Title: "YNOproject",
 		Body:  "This is how you will be notified of upcoming events.",
@@ -22,20 +22,56 @@ import (
 	"encoding/json"
 	"errors"
 	"slices"
+	"sync"
+	"time"
 )
 
+const (
+	partyRoleOwner   = "owner"
+	partyRoleOfficer = "officer"
+	partyRoleMember  = "member"
+)
+
+// who may change the party theme besides the owner
+const (
+	partyThemePolicyOwner    = "owner"
+	partyThemePolicyOfficers = "officers"
+	partyThemePolicyMembers  = "members"
+)
+
+// number of role changes kept in the party payload
+const partyRoleChangeHistory = 20
+
 type Party struct {
-	Id          int                   `json:"id"`
-	Name        string                `json:"name"`
-	Public      bool                  `json:"public"`
-	Pass        string                `json:"-"`
-	SystemName  string                `json:"systemName"`
-	Description string                `json:"description"`
-	OwnerUuid   string                `json:"ownerUuid"`
-	Members     []*PlayerListFullData `json:"members"`
+	Id                int                   `json:"id"`
+	Name              string                `json:"name"`
+	Public            bool                  `json:"public"`
+	CrossGame         bool                  `json:"crossGame"` // members can be playing any game
+	Pass              string                `json:"-"`
+	SystemName        string                `json:"systemName"`
+	ThemePolicy       string                `json:"themePolicy"`
+	Description       string                `json:"description"`
+	PinnedMsgId       string                `json:"pinnedMsgId,omitempty"`
+	ChatRetentionDays int                   `json:"chatRetentionDays"`
+	OwnerUuid         string                `json:"ownerUuid"`
+	Officers          []string              `json:"officers"`
+	Members           []*PlayerListFullData `json:"members"`
+	RoleChanges       []*PartyRoleChange    `json:"roleChanges"`
+}
+
+type PartyRoleChange struct {
+	Uuid      string    `json:"uuid"`
+	ActorUuid string    `json:"actorUuid,omitempty"` // empty when the server assigned the role
+	Role      string    `json:"role"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
-var parties = make(map[int]*Party)
+var (
+	parties = make(map[int]*Party)
+	// held by every entry point (HTTP, session, IPC, scheduler) that reads or changes
+	// the party cache or a client's partyId; party functions assume it's held
+	partiesMutex sync.Mutex
+)
 
 func sendPartyUpdate() {
 	parties, err := getAllPartyData()
@@ -44,16 +80,274 @@ func sendPartyUpdate() {
 	}
 
 	for _, party := range parties { // for every party
-		partyDataJson, err := json.Marshal(party)
+		sendPartyDataToMembers(party)
+	}
+}
+
+// pushes the full party to its online members, for after membership or settings change
+func sendPartyUpdateToMembers(partyId int) {
+	if party, ok := parties[partyId]; ok && party.CrossGame {
+		relayPartyUpdate(partyId)
+	}
+
+	sendLocalPartyUpdateToMembers(partyId)
+}
+
+func sendLocalPartyUpdateToMembers(partyId int) {
+	party, err := getPartyData(partyId)
+	if err != nil {
+		return
+	}
+
+	sendPartyDataToMembers(party)
+}
+
+// has sibling servers reload a cross-game party after it changed here
+func relayPartyUpdate(partyId int) {
+	go forEachGame(func(game string) error {
+		if game == config.gameName {
+			return nil
+		}
+
+		return ipcCall(game, "IPC.RefreshParty", partyId, true)
+	})
+}
+
+// reloads a cross-game party changed on another server and brings local members up to date
+func refreshParty(partyId int) error {
+	party, err := getPartyDataFromDatabaseById(partyId)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	memberUuids := make(map[string]bool)
+	if err == nil {
+		for _, member := range party.Members {
+			memberUuids[member.Uuid] = true
+		}
+	}
+
+	var hasLocalMember bool
+
+	for _, client := range clients.Get() {
+		if memberUuids[client.uuid] {
+			hasLocalMember = true
+			client.partyId = partyId
+		} else if client.partyId == partyId {
+			// kicked, left from another game, or the party was disbanded
+			client.partyId = 0
+			client.trySend(buildMsg("pt", "null"))
+		}
+	}
+
+	if !hasLocalMember {
+		delete(parties, partyId)
+		clearPartyMarkers(partyId)
+		return nil
+	}
+
+	parties[partyId] = &party
+
+	sendLocalPartyUpdateToMembers(partyId)
+
+	return nil
+}
+
+// removes the player from parties created in this game, handing ownership on or disbanding them;
+// each server takes care of its own, so cross-game parties are only left once
+func leaveHostedParties(uuid string) error {
+	results, err := db.Query("SELECT pm.partyId FROM partyMembers pm JOIN parties p ON p.id = pm.partyId WHERE pm.uuid = ? AND p.game = ?", uuid, config.gameName)
+	if err != nil {
+		return err
+	}
+
+	var partyIds []int
+
+	for results.Next() {
+		var partyId int
+
+		err := results.Scan(&partyId)
+		if err != nil {
+			results.Close()
+			return err
+		}
+
+		partyIds = append(partyIds, partyId)
+	}
+
+	results.Close()
+
+	for _, partyId := range partyIds {
+		err := ensurePartyCached(partyId)
+		if err != nil {
+			return err
+		}
+
+		err = handlePartyMemberLeave(partyId, uuid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// takes the player out of parties held in other games, so they can be in a cross-game party instead.
+// done in the database so it also covers games whose server isn't running; running ones are told to reload
+func leaveOtherGameParties(uuid string) error {
+	results, err := db.Query("SELECT p.id, p.game FROM partyMembers pm JOIN parties p ON p.id = pm.partyId WHERE pm.uuid = ? AND p.game <> ? AND p.crossGame = 0", uuid, config.gameName)
+	if err != nil {
+		return err
+	}
+
+	partyGames := make(map[int]string)
+
+	for results.Next() {
+		var partyId int
+		var game string
+
+		err := results.Scan(&partyId, &game)
+		if err != nil {
+			results.Close()
+			return err
+		}
+
+		partyGames[partyId] = game
+	}
+
+	results.Close()
+
+	for partyId, game := range partyGames {
+		_, err := db.Exec("DELETE FROM partyMembers WHERE partyId = ? AND uuid = ?", partyId, uuid)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec("UPDATE playerGameData SET lastPartyMsgId = NULL WHERE uuid = ? AND game = ?", uuid, game)
+		if err != nil {
+			return err
+		}
+
+		var memberCount int
+		err = db.QueryRow("SELECT COUNT(*) FROM partyMembers WHERE partyId = ?", partyId).Scan(&memberCount)
+		if err != nil {
+			return err
+		}
+
+		if memberCount == 0 {
+			err = deletePartyAndMembers(partyId)
+		} else {
+			_, err = db.Exec("UPDATE parties p SET p.owner = (SELECT pm.uuid FROM partyMembers pm JOIN players pd ON pd.uuid = pm.uuid WHERE pm.partyId = p.id ORDER BY pm.role = ? DESC, pd.rank DESC, pm.id LIMIT 1) WHERE p.id = ? AND p.owner = ?", partyRoleOfficer, partyId, uuid)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		for partyId, game := range partyGames {
+			err := ipcCall(game, "IPC.RefreshParty", partyId, true)
+			if err != nil {
+				eprintf("party", "failed to refresh party %d on %s: %s", partyId, game, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func relayPartyChatMessage(partyId int, uuid, contents, msgId string) {
+	go func() {
+		err := forEachGame(func(game string) error {
+			if game == config.gameName {
+				return nil
+			}
+
+			return ipcCall(game, "IPC.RelayPartyChat", PartyChatArgs{partyId, uuid, contents, msgId}, false)
+		})
 		if err != nil {
+			eprintf("party", "failed to relay chat message for party %d: %s", partyId, err)
+		}
+	}()
+}
+
+// passes an edit or removal of a cross-game party message on to sibling servers; empty contents mean removal
+func relayPartyChatUpdate(partyId int, msgId, contents string) {
+	if partyId == 0 {
+		return
+	}
+
+	go func() {
+		var crossGame bool
+		err := db.QueryRow("SELECT crossGame FROM parties WHERE id = ?", partyId).Scan(&crossGame)
+		if err != nil || !crossGame {
+			return
+		}
+
+		err = forEachGame(func(game string) error {
+			if game == config.gameName {
+				return nil
+			}
+
+			return ipcCall(game, "IPC.RelayPartyChatUpdate", PartyChatUpdateArgs{partyId, msgId, contents}, true)
+		})
+		if err != nil {
+			eprintf("party", "failed to relay chat update for party %d: %s", partyId, err)
+		}
+	}()
+}
+
+func receivePartyChatUpdate(args *PartyChatUpdateArgs) {
+	msg := buildMsg("gedit", args.MsgId, args.Contents)
+	if args.Contents == "" {
+		msg = buildMsg("gdel", args.MsgId)
+	}
+
+	sendChatMessageUpdate(args.PartyId, msg)
+}
+
+func receivePartyChatMessage(args *PartyChatArgs) error {
+	if banned, muted := getPlayerModerationStatus(args.Uuid); banned || muted {
+		return nil
+	}
+
+	filtered := wordFilter.Filter(args.Contents)
+	if filtered.Blocked {
+		return nil
+	}
+
+	blockedUuids, err := getPlayerBlockedUuids(args.Uuid)
+	if err != nil {
+		return err
+	}
+
+	msg := buildMsg("psay", args.Uuid, filtered.Contents, args.MsgId)
+
+	for _, client := range clients.Get() {
+		if client.partyId != args.PartyId {
+			continue
+		}
+
+		if blockedUuids[client.uuid] || client.blockedUsers[args.Uuid] {
 			continue
 		}
 
-		for _, member := range party.Members { // for every member
-			if member.Online {
-				if client, ok := clients.Load(member.Uuid); ok {
-					client.outbox <- buildMsg("pt", partyDataJson) // send JSON to client
-				}
+		client.trySend(msg)
+	}
+
+	return nil
+}
+
+func sendPartyDataToMembers(party *Party) {
+	partyDataJson, err := json.Marshal(party)
+	if err != nil {
+		return
+	}
+
+	for _, member := range party.Members { // for every member
+		if member.Online {
+			if client, ok := clients.Load(member.Uuid); ok {
+				client.trySend(buildMsg("pt", partyDataJson)) // send JSON to client
 			}
 		}
 	}
@@ -78,11 +372,38 @@ func (c *SessionClient) cacheParty() error {
 
 	parties[party.Id] = &party
 
+	if party.CrossGame {
+		// other servers look up this member's name and sprite from the game they're playing
+		_, err = db.Exec("UPDATE partyMembers SET game = ? WHERE partyId = ? AND uuid = ?", config.gameName, party.Id, c.uuid)
+		if err != nil {
+			return err
+		}
+
+		relayPartyUpdate(party.Id)
+	}
+
+	return nil
+}
+
+// loads the party into the cache if it can be joined from this game
+func ensurePartyCached(partyId int) error {
+	if _, ok := parties[partyId]; ok {
+		return nil
+	}
+
+	party, err := getPartyDataFromDatabaseById(partyId)
+	if err != nil {
+		return err
+	}
+
+	parties[partyId] = &party
+
 	return nil
 }
 
+// a player is in either one cross-game party or at most one party per game
 func getPlayerPartyId(uuid string) (partyId int, err error) {
-	err = db.QueryRow("SELECT pm.partyId FROM partyMembers pm JOIN parties p ON p.id = pm.partyId WHERE pm.uuid = ? AND p.game = ?", uuid, config.gameName).Scan(&partyId)
+	err = db.QueryRow("SELECT pm.partyId FROM partyMembers pm JOIN parties p ON p.id = pm.partyId WHERE pm.uuid = ? AND (p.game = ? OR p.crossGame = 1) ORDER BY p.crossGame LIMIT 1", uuid, config.gameName).Scan(&partyId)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return 0, nil
@@ -104,7 +425,20 @@ func getPartyData(partyId int) (*Party, error) {
 	for _, member := range party.Members {
 		client, ok := clients.Load(member.Uuid)
 		if !ok {
-			member.Online = false
+			// still shown as online while playing another game, but only cross-game parties get a location from it
+			event, online := remotePresence.Get(member.Uuid)
+			member.Online = online
+
+			if online && party.CrossGame {
+				member.Game = event.Game
+				member.MapId = event.MapId
+				member.PrevMapId = event.PrevMapId
+				member.PrevLocations = event.PrevLocations
+				member.X = event.X
+				member.Y = event.Y
+
+				continue
+			}
 
 			member.MapId = "0000"
 			member.PrevMapId = "0000"
@@ -117,6 +451,10 @@ func getPartyData(partyId int) (*Party, error) {
 
 		hasOnlineMember = true
 
+		if party.CrossGame {
+			member.Game = config.gameName
+		}
+
 		if client.name != "" {
 			member.Name = client.name
 		}
@@ -172,8 +510,40 @@ func getAllPartyData() ([]*Party, error) {
 	return partyData, nil
 }
 
+// the party list is public, so it leaves out what only members should see
+func getPublicPartyData() ([]*Party, error) {
+	partyData, err := getAllPartyData()
+	if err != nil {
+		return nil, err
+	}
+
+	publicPartyData := make([]*Party, 0, len(partyData))
+	for _, party := range partyData {
+		publicParty := *party
+		publicParty.Officers = nil
+		publicParty.RoleChanges = nil
+
+		publicPartyData = append(publicPartyData, &publicParty)
+	}
+
+	return publicPartyData, nil
+}
+
 func getPartyDataFromDatabase(playerUuid string) (party Party, err error) {
-	err = db.QueryRow("SELECT p.id, p.owner, p.name, p.public, p.pass, p.theme, p.description FROM parties p JOIN partyMembers pm ON pm.partyId = p.id JOIN playerGameData pgd ON pgd.uuid = pm.uuid AND pgd.game = p.game WHERE p.game = ? AND pm.uuid = ?", config.gameName, playerUuid).Scan(&party.Id, &party.OwnerUuid, &party.Name, &party.Public, &party.Pass, &party.SystemName, &party.Description)
+	partyId, err := getPlayerPartyId(playerUuid)
+	if err != nil {
+		return party, err
+	}
+
+	if partyId == 0 {
+		return party, sql.ErrNoRows
+	}
+
+	return getPartyDataFromDatabaseById(partyId)
+}
+
+func getPartyDataFromDatabaseById(partyId int) (party Party, err error) {
+	err = db.QueryRow("SELECT p.id, p.owner, p.name, p.public, p.crossGame, p.pass, p.theme, p.themePolicy, p.description, COALESCE(p.pinnedMsgId, ''), COALESCE(p.chatRetentionDays, ?) FROM parties p WHERE p.id = ? AND (p.game = ? OR p.crossGame = 1)", config.party.chatRetentionDays, partyId, config.gameName).Scan(&party.Id, &party.OwnerUuid, &party.Name, &party.Public, &party.CrossGame, &party.Pass, &party.SystemName, &party.ThemePolicy, &party.Description, &party.PinnedMsgId, &party.ChatRetentionDays)
 	if err != nil {
 		return party, err
 	}
@@ -185,11 +555,69 @@ func getPartyDataFromDatabase(playerUuid string) (party Party, err error) {
 
 	party.Members = partyMembers
 
+	party.Officers, err = getPartyOfficersFromDatabase(party.Id)
+	if err != nil {
+		return party, err
+	}
+
+	party.RoleChanges, err = getPartyRoleChangesFromDatabase(party.Id)
+	if err != nil {
+		return party, err
+	}
+
 	return party, nil
 }
 
+func getPartyOfficersFromDatabase(partyId int) (officers []string, err error) {
+	results, err := db.Query("SELECT uuid FROM partyMembers WHERE partyId = ? AND role = ? ORDER BY id", partyId, partyRoleOfficer)
+	if err != nil {
+		return nil, err
+	}
+
+	defer results.Close()
+
+	officers = []string{}
+
+	for results.Next() {
+		var uuid string
+
+		err := results.Scan(&uuid)
+		if err != nil {
+			return nil, err
+		}
+
+		officers = append(officers, uuid)
+	}
+
+	return officers, nil
+}
+
+func getPartyRoleChangesFromDatabase(partyId int) (roleChanges []*PartyRoleChange, err error) {
+	results, err := db.Query("SELECT uuid, COALESCE(actorUuid, ''), role, timestamp FROM partyRoleChanges WHERE partyId = ? ORDER BY id DESC LIMIT ?", partyId, partyRoleChangeHistory)
+	if err != nil {
+		return nil, err
+	}
+
+	defer results.Close()
+
+	roleChanges = []*PartyRoleChange{}
+
+	for results.Next() {
+		roleChange := &PartyRoleChange{}
+
+		err := results.Scan(&roleChange.Uuid, &roleChange.ActorUuid, &roleChange.Role, &roleChange.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		roleChanges = append(roleChanges, roleChange)
+	}
+
+	return roleChanges, nil
+}
+
 func getPartyMemberDataFromDatabase(partyId int) (partyMembers []*PlayerListFullData, err error) {
-	results, err := db.Query("SELECT pm.partyId, pm.uuid, COALESCE(a.user, pgd.name), pd.rank, CASE WHEN a.user IS NULL THEN 0 ELSE 1 END, COALESCE(a.badge, ''), pgd.timestampLastActive, pgd.systemName, pgd.spriteName, pgd.spriteIndex, pgd.medalCountBronze, pgd.medalCountSilver, pgd.medalCountGold, pgd.medalCountPlatinum, pgd.medalCountDiamond FROM partyMembers pm JOIN playerGameData pgd ON pgd.uuid = pm.uuid JOIN players pd ON pd.uuid = pgd.uuid JOIN parties p ON p.id = pm.partyId LEFT JOIN accounts a ON a.uuid = pd.uuid WHERE pm.partyId = ? AND pgd.game = ? ORDER BY CASE WHEN p.owner = pm.uuid THEN 0 ELSE 1 END, pd.rank DESC, pm.id", partyId, config.gameName)
+	results, err := db.Query("SELECT pm.partyId, pm.uuid, COALESCE(a.user, pgd.name), pd.rank, CASE WHEN a.user IS NULL THEN 0 ELSE 1 END, COALESCE(a.badge, ''), pgd.timestampLastActive, pgd.systemName, pgd.spriteName, pgd.spriteIndex, pgd.medalCountBronze, pgd.medalCountSilver, pgd.medalCountGold, pgd.medalCountPlatinum, pgd.medalCountDiamond, CASE WHEN p.crossGame = 1 THEN pgd.game ELSE '' END FROM partyMembers pm JOIN playerGameData pgd ON pgd.uuid = pm.uuid JOIN players pd ON pd.uuid = pgd.uuid JOIN parties p ON p.id = pm.partyId LEFT JOIN accounts a ON a.uuid = pd.uuid WHERE pm.partyId = ? AND pgd.game = CASE WHEN p.crossGame = 1 THEN COALESCE(pm.game, p.game) ELSE ? END ORDER BY CASE WHEN p.owner = pm.uuid THEN 0 ELSE 1 END, pd.rank DESC, pm.id", partyId, config.gameName)
 	if err != nil {
 		return partyMembers, err
 	}
@@ -205,7 +633,7 @@ func getPartyMemberDataFromDatabase(partyId int) (partyMembers []*PlayerListFull
 			PrevMapId: "0000",
 		}
 
-		err := results.Scan(&partyId, &partyMember.Uuid, &partyMember.Name, &partyMember.Rank, &accountBin, &partyMember.Badge, &partyMember.LastActive, &partyMember.SystemName, &partyMember.SpriteName, &partyMember.SpriteIndex, &partyMember.Medals[0], &partyMember.Medals[1], &partyMember.Medals[2], &partyMember.Medals[3], &partyMember.Medals[4])
+		err := results.Scan(&partyId, &partyMember.Uuid, &partyMember.Name, &partyMember.Rank, &accountBin, &partyMember.Badge, &partyMember.LastActive, &partyMember.SystemName, &partyMember.SpriteName, &partyMember.SpriteIndex, &partyMember.Medals[0], &partyMember.Medals[1], &partyMember.Medals[2], &partyMember.Medals[3], &partyMember.Medals[4], &partyMember.Game)
 		if err != nil {
 			return partyMembers, err
 		}
@@ -219,8 +647,8 @@ func getPartyMemberDataFromDatabase(partyId int) (partyMembers []*PlayerListFull
 	return partyMembers, nil
 }
 
-func createPartyData(name string, public bool, pass string, theme string, description string, playerUuid string) (partyId int, err error) {
-	results, err := db.Exec("INSERT INTO parties (game, owner, name, public, pass, theme, description) VALUES (?, ?, ?, ?, ?, ?, ?)", config.gameName, playerUuid, name, public, pass, theme, description)
+func createPartyData(name string, public bool, crossGame bool, pass string, theme string, themePolicy string, description string, playerUuid string) (partyId int, err error) {
+	results, err := db.Exec("INSERT INTO parties (game, owner, name, public, crossGame, pass, theme, themePolicy, description) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", config.gameName, playerUuid, name, public, crossGame, pass, theme, themePolicy, description)
 	if err != nil {
 		return 0, err
 	}
@@ -237,8 +665,8 @@ func createPartyData(name string, public bool, pass string, theme string, descri
 	return partyId, nil
 }
 
-func updatePartyData(partyId int, name string, public bool, pass string, theme string, description string, playerUuid string) error {
-	_, err := db.Exec("UPDATE parties SET game = ?, owner = ?, name = ?, public = ?, pass = ?, theme = ?, description = ? WHERE id = ?", config.gameName, playerUuid, name, public, pass, theme, description, partyId)
+func updatePartyData(partyId int, name string, public bool, pass string, theme string, themePolicy string, description string, playerUuid string) error {
+	_, err := db.Exec("UPDATE parties SET game = ?, owner = ?, name = ?, public = ?, pass = ?, theme = ?, themePolicy = ?, description = ? WHERE id = ?", config.gameName, playerUuid, name, public, pass, theme, themePolicy, description, partyId)
 	if err != nil {
 		return err
 	}
@@ -253,17 +681,224 @@ func updatePartyData(partyId int, name string, public bool, pass string, theme s
 	party.Public = public
 	party.Pass = pass
 	party.SystemName = theme
+	party.ThemePolicy = themePolicy
+	party.Description = description
+
+	sendPartyUpdateToMembers(partyId)
+
+	return nil
+}
+
+func getPartyRole(partyId int, uuid string) string {
+	party, ok := parties[partyId]
+	if !ok {
+		return ""
+	}
+
+	if party.OwnerUuid == uuid {
+		return partyRoleOwner
+	}
+
+	if slices.Contains(party.Officers, uuid) {
+		return partyRoleOfficer
+	}
+
+	for _, member := range party.Members {
+		if member.Uuid == uuid {
+			return partyRoleMember
+		}
+	}
+
+	return ""
+}
+
+// the owner counts as an officer
+func isPartyOfficer(partyId int, uuid string) bool {
+	role := getPartyRole(partyId, uuid)
+	return role == partyRoleOwner || role == partyRoleOfficer
+}
+
+func isValidPartyThemePolicy(themePolicy string) bool {
+	switch themePolicy {
+	case partyThemePolicyOwner, partyThemePolicyOfficers, partyThemePolicyMembers:
+		return true
+	}
+	return false
+}
+
+func canChangePartyTheme(partyId int, uuid string) bool {
+	party, ok := parties[partyId]
+	if !ok {
+		return false
+	}
+
+	switch getPartyRole(partyId, uuid) {
+	case partyRoleOwner:
+		return true
+	case partyRoleOfficer:
+		return party.ThemePolicy == partyThemePolicyOfficers || party.ThemePolicy == partyThemePolicyMembers
+	case partyRoleMember:
+		return party.ThemePolicy == partyThemePolicyMembers
+	}
+
+	return false
+}
+
+func setPartyTheme(partyId int, theme string) error {
+	_, err := db.Exec("UPDATE parties SET theme = ? WHERE id = ?", theme, partyId)
+	if err != nil {
+		return err
+	}
+
+	party, ok := parties[partyId]
+	if !ok {
+		return errors.New("party id not in cache")
+	}
+
+	party.SystemName = theme
+
+	sendPartyUpdateToMembers(partyId)
+
+	return nil
+}
+
+func setPartyDescription(partyId int, description string) error {
+	_, err := db.Exec("UPDATE parties SET description = ? WHERE id = ?", description, partyId)
+	if err != nil {
+		return err
+	}
+
+	party, ok := parties[partyId]
+	if !ok {
+		return errors.New("party id not in cache")
+	}
+
 	party.Description = description
 
+	sendPartyUpdateToMembers(partyId)
+
+	return nil
+}
+
+func setPartyChatRetention(partyId int, days int) error {
+	_, err := db.Exec("UPDATE parties SET chatRetentionDays = ? WHERE id = ?", days, partyId)
+	if err != nil {
+		return err
+	}
+
+	party, ok := parties[partyId]
+	if !ok {
+		return errors.New("party id not in cache")
+	}
+
+	party.ChatRetentionDays = days
+
+	sendPartyUpdateToMembers(partyId)
+
+	return nil
+}
+
+// leave msgId empty to unpin
+func setPartyPinnedMessage(partyId int, msgId string) error {
+	var pinnedMsgId sql.NullString
+	if msgId != "" {
+		pinnedMsgId = sql.NullString{String: msgId, Valid: true}
+	}
+
+	_, err := db.Exec("UPDATE parties SET pinnedMsgId = ? WHERE id = ?", pinnedMsgId, partyId)
+	if err != nil {
+		return err
+	}
+
+	party, ok := parties[partyId]
+	if !ok {
+		return errors.New("party id not in cache")
+	}
+
+	party.PinnedMsgId = msgId
+
+	sendPartyUpdateToMembers(partyId)
+
+	return nil
+}
+
+// sets a member's role to officer or member; ownership changes go through setPartyOwner
+func setPartyMemberRole(partyId int, uuid string, role string, actorUuid string) error {
+	_, err := db.Exec("UPDATE partyMembers SET role = ? WHERE partyId = ? AND uuid = ?", role, partyId, uuid)
+	if err != nil {
+		return err
+	}
+
+	party, ok := parties[partyId]
+	if !ok {
+		return errors.New("party id not in cache")
+	}
+
+	party.Officers = slices.DeleteFunc(party.Officers, func(officerUuid string) bool {
+		return officerUuid == uuid
+	})
+	if role == partyRoleOfficer {
+		party.Officers = append(party.Officers, uuid)
+	}
+
+	err = writePartyRoleChange(partyId, uuid, role, actorUuid)
+	if err != nil {
+		return err
+	}
+
+	sendPartyUpdateToMembers(partyId)
+
+	return nil
+}
+
+func writePartyRoleChange(partyId int, uuid string, role string, actorUuid string) error {
+	var actor sql.NullString
+	if actorUuid != "" {
+		actor = sql.NullString{String: actorUuid, Valid: true}
+	}
+
+	_, err := db.Exec("INSERT INTO partyRoleChanges (partyId, uuid, actorUuid, role, timestamp) VALUES (?, ?, ?, ?, UTC_TIMESTAMP())", partyId, uuid, actor, role)
+	if err != nil {
+		return err
+	}
+
+	if party, ok := parties[partyId]; ok {
+		roleChange := &PartyRoleChange{
+			Uuid:      uuid,
+			ActorUuid: actorUuid,
+			Role:      role,
+			Timestamp: time.Now().UTC(),
+		}
+
+		party.RoleChanges = append([]*PartyRoleChange{roleChange}, party.RoleChanges...)
+		if len(party.RoleChanges) > partyRoleChangeHistory {
+			party.RoleChanges = party.RoleChanges[:partyRoleChangeHistory]
+		}
+	}
+
 	return nil
 }
 
 func joinPlayerParty(partyId int, playerUuid string) error {
-	_, err := db.Exec("INSERT INTO partyMembers (partyId, uuid) VALUES (?, ?)", partyId, playerUuid)
+	_, err := db.Exec("INSERT INTO partyMembers (partyId, uuid, game) VALUES (?, ?, ?)", partyId, playerUuid, config.gameName)
 	if err != nil {
 		return err
 	}
 
+	var crossGame bool
+	err = db.QueryRow("SELECT crossGame FROM parties WHERE id = ?", partyId).Scan(&crossGame)
+	if err != nil {
+		return err
+	}
+
+	if crossGame {
+		// parties held in other games are given up for the cross-game one
+		err = leaveOtherGameParties(playerUuid)
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = db.Exec("UPDATE playerGameData pgd SET pgd.lastPartyMsgId = (SELECT cm.msgId FROM chatMessages cm WHERE cm.game = pgd.game AND cm.partyId = ? AND cm.timestamp = (SELECT MAX(timestamp) FROM chatMessages WHERE game = cm.game AND partyId = cm.partyId) LIMIT 1) WHERE pgd.uuid = ? AND pgd.game = ?", partyId, playerUuid, config.gameName)
 	if err != nil {
 		return err
@@ -271,7 +906,7 @@ func joinPlayerParty(partyId int, playerUuid string) error {
 
 	party, ok := parties[partyId]
 	if !ok {
-		// this only happens when someone creates a party
+		// this only happens when someone creates a party, or joins a cross-game party from a new game
 		party, err := getPartyDataFromDatabase(playerUuid)
 		if err != nil {
 			return err
@@ -279,12 +914,26 @@ func joinPlayerParty(partyId int, playerUuid string) error {
 
 		parties[partyId] = &party
 
+		if client, ok := clients.Load(playerUuid); ok {
+			client.partyId = partyId
+		}
+
+		sendPartyUpdateToMembers(partyId)
+
 		return nil
 	}
 
 	client, ok := clients.Load(playerUuid)
 	if !ok {
-		return errors.New("client not online")
+		// approved join requests can add players who aren't connected here, so read their member data back
+		party.Members, err = getPartyMemberDataFromDatabase(partyId)
+		if err != nil {
+			return err
+		}
+
+		sendPartyUpdateToMembers(partyId)
+
+		return nil
 	}
 
 	partyMemberPlayerListData := PlayerListData{
@@ -307,6 +956,8 @@ func joinPlayerParty(partyId int, playerUuid string) error {
 
 	client.partyId = partyId
 
+	sendPartyUpdateToMembers(partyId)
+
 	return nil
 }
 
@@ -316,7 +967,7 @@ func leavePlayerParty(playerUuid string) error {
 		return err
 	}
 
-	_, err = db.Exec("DELETE pm FROM partyMembers pm JOIN parties p ON p.id = pm.partyId WHERE pm.uuid = ? AND p.game = ?", playerUuid, config.gameName)
+	_, err = db.Exec("DELETE FROM partyMembers WHERE uuid = ? AND partyId = ?", playerUuid, partyId)
 	if err != nil {
 		return err
 	}
@@ -331,6 +982,10 @@ func leavePlayerParty(playerUuid string) error {
 		return errors.New("party id not in cache")
 	}
 
+	party.Officers = slices.DeleteFunc(party.Officers, func(officerUuid string) bool {
+		return officerUuid == playerUuid
+	})
+
 	// remove member from party cache
 	if len(party.Members) <= 1 {
 		party.Members = nil // probably not safe
@@ -345,8 +1000,14 @@ func leavePlayerParty(playerUuid string) error {
 
 	if client, ok := clients.Load(playerUuid); ok {
 		client.partyId = 0
+		client.trySend(buildMsg("pt", "null"))
 	}
 
+	// markers are placed for the rest of the party, so they go with whoever placed them
+	sendPartyMarkerRemoval(partyId, removePlayerPartyMarkers(partyId, playerUuid))
+
+	sendPartyUpdateToMembers(partyId)
+
 	return nil
 }
 
@@ -380,6 +1041,11 @@ func assumeNextPartyOwner(partyId int) error {
 
 	var nextOnlinePlayerUuid string
 
+	// officers take over before other members
+	if party, ok := parties[partyId]; ok {
+		partyMemberUuids = append(slices.Clone(party.Officers), partyMemberUuids...)
+	}
+
 	for _, uuid := range partyMemberUuids {
 		if client, ok := clients.Load(uuid); ok {
 			if client.roomC != nil {
@@ -390,12 +1056,12 @@ func assumeNextPartyOwner(partyId int) error {
 	}
 
 	if nextOnlinePlayerUuid != "" {
-		err := setPartyOwner(partyId, nextOnlinePlayerUuid)
+		err := setPartyOwner(partyId, nextOnlinePlayerUuid, "")
 		if err != nil {
 			return err
 		}
 	} else {
-		_, err := db.Exec("UPDATE parties p SET p.owner = (SELECT pm.uuid FROM partyMembers pm JOIN players pd ON pd.uuid = pm.uuid WHERE pm.partyId = p.id ORDER BY pd.rank DESC, pm.id LIMIT 1) WHERE p.id = ?", partyId)
+		_, err := db.Exec("UPDATE parties p SET p.owner = (SELECT pm.uuid FROM partyMembers pm JOIN players pd ON pd.uuid = pm.uuid WHERE pm.partyId = p.id ORDER BY pm.role = ? DESC, pd.rank DESC, pm.id LIMIT 1) WHERE p.id = ?", partyRoleOfficer, partyId)
 		if err != nil {
 			return err
 		}
@@ -404,12 +1070,26 @@ func assumeNextPartyOwner(partyId int) error {
 	return nil
 }
 
-func setPartyOwner(partyId int, playerUuid string) error {
+// leave actorUuid empty when ownership passes on automatically;
+// on a transfer the previous owner stays on as an officer
+func setPartyOwner(partyId int, playerUuid string, actorUuid string) error {
 	_, err := db.Exec("UPDATE parties SET owner = ? WHERE id = ?", playerUuid, partyId)
 	if err != nil {
 		return err
 	}
 
+	_, err = db.Exec("UPDATE partyMembers SET role = ? WHERE partyId = ? AND uuid = ?", partyRoleMember, partyId, playerUuid)
+	if err != nil {
+		return err
+	}
+
+	if actorUuid != "" {
+		_, err = db.Exec("UPDATE partyMembers SET role = ? WHERE partyId = ? AND uuid = ?", partyRoleOfficer, partyId, actorUuid)
+		if err != nil {
+			return err
+		}
+	}
+
 	party, ok := parties[partyId]
 	if !ok {
 		return errors.New("party id not in cache")
@@ -417,6 +1097,26 @@ func setPartyOwner(partyId int, playerUuid string) error {
 
 	party.OwnerUuid = playerUuid
 
+	party.Officers = slices.DeleteFunc(party.Officers, func(officerUuid string) bool {
+		return officerUuid == playerUuid
+	})
+
+	err = writePartyRoleChange(partyId, playerUuid, partyRoleOwner, actorUuid)
+	if err != nil {
+		return err
+	}
+
+	if actorUuid != "" {
+		party.Officers = append(party.Officers, actorUuid)
+
+		err = writePartyRoleChange(partyId, actorUuid, partyRoleOfficer, actorUuid)
+		if err != nil {
+			return err
+		}
+	}
+
+	sendPartyUpdateToMembers(partyId)
+
 	return nil
 }
 
@@ -432,6 +1132,18 @@ func checkDeleteOrphanedParty(partyId int) (deleted bool, err error) {
 			return true, err
 		}
 
+		_, err = db.Exec("DELETE FROM partyRoleChanges WHERE partyId = ?", partyId)
+		if err != nil {
+			return true, err
+		}
+
+		err = deletePartyInvites(partyId)
+		if err != nil {
+			return true, err
+		}
+
+		clearPartyMarkers(partyId)
+
 		delete(parties, partyId)
 
 		return true, nil
@@ -441,6 +1153,9 @@ func checkDeleteOrphanedParty(partyId int) (deleted bool, err error) {
 }
 
 func deletePartyAndMembers(partyId int) error {
+	party, ok := parties[partyId]
+	crossGame := ok && party.CrossGame
+
 	_, err := db.Exec("DELETE FROM partyMembers WHERE partyId = ?", partyId)
 	if err != nil {
 		return err
@@ -451,6 +1166,31 @@ func deletePartyAndMembers(partyId int) error {
 		return err
 	}
 
+	_, err = db.Exec("DELETE FROM partyRoleChanges WHERE partyId = ?", partyId)
+	if err != nil {
+		return err
+	}
+
+	err = deletePartyInvites(partyId)
+	if err != nil {
+		return err
+	}
+
+	clearPartyMarkers(partyId)
+
+	if crossGame {
+		relayPartyUpdate(partyId)
+	}
+
+	if partyMemberUuids, err := getPartyMemberUuids(partyId); err == nil {
+		for _, uuid := range partyMemberUuids {
+			if client, ok := clients.Load(uuid); ok {
+				client.partyId = 0
+				client.trySend(buildMsg("pt", "null"))
+			}
+		}
+	}
+
 	delete(parties, partyId)
 
 	return nil
@@ -0,0 +1,390 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	partyInviteInvite   = "invite"   // sent to the invitee
+	partyInviteRequest  = "request"  // sent to the party owner and officers
+	partyInviteApproved = "approved" // sent to the requester
+	partyInviteDenied   = "denied"   // sent to the requester
+)
+
+type PartyInvite struct {
+	PartyId     int       `json:"partyId"`
+	PartyName   string    `json:"partyName"`
+	Uuid        string    `json:"uuid"`
+	Name        string    `json:"name"`
+	InviterUuid string    `json:"inviterUuid,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+func initParties() {
+	// Use main server to hash legacy passwords and clear out expired invites for all games
+	if !isMainServer {
+		return
+	}
+
+	logInitTask("parties")
+
+	err := hashLegacyPartyPasswords()
+	if err != nil {
+		eprintf("PARTY", "failed to hash party passwords: %s", err)
+	}
+
+	scheduler.Every(1).Hour().Do(deleteExpiredPartyInvites)
+}
+
+func hashPartyPass(pass string) (string, error) {
+	if pass == "" {
+		return "", nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func isPartyPassHashed(pass string) bool {
+	return strings.HasPrefix(pass, "$2")
+}
+
+func checkPartyPass(hash string, pass string) bool {
+	if hash == "" {
+		// private parties without a password can only be joined by invite
+		return false
+	}
+
+	if !isPartyPassHashed(hash) {
+		// not migrated yet
+		return hash == pass
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+func getPartyJoinKey(uuid string, partyId int) string {
+	return "party:" + uuid + ":" + strconv.Itoa(partyId)
+}
+
+// must be called with partiesMutex held. it is released while bcrypt runs so other party
+// operations aren't stalled, and held again on return. failures count towards the login throttle
+func checkPartyJoinPass(partyId int, uuid string, ip string, pass string) (ok bool, wait time.Duration) {
+	party, exists := parties[partyId]
+	if !exists {
+		return false, 0
+	}
+
+	joinKey, ipKey := getPartyJoinKey(uuid, partyId), getIpLoginKey(ip)
+	if wait := loginThrottle.Check(joinKey, ipKey); wait > 0 {
+		return false, wait
+	}
+
+	hash := party.Pass
+
+	partiesMutex.Unlock()
+	ok = checkPartyPass(hash, pass)
+	partiesMutex.Lock()
+
+	if !ok {
+		loginThrottle.Fail(joinKey, false)
+		loginThrottle.Fail(ipKey, false)
+		return false, 0
+	}
+
+	loginThrottle.Reset(joinKey)
+
+	// the pass may have been changed while the lock was released
+	if party, exists := parties[partyId]; !exists || party.Pass != hash {
+		return false, 0
+	}
+
+	return true, 0
+}
+
+// parties created before passwords were hashed
+func hashLegacyPartyPasswords() error {
+	results, err := db.Query("SELECT id, pass FROM parties WHERE pass IS NOT NULL AND pass != '' AND pass NOT LIKE '$2%'")
+	if err != nil {
+		return err
+	}
+
+	defer results.Close()
+
+	legacyPasses := make(map[int]string)
+
+	for results.Next() {
+		var partyId int
+		var pass string
+
+		err := results.Scan(&partyId, &pass)
+		if err != nil {
+			return err
+		}
+
+		legacyPasses[partyId] = pass
+	}
+
+	for partyId, pass := range legacyPasses {
+		hash, err := hashPartyPass(pass)
+		if err != nil {
+			return err
+		}
+
+		// only if it hasn't been changed in the meantime
+		_, err = db.Exec("UPDATE parties SET pass = ? WHERE id = ? AND pass = ?", hash, partyId, pass)
+		if err != nil {
+			return err
+		}
+
+		partiesMutex.Lock()
+		if party, ok := parties[partyId]; ok && party.Pass == pass {
+			party.Pass = hash
+		}
+		partiesMutex.Unlock()
+	}
+
+	return nil
+}
+
+func sendPartyInviteNotice(targetUuid string, kind string, partyId int, partyName string, uuid string, name string) {
+	if client, ok := clients.Load(targetUuid); ok {
+		client.trySend(buildMsg("pti", kind, partyId, partyName, uuid, name))
+	}
+}
+
+func createPartyInvite(partyId int, inviterUuid string, uuid string) error {
+	party, ok := parties[partyId]
+	if !ok {
+		return errors.New("party id not in cache")
+	}
+
+	for _, member := range party.Members {
+		if member.Uuid == uuid {
+			return errors.New("player already in party")
+		}
+	}
+
+	if isPlayerBlocked(uuid, inviterUuid) {
+		return errors.New("player is blocked")
+	}
+
+	_, err := db.Exec("INSERT INTO partyInvites (partyId, uuid, inviterUuid, expiry) VALUES (?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND)) ON DUPLICATE KEY UPDATE inviterUuid = VALUES(inviterUuid), expiry = VALUES(expiry)", partyId, uuid, inviterUuid, int(config.party.inviteExpiry.Seconds()))
+	if err != nil {
+		return err
+	}
+
+	sendPartyInviteNotice(uuid, partyInviteInvite, partyId, party.Name, inviterUuid, getNameFromUuid(inviterUuid))
+
+	return nil
+}
+
+// removes a pending invite, returning whether there was one to remove
+func consumePartyInvite(partyId int, uuid string) (bool, error) {
+	results, err := db.Exec("DELETE FROM partyInvites WHERE partyId = ? AND uuid = ? AND expiry > NOW()", partyId, uuid)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := results.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, nil
+}
+
+func createPartyJoinRequest(partyId int, uuid string) error {
+	party, ok := parties[partyId]
+	if !ok {
+		return errors.New("party id not in cache")
+	}
+
+	if isPlayerBlocked(party.OwnerUuid, uuid) {
+		return errors.New("player is blocked")
+	}
+
+	_, err := db.Exec("INSERT INTO partyJoinRequests (partyId, uuid, expiry) VALUES (?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND)) ON DUPLICATE KEY UPDATE expiry = VALUES(expiry)", partyId, uuid, int(config.party.inviteExpiry.Seconds()))
+	if err != nil {
+		return err
+	}
+
+	name := getNameFromUuid(uuid)
+	for _, officerUuid := range append([]string{party.OwnerUuid}, party.Officers...) {
+		sendPartyInviteNotice(officerUuid, partyInviteRequest, partyId, party.Name, uuid, name)
+	}
+
+	return nil
+}
+
+func consumePartyJoinRequest(partyId int, uuid string) (bool, error) {
+	results, err := db.Exec("DELETE FROM partyJoinRequests WHERE partyId = ? AND uuid = ? AND expiry > NOW()", partyId, uuid)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := results.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows > 0, nil
+}
+
+// invites and join requests addressed to uuid, the latter only for parties they can manage
+func getPendingPartyInvites(uuid string, partyId int) (invites []*PartyInvite, requests []*PartyInvite, err error) {
+	results, err := db.Query("SELECT pi.partyId, p.name, pi.inviterUuid, COALESCE(a.user, pgd.name, ''), pi.timestampCreated FROM partyInvites pi JOIN parties p ON p.id = pi.partyId LEFT JOIN accounts a ON a.uuid = pi.inviterUuid LEFT JOIN playerGameData pgd ON pgd.uuid = pi.inviterUuid AND pgd.game = p.game WHERE pi.uuid = ? AND (p.game = ? OR p.crossGame = 1) AND pi.expiry > NOW() ORDER BY pi.timestampCreated DESC", uuid, config.gameName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		invite := &PartyInvite{Uuid: uuid}
+
+		err := results.Scan(&invite.PartyId, &invite.PartyName, &invite.InviterUuid, &invite.Name, &invite.Timestamp)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		invites = append(invites, invite)
+	}
+
+	if partyId == 0 || !isPartyOfficer(partyId, uuid) {
+		return invites, nil, nil
+	}
+
+	results, err = db.Query("SELECT pr.partyId, p.name, pr.uuid, COALESCE(a.user, pgd.name, ''), pr.timestampCreated FROM partyJoinRequests pr JOIN parties p ON p.id = pr.partyId LEFT JOIN accounts a ON a.uuid = pr.uuid LEFT JOIN playerGameData pgd ON pgd.uuid = pr.uuid AND pgd.game = p.game WHERE pr.partyId = ? AND pr.expiry > NOW() ORDER BY pr.timestampCreated", partyId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		request := &PartyInvite{}
+
+		err := results.Scan(&request.PartyId, &request.PartyName, &request.Uuid, &request.Name, &request.Timestamp)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		requests = append(requests, request)
+	}
+
+	return invites, requests, nil
+}
+
+func getPendingPartyInvitesJson(uuid string, partyId int) ([]byte, error) {
+	invites, requests, err := getPendingPartyInvites(uuid, partyId)
+	if err != nil {
+		return nil, err
+	}
+
+	if invites == nil {
+		invites = []*PartyInvite{}
+	}
+	if requests == nil {
+		requests = []*PartyInvite{}
+	}
+
+	return json.Marshal(struct {
+		Invites  []*PartyInvite `json:"invites"`
+		Requests []*PartyInvite `json:"requests"`
+	}{invites, requests})
+}
+
+// invite links can be used once by whoever holds them, until they expire
+func createPartyInviteLink(partyId int, creatorUuid string) (token string, err error) {
+	token = randString(24)
+
+	_, err = db.Exec("INSERT INTO partyInviteLinks (token, partyId, creatorUuid, expiry) VALUES (?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))", token, partyId, creatorUuid, int(config.party.linkExpiry.Seconds()))
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func consumePartyInviteLink(token string) (partyId int, err error) {
+	err = db.QueryRow("SELECT partyId FROM partyInviteLinks WHERE token = ? AND expiry > NOW()", token).Scan(&partyId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	// whoever deletes the row gets to use the link
+	results, err := db.Exec("DELETE FROM partyInviteLinks WHERE token = ?", token)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := results.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rows == 0 {
+		return 0, nil
+	}
+
+	return partyId, nil
+}
+
+func deletePartyInvites(partyId int) error {
+	_, err := db.Exec("DELETE FROM partyInvites WHERE partyId = ?", partyId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM partyJoinRequests WHERE partyId = ?", partyId)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM partyInviteLinks WHERE partyId = ?", partyId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func deleteExpiredPartyInvites() {
+	for _, table := range []string{"partyInvites", "partyJoinRequests", "partyInviteLinks"} {
+		_, err := db.Exec("DELETE FROM " + table + " WHERE expiry < NOW()")
+		if err != nil {
+			eprintf("PARTY", "failed to delete expired %s: %s", table, err)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const partyMarkerLabelMaxLength = 50
+
+type PartyMarker struct {
+	Id        int       `json:"id"`
+	Uuid      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	Game      string    `json:"game"` // mapId is only meaningful within this game
+	Label     string    `json:"label"`
+	MapId     string    `json:"mapId"`
+	X         int       `json:"x"` // -1 for named locations
+	Y         int       `json:"y"`
+	Location  string    `json:"location,omitempty"` // set when placed at a named location instead of a position
+	Timestamp time.Time `json:"timestamp"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// markers only live in memory; they are meant for coordinating players who are online right now.
+// ids are random so markers relayed between servers for cross-game parties don't collide
+var (
+	partyMarkers      = make(map[int][]*PartyMarker)
+	partyMarkersMutex sync.Mutex
+)
+
+// pmk <label> <durationSeconds> [location]
+func (c *SessionClient) handlePmk(msg []string) error {
+	if len(msg) != 3 && len(msg) != 4 {
+		return errors.New("segment count mismatch")
+	}
+
+	if c.partyId == 0 {
+		return errors.New("player not in a party")
+	}
+
+	if c.muted {
+		return errors.New("player is muted")
+	}
+
+	label := msg[1]
+	if label == "" || utf8.RuneCountInString(label) > partyMarkerLabelMaxLength {
+		return errors.New("invalid label")
+	}
+
+	filterResult := wordFilter.Filter(label)
+	if filterResult.Blocked {
+		return errors.New("label contains blocked words")
+	}
+	label = filterResult.Contents
+
+	durationSeconds, err := strconv.Atoi(msg[2])
+	if err != nil || durationSeconds <= 0 {
+		return errors.New("invalid duration")
+	}
+
+	duration := time.Duration(durationSeconds) * time.Second
+	if duration > config.party.markerMaxDuration {
+		duration = config.party.markerMaxDuration
+	}
+
+	marker := &PartyMarker{
+		Uuid:      c.uuid,
+		Name:      c.name,
+		Game:      config.gameName,
+		Label:     label,
+		Timestamp: time.Now(),
+		Expiry:    time.Now().Add(duration),
+	}
+
+	if len(msg) == 4 {
+		gameLocation, err := getGameLocationByName(msg[3])
+		if err != nil {
+			return err
+		}
+		if len(gameLocation.MapIds) == 0 {
+			return errors.New("location has no maps")
+		}
+
+		marker.Location = gameLocation.Name
+		marker.MapId = gameLocation.MapIds[0]
+		marker.X = -1
+		marker.Y = -1
+	} else {
+		if c.roomC == nil {
+			return errors.New("room client does not exist")
+		}
+
+		marker.MapId = c.roomC.mapId
+		marker.X = c.roomC.x
+		marker.Y = c.roomC.y
+	}
+
+	// shadow muted players' markers are only shown to themselves, and never stored where others could list them
+	shadowDropped := c.banned || c.shadowMuted
+	if shadowDropped {
+		marker.Id = rand.IntN(math.MaxInt32) + 1
+	} else {
+		err = addPartyMarker(c.partyId, marker)
+		if err != nil {
+			return err
+		}
+	}
+
+	markerJson, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+
+	if shadowDropped {
+		c.outbox <- buildMsg("pmk", markerJson)
+		return nil
+	}
+
+	partiesMutex.Lock()
+	sendPartyMessage(c.partyId, buildMsg("pmk", markerJson))
+	if party, ok := parties[c.partyId]; ok && party.CrossGame {
+		relayPartyMarker(c.partyId, marker)
+	}
+	partiesMutex.Unlock()
+
+	return nil
+}
+
+// pmkd <markerId>
+func (c *SessionClient) handlePmkd(msg []string) error {
+	if len(msg) != 2 {
+		return errors.New("segment count mismatch")
+	}
+
+	if c.partyId == 0 {
+		return errors.New("player not in a party")
+	}
+
+	markerId, err := strconv.Atoi(msg[1])
+	if err != nil {
+		return errors.New("invalid marker id")
+	}
+
+	partiesMutex.Lock()
+	defer partiesMutex.Unlock()
+
+	// officers can remove anyone's marker, members only their own
+	err = removePartyMarker(c.partyId, markerId, c.uuid, isPartyOfficer(c.partyId, c.uuid))
+	if err != nil {
+		return err
+	}
+
+	sendPartyMarkerRemoval(c.partyId, []int{markerId})
+
+	return nil
+}
+
+// pmkl: list the party's active markers
+func (c *SessionClient) handlePmkl() error {
+	if c.partyId == 0 {
+		return errors.New("player not in a party")
+	}
+
+	markersJson, err := json.Marshal(getPartyMarkers(c.partyId))
+	if err != nil {
+		return err
+	}
+
+	c.outbox <- buildMsg("pmkl", markersJson)
+
+	return nil
+}
+
+func addPartyMarker(partyId int, marker *PartyMarker) error {
+	partyMarkersMutex.Lock()
+	defer partyMarkersMutex.Unlock()
+
+	markers := pruneExpiredPartyMarkers(partyId)
+	if len(markers) >= config.party.maxMarkers {
+		return errors.New("party marker limit reached")
+	}
+
+	for marker.Id == 0 || slices.ContainsFunc(markers, func(m *PartyMarker) bool { return m.Id == marker.Id }) {
+		marker.Id = rand.IntN(math.MaxInt32) + 1
+	}
+
+	partyMarkers[partyId] = append(markers, marker)
+
+	return nil
+}
+
+func removePartyMarker(partyId int, markerId int, uuid string, isOfficer bool) error {
+	partyMarkersMutex.Lock()
+	defer partyMarkersMutex.Unlock()
+
+	markers := pruneExpiredPartyMarkers(partyId)
+
+	i := slices.IndexFunc(markers, func(marker *PartyMarker) bool {
+		return marker.Id == markerId
+	})
+	if i < 0 {
+		return errors.New("marker not found")
+	}
+
+	if !isOfficer && markers[i].Uuid != uuid {
+		return errors.New("attempted to remove another player's marker")
+	}
+
+	partyMarkers[partyId] = slices.Delete(markers, i, i+1)
+
+	return nil
+}
+
+// removes every marker the player placed and returns their ids
+func removePlayerPartyMarkers(partyId int, uuid string) (markerIds []int) {
+	partyMarkersMutex.Lock()
+	defer partyMarkersMutex.Unlock()
+
+	markers := slices.DeleteFunc(pruneExpiredPartyMarkers(partyId), func(marker *PartyMarker) bool {
+		if marker.Uuid != uuid {
+			return false
+		}
+		markerIds = append(markerIds, marker.Id)
+		return true
+	})
+
+	if len(markers) == 0 {
+		delete(partyMarkers, partyId)
+	} else {
+		partyMarkers[partyId] = markers
+	}
+
+	return markerIds
+}
+
+func getPartyMarkers(partyId int) []*PartyMarker {
+	partyMarkersMutex.Lock()
+	defer partyMarkersMutex.Unlock()
+
+	return slices.Clone(pruneExpiredPartyMarkers(partyId))
+}
+
+// must be called with partyMarkersMutex held
+func pruneExpiredPartyMarkers(partyId int) []*PartyMarker {
+	now := time.Now()
+
+	markers := slices.DeleteFunc(partyMarkers[partyId], func(marker *PartyMarker) bool {
+		return marker.Expiry.Before(now)
+	})
+
+	if len(markers) == 0 {
+		delete(partyMarkers, partyId)
+		return nil
+	}
+
+	partyMarkers[partyId] = markers
+
+	return markers
+}
+
+func clearPartyMarkers(partyId int) {
+	partyMarkersMutex.Lock()
+	delete(partyMarkers, partyId)
+	partyMarkersMutex.Unlock()
+}
+
+func sendPartyMessage(partyId int, msg []byte) {
+	partyMemberUuids, err := getPartyMemberUuids(partyId)
+	if err != nil {
+		return
+	}
+
+	for _, uuid := range partyMemberUuids {
+		if client, ok := clients.Load(uuid); ok {
+			client.trySend(msg)
+		}
+	}
+}
+
+// tells members here and, for cross-game parties, on sibling servers that markers were removed.
+// must be called with partiesMutex held
+func sendPartyMarkerRemoval(partyId int, markerIds []int) {
+	if len(markerIds) == 0 {
+		return
+	}
+
+	for _, markerId := range markerIds {
+		sendPartyMessage(partyId, buildMsg("pmkd", markerId))
+	}
+
+	if party, ok := parties[partyId]; ok && party.CrossGame {
+		go func() {
+			err := forEachGame(func(game string) error {
+				if game == config.gameName {
+					return nil
+				}
+
+				return ipcCall(game, "IPC.RelayPartyMarkerRemoval", PartyMarkerRemovalArgs{partyId, markerIds}, true)
+			})
+			if err != nil {
+				eprintf("party", "failed to relay marker removal for party %d: %s", partyId, err)
+			}
+		}()
+	}
+}
+
+func relayPartyMarker(partyId int, marker *PartyMarker) {
+	args := PartyMarkerArgs{partyId, *marker}
+
+	go func() {
+		err := forEachGame(func(game string) error {
+			if game == config.gameName {
+				return nil
+			}
+
+			return ipcCall(game, "IPC.RelayPartyMarker", args, true)
+		})
+		if err != nil {
+			eprintf("party", "failed to relay marker for party %d: %s", partyId, err)
+		}
+	}()
+}
+
+// stores a marker placed on a sibling server and shows it to members here
+func receivePartyMarker(partyId int, marker *PartyMarker) {
+	if _, ok := parties[partyId]; !ok {
+		return
+	}
+
+	partyMarkersMutex.Lock()
+	markers := pruneExpiredPartyMarkers(partyId)
+	if slices.ContainsFunc(markers, func(m *PartyMarker) bool { return m.Id == marker.Id }) {
+		// already received; relays are retried
+		partyMarkersMutex.Unlock()
+		return
+	}
+	partyMarkers[partyId] = append(markers, marker)
+	partyMarkersMutex.Unlock()
+
+	markerJson, err := json.Marshal(marker)
+	if err != nil {
+		return
+	}
+
+	sendPartyMessage(partyId, buildMsg("pmk", markerJson))
+}
+
+func receivePartyMarkerRemoval(partyId int, markerIds []int) {
+	if _, ok := parties[partyId]; !ok {
+		return
+	}
+
+	partyMarkersMutex.Lock()
+	markers := slices.DeleteFunc(pruneExpiredPartyMarkers(partyId), func(marker *PartyMarker) bool {
+		return slices.Contains(markerIds, marker.Id)
+	})
+	if len(markers) == 0 {
+		delete(partyMarkers, partyId)
+	} else {
+		partyMarkers[partyId] = markers
+	}
+	partyMarkersMutex.Unlock()
+
+	for _, markerId := range markerIds {
+		sendPartyMessage(partyId, buildMsg("pmkd", markerId))
+	}
+}
@@ -0,0 +1,277 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"errors"
+	"slices"
+	"sync"
+)
+
+const (
+	permViewPlayers       = "view_players"
+	permBan               = "ban"
+	permMute              = "mute"
+	permWarn              = "warn"
+	permChangeUsername    = "change_username"
+	permResetPassword     = "reset_password"
+	permGrantBadge        = "grant_badge"
+	permManageRoles       = "manage_roles"
+	permViewAuditLog      = "view_audit_log"
+	permDeleteMessages    = "delete_messages"
+	permHandleReports     = "handle_reports"
+	permEditSchedules     = "edit_schedules"
+	permJoinPrivateParty  = "join_private_party"
+	permPlayDevMinigames  = "play_dev_minigames"
+	permViewDevBadges     = "view_dev_badges"
+	permViewHiddenBadges  = "view_hidden_badges"
+	permBypassDebugChecks = "bypass_debug_checks"
+)
+
+type Role struct {
+	Name        string   `json:"name"`
+	Priority    int      `json:"priority"`
+	Permissions []string `json:"permissions"`
+}
+
+// used until a role with the same name is defined in the roles table
+var defaultRoles = []*Role{
+	{
+		Name:     "moderator",
+		Priority: 1,
+		Permissions: []string{
+			permViewPlayers, permBan, permMute, permWarn, permChangeUsername, permResetPassword, permGrantBadge, permDeleteMessages, permHandleReports,
+			permEditSchedules, permJoinPrivateParty, permPlayDevMinigames, permViewDevBadges, permBypassDebugChecks,
+		},
+	},
+	{
+		Name:     "admin",
+		Priority: 2,
+		Permissions: []string{
+			permViewPlayers, permBan, permMute, permWarn, permChangeUsername, permResetPassword, permGrantBadge, permManageRoles, permViewAuditLog,
+			permDeleteMessages, permHandleReports, permEditSchedules, permJoinPrivateParty, permPlayDevMinigames, permViewDevBadges, permViewHiddenBadges, permBypassDebugChecks,
+		},
+	},
+}
+
+var (
+	roles      map[string]*Role
+	rolesMutex sync.RWMutex
+)
+
+func initPermissions() {
+	err := loadRoles()
+	if err != nil {
+		eprintf("ROLES", "failed to load roles: %s", err)
+	}
+
+	scheduler.Every(5).Minutes().Do(func() {
+		err := loadRoles()
+		if err != nil {
+			eprintf("ROLES", "failed to reload roles: %s", err)
+		}
+	})
+}
+
+func loadRoles() error {
+	newRoles := make(map[string]*Role)
+	for _, role := range defaultRoles {
+		newRoles[role.Name] = role
+	}
+
+	results, err := db.Query("SELECT r.name, r.priority, COALESCE(rp.permission, '') FROM roles r LEFT JOIN rolePermissions rp ON rp.role = r.name ORDER BY r.name")
+	if err != nil {
+		return err
+	}
+
+	defer results.Close()
+
+	definedRoles := make(map[string]*Role)
+
+	for results.Next() {
+		var name, permission string
+		var priority int
+
+		err := results.Scan(&name, &priority, &permission)
+		if err != nil {
+			return err
+		}
+
+		role, ok := definedRoles[name]
+		if !ok {
+			role = &Role{Name: name, Priority: priority}
+			definedRoles[name] = role
+		}
+
+		if permission != "" {
+			role.Permissions = append(role.Permissions, permission)
+		}
+	}
+
+	for name, role := range definedRoles {
+		newRoles[name] = role
+	}
+
+	rolesMutex.Lock()
+	roles = newRoles
+	rolesMutex.Unlock()
+
+	return nil
+}
+
+func getRole(name string) *Role {
+	rolesMutex.RLock()
+	defer rolesMutex.RUnlock()
+
+	return roles[name]
+}
+
+// legacy ranks map onto the built-in roles so existing staff keep their access
+func getRankRole(rank int) string {
+	switch {
+	case rank >= 2:
+		return "admin"
+	case rank == 1:
+		return "moderator"
+	}
+
+	return ""
+}
+
+func getPlayerRoles(uuid string) (playerRoles []string, err error) {
+	if role := getRankRole(getPlayerRank(uuid)); role != "" {
+		playerRoles = append(playerRoles, role)
+	}
+
+	results, err := db.Query("SELECT role FROM playerRoles WHERE uuid = ?", uuid)
+	if err != nil {
+		return playerRoles, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var role string
+
+		err := results.Scan(&role)
+		if err != nil {
+			return playerRoles, err
+		}
+
+		if !slices.Contains(playerRoles, role) {
+			playerRoles = append(playerRoles, role)
+		}
+	}
+
+	return playerRoles, nil
+}
+
+func getCachedPlayerRoles(uuid string) []string {
+	if client, ok := clients.Load(uuid); ok {
+		return client.roles // return roles from session if client is connected
+	}
+
+	playerRoles, err := getPlayerRoles(uuid)
+	if err != nil {
+		eprintf("ROLES", "failed to read roles for %s: %s", uuid, err)
+	}
+
+	return playerRoles
+}
+
+// reports whether the player holds a role granting perm
+func can(uuid string, perm string) bool {
+	if uuid == "" {
+		return false
+	}
+
+	for _, name := range getCachedPlayerRoles(uuid) {
+		if role := getRole(name); role != nil && slices.Contains(role.Permissions, perm) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getPlayerRolePriority(uuid string) (priority int) {
+	for _, name := range getCachedPlayerRoles(uuid) {
+		if role := getRole(name); role != nil && role.Priority > priority {
+			priority = role.Priority
+		}
+	}
+
+	return priority
+}
+
+// reports whether sender holds perm and outranks the target, so staff can't act on their peers or superiors
+func canActOn(senderUuid, targetUuid string, perm string) bool {
+	return can(senderUuid, perm) && getPlayerRolePriority(senderUuid) > getPlayerRolePriority(targetUuid)
+}
+
+func grantPlayerRole(uuid string, role string) error {
+	_, err := db.Exec("INSERT IGNORE INTO playerRoles (uuid, role) VALUES (?, ?)", uuid, role)
+	if err != nil {
+		return err
+	}
+
+	return refreshPlayerRoles(uuid)
+}
+
+var errRankRole = errors.New("role comes from the player's rank; change their rank instead")
+
+func revokePlayerRole(uuid string, role string) error {
+	// getPlayerRoles would hand it straight back
+	if role == getRankRole(getPlayerRank(uuid)) {
+		return errRankRole
+	}
+
+	_, err := db.Exec("DELETE FROM playerRoles WHERE uuid = ? AND role = ?", uuid, role)
+	if err != nil {
+		return err
+	}
+
+	return refreshPlayerRoles(uuid)
+}
+
+// reloads the player's roles wherever they're connected, so a revoked role stops working everywhere at once
+func refreshPlayerRoles(uuid string) error {
+	return forEachGame(func(game string) error {
+		if game == config.gameName {
+			return refreshPlayerRolesUnchecked(uuid)
+		}
+
+		return ipcCall(game, "IPC.RefreshRoles", uuid, true)
+	})
+}
+
+func refreshPlayerRolesUnchecked(uuid string) error {
+	client, ok := clients.Load(uuid)
+	if !ok {
+		return nil
+	}
+
+	playerRoles, err := getPlayerRoles(uuid)
+	if err != nil {
+		return err
+	}
+
+	client.roles = playerRoles
+
+	return nil
+}
@@ -0,0 +1,438 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	presenceOnline  = "online"
+	presenceOffline = "offline"
+	presenceMap     = "map"
+	presenceSprite  = "sprite"
+	presenceSystem  = "system"
+	presenceName    = "name"
+)
+
+// full friend and party lists are still sent on request and by the reconciliation sweep;
+// everything in between is pushed to interested clients as "pu" delta events
+type PresenceEvent struct {
+	Type string `json:"type"`
+	Game string `json:"game"`
+	PlayerListFullData
+}
+
+type Presence struct {
+	mutex sync.RWMutex
+
+	// uuid -> uuids of local clients with them as an accepted friend
+	watchers map[string]map[string]bool
+	// uuid of a local client -> uuids of their accepted friends
+	watching map[string][]string
+}
+
+var presence = &Presence{
+	watchers: make(map[string]map[string]bool),
+	watching: make(map[string][]string),
+}
+
+func initPresence() {
+	// reconcile anything the delta events missed, such as friends in other games
+	scheduler.Every(config.presence.reconcileInterval).Do(func() {
+		partiesMutex.Lock()
+		sendPartyUpdate()
+		partiesMutex.Unlock()
+
+		sendFriendsUpdate()
+	})
+
+	initPresenceBus()
+}
+
+// subscribes the client to presence events of its accepted friends
+func (p *Presence) Watch(c *SessionClient) error {
+	if !c.account {
+		return nil
+	}
+
+	friendUuids, err := getAcceptedFriendUuids(c.uuid)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+
+	p.unwatch(c.uuid)
+
+	p.watching[c.uuid] = friendUuids
+	for _, friendUuid := range friendUuids {
+		if p.watchers[friendUuid] == nil {
+			p.watchers[friendUuid] = make(map[string]bool)
+		}
+		p.watchers[friendUuid][c.uuid] = true
+	}
+
+	p.mutex.Unlock()
+
+	onlineFriends := make(map[string]bool)
+	for _, friendUuid := range friendUuids {
+		if clients.Exists(friendUuid) {
+			onlineFriends[friendUuid] = true
+		}
+	}
+
+	c.setOnlineFriends(onlineFriends)
+
+	return nil
+}
+
+func (p *Presence) Unwatch(uuid string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.unwatch(uuid)
+}
+
+// must be called with the mutex held
+func (p *Presence) unwatch(uuid string) {
+	for _, friendUuid := range p.watching[uuid] {
+		delete(p.watchers[friendUuid], uuid)
+		if len(p.watchers[friendUuid]) == 0 {
+			delete(p.watchers, friendUuid)
+		}
+	}
+
+	delete(p.watching, uuid)
+}
+
+func (p *Presence) getWatchers(uuid string) (watcherUuids []string) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for watcherUuid := range p.watchers[uuid] {
+		watcherUuids = append(watcherUuids, watcherUuid)
+	}
+
+	return watcherUuids
+}
+
+func getAcceptedFriendUuids(uuid string) (friendUuids []string, err error) {
+	results, err := db.Query("SELECT targetUuid FROM playerFriends WHERE uuid = ? AND accepted = 1", uuid)
+	if err != nil {
+		return friendUuids, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var friendUuid string
+
+		err := results.Scan(&friendUuid)
+		if err != nil {
+			return friendUuids, err
+		}
+
+		friendUuids = append(friendUuids, friendUuid)
+	}
+
+	return friendUuids, nil
+}
+
+func (c *SessionClient) getPresenceEvent(eventType string) *PresenceEvent {
+	event := &PresenceEvent{
+		Type: eventType,
+		Game: config.gameName,
+		PlayerListFullData: PlayerListFullData{
+			PlayerListData: PlayerListData{
+				Uuid:        c.uuid,
+				Name:        c.name,
+				SystemName:  c.system,
+				Rank:        c.rank,
+				Account:     c.account,
+				Badge:       c.badge,
+				SpriteName:  c.sprite,
+				SpriteIndex: c.spriteIndex,
+				Medals:      c.medals,
+			},
+			MapId:      "0000",
+			PrevMapId:  "0000",
+			Online:     eventType != presenceOffline,
+			LastActive: time.Now().UTC(),
+		},
+	}
+
+	if eventType != presenceOffline && c.roomC != nil && !(c.hideLocation && c.singleplayer) {
+		event.MapId = c.roomC.mapId
+		event.PrevMapId = c.roomC.prevMapId
+		event.PrevLocations = c.roomC.prevLocations
+		event.X = c.roomC.x
+		event.Y = c.roomC.y
+	}
+
+	return event
+}
+
+// sends a presence delta for the client to its online friends and party members
+func (c *SessionClient) publishPresence(eventType string) {
+	if c.uuid == "" {
+		return
+	}
+
+	event := c.getPresenceEvent(eventType)
+
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		writeErrLog(c.uuid, "sess", err.Error())
+		return
+	}
+
+	msg := buildMsg("pu", eventJson)
+
+	recipients := make(map[string]bool)
+
+	for _, watcherUuid := range presence.getWatchers(c.uuid) {
+		recipients[watcherUuid] = true
+	}
+
+	partiesMutex.Lock()
+	if c.partyId != 0 {
+		if party, ok := parties[c.partyId]; ok {
+			for _, member := range party.Members {
+				recipients[member.Uuid] = true
+			}
+		}
+	}
+	partiesMutex.Unlock()
+
+	delete(recipients, c.uuid)
+
+	publishRemotePresence("IPC.PublishPresence", event)
+
+	for uuid := range recipients {
+		client, ok := clients.Load(uuid)
+		if !ok {
+			continue
+		}
+
+		switch eventType {
+		case presenceOnline, presenceOffline:
+			if presence.isWatching(client.uuid, c.uuid) {
+				client.setOnlineFriend(c.uuid, eventType == presenceOnline)
+			}
+		}
+
+		client.trySend(msg)
+	}
+}
+
+func (p *Presence) isWatching(watcherUuid, uuid string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.watchers[uuid][watcherUuid]
+}
+
+// reloads friend subscriptions and resends full friend lists, for after friendships change
+func refreshFriendPresence(uuids ...string) {
+	for _, uuid := range uuids {
+		client, ok := clients.Load(uuid)
+		if !ok {
+			continue
+		}
+
+		err := presence.Watch(client)
+		if err != nil {
+			writeErrLog(uuid, "sess", err.Error())
+			continue
+		}
+
+		err = client.handlePf()
+		if err != nil {
+			writeErrLog(uuid, "sess", err.Error())
+		}
+	}
+}
+
+// like a plain outbox send, but never blocks the caller on a slow client
+func (c *SessionClient) trySend(msg []byte) {
+	select {
+	case c.outbox <- msg:
+	default:
+		writeErrLog(c.uuid, "sess", "send channel is full")
+	}
+}
+
+// live state of players connected to sibling game servers, fed by the presence bus
+type RemotePresence struct {
+	mutex   sync.RWMutex
+	players map[string]*PresenceEvent
+}
+
+var remotePresence = &RemotePresence{
+	players: make(map[string]*PresenceEvent),
+}
+
+func (p *RemotePresence) Get(uuid string) (*PresenceEvent, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	event, ok := p.players[uuid]
+	return event, ok
+}
+
+func (p *RemotePresence) GetAll() (events []*PresenceEvent) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, event := range p.players {
+		events = append(events, event)
+	}
+
+	return events
+}
+
+func (p *RemotePresence) apply(event *PresenceEvent) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if event.Type == presenceOffline {
+		// the player may have already moved on to another game
+		if current, ok := p.players[event.Uuid]; ok && current.Game == event.Game {
+			delete(p.players, event.Uuid)
+		}
+		return
+	}
+
+	p.players[event.Uuid] = event
+}
+
+// replaces everything known about a game with a full snapshot from it
+func (p *RemotePresence) sync(game string, events []*PresenceEvent) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for uuid, event := range p.players {
+		if event.Game == game {
+			delete(p.players, uuid)
+		}
+	}
+
+	for _, event := range events {
+		p.players[event.Uuid] = event
+	}
+}
+
+// applies an event received from a sibling server and relays it to interested local clients
+func receiveRemotePresence(event *PresenceEvent) {
+	if event.Game == config.gameName {
+		return
+	}
+
+	remotePresence.apply(event)
+
+	// a player connected here is authoritative over what other games report
+	if clients.Exists(event.Uuid) {
+		return
+	}
+
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	msg := buildMsg("pu", eventJson)
+
+	recipients := make(map[string]bool)
+
+	for _, watcherUuid := range presence.getWatchers(event.Uuid) {
+		recipients[watcherUuid] = true
+	}
+
+	partiesMutex.Lock()
+	for _, party := range parties {
+		if !slices.ContainsFunc(party.Members, func(member *PlayerListFullData) bool { return member.Uuid == event.Uuid }) {
+			continue
+		}
+
+		for _, member := range party.Members {
+			recipients[member.Uuid] = true
+		}
+	}
+	partiesMutex.Unlock()
+
+	for uuid := range recipients {
+		if client, ok := clients.Load(uuid); ok {
+			client.trySend(msg)
+		}
+	}
+}
+
+type presenceCall struct {
+	method string
+	args   any
+}
+
+// one queue per sibling server so a slow or missing one doesn't hold up the others
+var presenceBus map[string]chan presenceCall
+
+func initPresenceBus() {
+	presenceBus = make(map[string]chan presenceCall)
+
+	for game := range gameIdToName {
+		if game == config.gameName {
+			continue
+		}
+
+		queue := make(chan presenceCall, 256)
+		presenceBus[game] = queue
+
+		go runPresenceBus(game, queue)
+	}
+
+	scheduler.Every(config.presence.reconcileInterval).Do(publishPresenceSnapshot)
+}
+
+func runPresenceBus(game string, queue chan presenceCall) {
+	for call := range queue {
+		// not retried; if the server is down it gets a full snapshot on the next sweep after it comes back
+		ipcCall(game, call.method, call.args, false)
+	}
+}
+
+func publishRemotePresence(method string, args any) {
+	for game, queue := range presenceBus {
+		select {
+		case queue <- presenceCall{method, args}:
+		default:
+			eprintf("PRESENCE", "bus queue for %s is full", game)
+		}
+	}
+}
+
+func publishPresenceSnapshot() {
+	var events []*PresenceEvent
+	for _, client := range clients.Get() {
+		events = append(events, client.getPresenceEvent(presenceOnline))
+	}
+
+	publishRemotePresence("IPC.SyncPresence", SyncPresenceArgs{Game: config.gameName, Events: events})
+}
@@ -26,17 +26,22 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
+// reporter of reports filed by the server itself, such as chat filter flags
+const systemReporterUuid = "0000000000000000"
+
 var (
 	bot *discordgo.Session
 	// uuid -> ynoMsgId -> discordMsgId
 	//
-	// main server only
+	// main server only; mirrored in playerReports.discordMsgId
 	reportLog     map[string]map[string]string
+	reportLogMtx  sync.Mutex
 	reportReasons = map[string]string{
 		":1": "Slurs, harmful or inappropriate language",
 		":2": "Harassment, bullying, stalking",
@@ -47,6 +52,9 @@ var (
 		":7": "Spam",
 	}
 	msgIdPattern = regexp.MustCompile(`msgid=(\S*)$`)
+
+	errDuplicateReport   = errors.New("report already open")
+	errReportRateLimited = errors.New("too many reports")
 	// main server only
 	modActionExpirations map[ModAction]oneshotJob
 )
@@ -80,7 +88,11 @@ func initReports() {
 func initModBot() {
 	reportLog = make(map[string]map[string]string)
 
-	var err error
+	err := loadReportLog()
+	if err != nil {
+		log.Printf("initModBot(reportLog): %s", err)
+	}
+
 	bot, err = discordgo.New("Bot " + config.moderation.botToken)
 	if err != nil {
 		if config.moderation.botToken != "" {
@@ -103,7 +115,7 @@ func initModBot() {
 			botHandleModalResponse(&resp, action.ModalSubmitData(), action.Interaction)
 			return
 		case discordgo.InteractionApplicationCommand:
-			botHandleCommandResponse(&resp, action.ApplicationCommandData())
+			botHandleCommandResponse(&resp, action.ApplicationCommandData(), action.Interaction)
 			return
 		}
 
@@ -120,9 +132,7 @@ func initModBot() {
 
 		doMute := func(broadcast bool) {
 			targetName := getNameFromUuid(uuid)
-			for game := range gameIdToName {
-				mutePlayerInGameUnchecked(game, uuid, false, broadcast)
-			}
+			mutePlayerInAllGamesUnchecked(uuid, false, broadcast)
 
 			content := fmt.Sprintf("*%s has been muted by %s*", targetName, action.Member.DisplayName())
 
@@ -135,15 +145,15 @@ func initModBot() {
 					}
 				}
 			}
-			delete(reportLog[uuid], ynoMsgId)
-			markAsResolved(uuid)
+			forgetReportLogMessage(uuid, ynoMsgId)
+			markAsResolved(uuid, reportOutcomeActioned, action.Member.DisplayName())
+
+			writeModAuditLog("", action.Member.DisplayName(), uuid, "mute", "", auditSourceDiscord, nil)
 		}
 
 		doBan := func(disconnect, broadcast bool) {
 			targetName := getNameFromUuid(uuid)
-			for game := range gameIdToName {
-				banPlayerInGameUnchecked(game, uuid, disconnect, false, broadcast)
-			}
+			banPlayerInAllGamesUnchecked(uuid, disconnect, false, broadcast)
 
 			content := fmt.Sprintf("*%s has been **banned** by %s*", targetName, action.Member.DisplayName())
 
@@ -156,8 +166,14 @@ func initModBot() {
 					}
 				}
 			}
-			delete(reportLog[uuid], ynoMsgId)
-			markAsResolved(uuid)
+			forgetReportLogMessage(uuid, ynoMsgId)
+			markAsResolved(uuid, reportOutcomeActioned, action.Member.DisplayName())
+
+			modAction := "ban"
+			if disconnect {
+				modAction = "dban"
+			}
+			writeModAuditLog("", action.Member.DisplayName(), uuid, modAction, "", auditSourceDiscord, nil)
 		}
 
 		switch cmd {
@@ -178,8 +194,10 @@ func initModBot() {
 					}
 				}
 			}
-			delete(reportLog[uuid], ynoMsgId)
-			markAsResolved(uuid)
+			forgetReportLogMessage(uuid, ynoMsgId)
+			markAsResolved(uuid, reportOutcomeAcknowledged, action.Member.DisplayName())
+
+			writeModAuditLog("", action.Member.DisplayName(), uuid, "ack", "", auditSourceDiscord, nil)
 		case "cmd":
 			if len(data.Values) != 1 {
 				return
@@ -209,6 +227,21 @@ func initModBot() {
 				doBan(true, true)
 			case "mute_broadcast":
 				doMute(true)
+			case "shadowmute":
+				err := setPlayerShadowMuted(uuid, true)
+				if err != nil {
+					log.Printf("setPlayerShadowMuted: %s", err)
+					return
+				}
+
+				content := fmt.Sprintf("*%s has been shadow muted by %s*", getNameFromUuid(uuid), action.Member.DisplayName())
+
+				resp.Type = discordgo.InteractionResponseUpdateMessage
+				resp.Data = &discordgo.InteractionResponseData{Content: content, Embeds: action.Message.Embeds}
+				forgetReportLogMessage(uuid, ynoMsgId)
+				markAsResolved(uuid, reportOutcomeActioned, action.Member.DisplayName())
+
+				writeModAuditLog("", action.Member.DisplayName(), uuid, "shadowmute", "", auditSourceDiscord, nil)
 			// handled by botHandleModalResponse
 			case "tempban":
 				fallthrough
@@ -247,6 +280,26 @@ func initModBot() {
 						},
 					},
 				}
+			case "warn":
+				fallthrough
+			case "sanction":
+				resp.Type = discordgo.InteractionResponseModal
+				resp.Data = &discordgo.InteractionResponseData{
+					CustomID: fmt.Sprintf("%s:%s", data.Values[0], uuid),
+					Title:    "Details",
+					Components: []discordgo.MessageComponent{
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.TextInput{
+									Label:     "Reason",
+									CustomID:  "reason",
+									Style:     discordgo.TextInputParagraph,
+									MaxLength: 150,
+								},
+							},
+						},
+					},
+				}
 			}
 
 			// reset the selection
@@ -323,19 +376,64 @@ func botHandleModalResponse(resp *discordgo.InteractionResponse, data discordgo.
 		cmd := strings.TrimSuffix(cmd, "_broadcast")
 
 		if cmd == "tempban" {
-			for game := range gameIdToName {
-				banPlayerInGameUnchecked(game, uuid, true, true, broadcast)
-			}
+			banPlayerInAllGamesUnchecked(uuid, true, true, broadcast)
 			registerModAction(uuid, actionBan, expiry, reason)
 			action = "**banned**"
 		} else {
-			for game := range gameIdToName {
-				mutePlayerInGameUnchecked(game, uuid, true, broadcast)
-			}
+			mutePlayerInAllGamesUnchecked(uuid, true, broadcast)
 			registerModAction(uuid, actionMute, expiry, reason)
 			action = "muted"
 		}
+		writeModAuditLog("", interaction.Member.DisplayName(), uuid, cmd, reason, auditSourceDiscord, &expiry)
+
 		content := fmt.Sprintf("*%s has been %s until <t:%d:F> by %s*", name, action, expiry.Unix(), interaction.Member.DisplayName())
+		var embeds []*discordgo.MessageEmbed
+		if msgObj := interaction.Message; msgObj != nil {
+			embeds = msgObj.Embeds
+		}
+		resp.Type = discordgo.InteractionResponseUpdateMessage
+		resp.Data = &discordgo.InteractionResponseData{Content: content, Embeds: embeds}
+	case "warn":
+		fallthrough
+	case "sanction":
+		reason := data.Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+		name := getNameFromUuid(uuid)
+
+		var content string
+		if cmd == "warn" {
+			if err := warnPlayer("", interaction.Member.DisplayName(), uuid, reason, auditSourceDiscord); err != nil {
+				setResponse(resp, fmt.Sprintf("warn: %s", err))
+				return
+			}
+			content = fmt.Sprintf("*%s has been warned by %s*", name, interaction.Member.DisplayName())
+		} else {
+			level, step, err := getNextSanctionStep(uuid)
+			if err != nil {
+				setResponse(resp, fmt.Sprintf("sanction: %s", err))
+				return
+			}
+
+			sanction, err := applySanction("", interaction.Member.DisplayName(), uuid, reason, auditSourceDiscord, level, step)
+			if err != nil {
+				setResponse(resp, fmt.Sprintf("sanction: %s", err))
+				return
+			}
+
+			var action string
+			switch sanction.Action {
+			case sanctionWarn:
+				action = "warned"
+			case sanctionMute:
+				action = "muted"
+			case sanctionBan:
+				action = "**banned**"
+			}
+			if sanction.Expiry != nil {
+				action += fmt.Sprintf(" until <t:%d:F>", sanction.Expiry.Unix())
+			}
+			content = fmt.Sprintf("*%s has been %s (sanction level %d) by %s*", name, action, sanction.Level+1, interaction.Member.DisplayName())
+		}
+
 		var embeds []*discordgo.MessageEmbed
 		if msgObj := interaction.Message; msgObj != nil {
 			embeds = msgObj.Embeds
@@ -345,7 +443,7 @@ func botHandleModalResponse(resp *discordgo.InteractionResponse, data discordgo.
 	}
 }
 
-func botHandleCommandResponse(resp *discordgo.InteractionResponse, data discordgo.ApplicationCommandInteractionData) {
+func botHandleCommandResponse(resp *discordgo.InteractionResponse, data discordgo.ApplicationCommandInteractionData, interaction *discordgo.Interaction) {
 	args := data.Options
 	switch data.Name {
 	case "pinfo":
@@ -358,11 +456,12 @@ func botHandleCommandResponse(resp *discordgo.InteractionResponse, data discordg
 			onlineGames   []string
 			name, uuid    string
 			banned, muted bool
+			shadowMuted   bool
 			err           error
 		)
 		rows, err := db.Query(`
 SELECT
-	pgd.name, pgd.uuid, pgd.game, pgd.online, players.banned, players.muted
+	pgd.name, pgd.uuid, pgd.game, pgd.online, players.banned, players.muted, players.shadowMuted
 FROM playerGameData pgd
 JOIN players ON players.uuid = pgd.uuid
 WHERE pgd.name = ? OR pgd.uuid = ?`, playerid, playerid)
@@ -377,7 +476,7 @@ WHERE pgd.name = ? OR pgd.uuid = ?`, playerid, playerid)
 				game   string
 				online bool
 			)
-			err = rows.Scan(&name, &uuid, &game, &online, &banned, &muted)
+			err = rows.Scan(&name, &uuid, &game, &online, &banned, &muted, &shadowMuted)
 			if err != nil {
 				setResponse(resp, fmt.Sprintf("pinfo: sql error: %s", err))
 				return
@@ -388,9 +487,50 @@ WHERE pgd.name = ? OR pgd.uuid = ?`, playerid, playerid)
 		}
 		msg := fmt.Sprintf(`##### Player Info
 name=%s uuid=%s
-banned=%t muted=%t
-online in: %s`, name, uuid, banned, muted, strings.Join(onlineGames, ", "))
+banned=%t muted=%t shadowMuted=%t
+online in: %s`, name, uuid, banned, muted, shadowMuted, strings.Join(onlineGames, ", "))
 		setResponse(resp, msg)
+	case "shadowmute":
+		if len(args) != 2 {
+			setResponse(resp, "Usage: /shadowmute <NAME|UUID> <ENABLED>")
+			return
+		}
+		playerid, enabled := args[0].StringValue(), args[1].BoolValue()
+
+		uuid, err := getUuidFromName(playerid)
+		if err != nil {
+			setResponse(resp, fmt.Sprintf("shadowmute: sql error: %s", err))
+			return
+		}
+		if uuid == "" {
+			uuid = playerid
+		}
+
+		var exists bool
+		db.QueryRow("SELECT EXISTS (SELECT * FROM players WHERE uuid = ?)", uuid).Scan(&exists)
+		if !exists {
+			setResponse(resp, "shadowmute: player not found")
+			return
+		}
+
+		err = setPlayerShadowMuted(uuid, enabled)
+		if err != nil {
+			setResponse(resp, fmt.Sprintf("shadowmute: %s", err))
+			return
+		}
+
+		action := "shadowmute"
+		if !enabled {
+			action = "unshadowmute"
+		}
+
+		var actorName string
+		if interaction.Member != nil {
+			actorName = interaction.Member.DisplayName()
+		}
+		writeModAuditLog("", actorName, uuid, action, "", auditSourceDiscord, nil)
+
+		setResponse(resp, fmt.Sprintf("%s: %s", action, getNameFromUuid(uuid)))
 	default:
 		setResponse(resp, "Unknown command")
 	}
@@ -417,6 +557,32 @@ func registerBotCommands() (err error) {
 			},
 		},
 	)
+	if err != nil {
+		return
+	}
+
+	_, err = bot.ApplicationCommandCreate(
+		bot.State.User.ID,
+		config.moderation.guildId,
+		&discordgo.ApplicationCommand{
+			Name:        "shadowmute",
+			Description: "Shadow mute or unshadow mute a player",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "name",
+					Description: "player name or uuid",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "enabled",
+					Description: "whether the player should be shadow muted",
+					Required:    true,
+				},
+			},
+		},
+	)
 
 	return
 }
@@ -479,8 +645,10 @@ func scheduleModActionReversalMainServer(uuid string, action int, expiry time.Ti
 		switch action {
 		case actionBan:
 			err = unbanPlayerUnchecked(uuid)
+			writeModAuditLog("", "", uuid, "unban", "expired", auditSourceSystem, nil)
 		case actionMute:
 			err = unmutePlayerUnchecked(uuid)
+			writeModAuditLog("", "", uuid, "unmute", "expired", auditSourceSystem, nil)
 		default:
 			err = fmt.Errorf("did not handle reversal for action %d", action)
 		}
@@ -495,7 +663,7 @@ func scheduleModActionReversalMainServer(uuid string, action int, expiry time.Ti
 }
 
 // obj must be an outpointer to a [discordgo.MessageSend] or [discordgo.MessageEdit]
-func formatReportLog(obj any, targetUuid, ynoMsgId, originalMsg, game string, reasons map[string]int) {
+func formatReportLog(obj any, targetUuid, ynoMsgId, originalMsg, game string, reasons map[string]int, lowPriority bool) {
 	targetName := getNameFromUuid(targetUuid)
 	if originalMsg != "" {
 		originalMsg = fmt.Sprintf("> *%s*", originalMsg)
@@ -533,6 +701,15 @@ func formatReportLog(obj any, targetUuid, ynoMsgId, originalMsg, game string, re
 				Value:  metadataString,
 				Inline: true,
 			},
+			// after metadata, which parseMsgIdFromComponent expects as the third field
+			{
+				Name:  "Context",
+				Value: getReportContext(ynoMsgId, game),
+			},
+			{
+				Name:  "Likely alts",
+				Value: getLinkedIdentitiesSummary(targetUuid),
+			},
 		},
 	}
 
@@ -566,6 +743,10 @@ func formatReportLog(obj any, targetUuid, ynoMsgId, originalMsg, game string, re
 			Label: "Mute (broadcast)",
 			Value: "mute_broadcast",
 		},
+		{
+			Label: "Shadow mute",
+			Value: "shadowmute",
+		},
 		{
 			Label: "Tempban",
 			Value: "tempban",
@@ -582,6 +763,14 @@ func formatReportLog(obj any, targetUuid, ynoMsgId, originalMsg, game string, re
 			Label: "Tempmute (broadcast)",
 			Value: "tempmute_broadcast",
 		},
+		{
+			Label: "Warn",
+			Value: "warn",
+		},
+		{
+			Label: "Escalate (next sanction)",
+			Value: "sanction",
+		},
 		{
 			Label: "Reveal Reporters",
 			Value: "reveal",
@@ -604,6 +793,10 @@ func formatReportLog(obj any, targetUuid, ynoMsgId, originalMsg, game string, re
 	allowedMentions := &discordgo.MessageAllowedMentions{
 		Roles: []string{config.moderation.modRoleId},
 	}
+	if lowPriority {
+		content = "-# Only reported by low credibility reporters"
+		allowedMentions = &discordgo.MessageAllowedMentions{}
+	}
 	switch msg := obj.(type) {
 	case *discordgo.MessageSend:
 		msg.Content = content
@@ -662,7 +855,25 @@ func handleReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, ok := reportReasons[req.Reason]; !ok {
+		handleError(w, r, "invalid reason")
+		return
+	}
+
+	if req.Uuid == uuid {
+		handleError(w, r, "cannot report yourself")
+		return
+	}
+
 	msgid, originalMsg, err := createReport(uuid, req.Uuid, req.Reason, req.MsgId, req.OriginalMsg)
+	if err == errDuplicateReport {
+		handleError(w, r, "already reported")
+		return
+	}
+	if err == errReportRateLimited {
+		handleError(w, r, "too many reports")
+		return
+	}
 	if err != nil {
 		writeErrLog(uuid, r.URL.Path, "createReport failed: "+err.Error())
 		handleError(w, r, "Could not create report")
@@ -682,6 +893,11 @@ func sendReportLogMainServer(uuid, ynoMsgId, originalMsg, game string) error {
 		return errors.New("cannot call sendReportMessage from non-main server")
 	}
 
+	// reports are already queued in the database; the bot only mirrors them to a channel
+	if bot == nil || config.moderation.botToken == "" || config.moderation.channelId == "" {
+		return nil
+	}
+
 	rows, err := db.Query(`
 SELECT reason, COUNT(*) FROM playerReports
 WHERE targetUuid = ? AND NOT actionTaken
@@ -703,36 +919,93 @@ GROUP BY reason`, uuid)
 		}
 	}
 
+	credible, err := hasCredibleReporter(uuid)
+	if err != nil {
+		log.Printf("sendReportLog(credibility): %s", err)
+		credible = true
+	}
+	lowPriority := !credible
+
+	// held across the send so concurrent reports on one message can't post it twice
+	reportLogMtx.Lock()
+	defer reportLogMtx.Unlock()
+
 	var msg *discordgo.Message
-	if discordMsgId, ok := reportLog[uuid][ynoMsgId]; ok {
+	discordMsgId, ok := reportLog[uuid][ynoMsgId]
+	if ok {
 		payload := discordgo.NewMessageEdit(config.moderation.channelId, discordMsgId)
-		formatReportLog(payload, uuid, ynoMsgId, originalMsg, game, reasons)
+		formatReportLog(payload, uuid, ynoMsgId, originalMsg, game, reasons, lowPriority)
 		msg, err = bot.ChannelMessageEditComplex(payload)
-	} else {
+
+		// the log message was deleted from the channel, so post it again
+		var restErr *discordgo.RESTError
+		if errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMessage {
+			ok = false
+		}
+	}
+	if !ok {
 		payload := &discordgo.MessageSend{}
-		formatReportLog(payload, uuid, ynoMsgId, originalMsg, game, reasons)
+		formatReportLog(payload, uuid, ynoMsgId, originalMsg, game, reasons, lowPriority)
 		msg, err = bot.ChannelMessageSendComplex(config.moderation.channelId, payload)
 	}
 
-	if msg != nil && err == nil {
-		var forUuid map[string]string
-		if map_, ok := reportLog[uuid]; ok {
-			forUuid = map_
-		} else {
-			forUuid = make(map[string]string)
-			reportLog[uuid] = forUuid
-		}
-		forUuid[ynoMsgId] = msg.ID
+	if msg == nil || err != nil {
+		return err
+	}
+
+	forUuid, ok := reportLog[uuid]
+	if !ok {
+		forUuid = make(map[string]string)
+		reportLog[uuid] = forUuid
 	}
+	forUuid[ynoMsgId] = msg.ID
 
+	_, err = db.Exec("UPDATE playerReports SET discordMsgId = ? WHERE targetUuid = ? AND COALESCE(msgId, '') = ? AND NOT actionTaken", msg.ID, uuid, ynoMsgId)
 	return err
 }
 
+// rebuilds reportLog from the report log messages of unresolved reports
+func loadReportLog() error {
+	results, err := db.Query("SELECT DISTINCT targetUuid, COALESCE(msgId, ''), discordMsgId FROM playerReports WHERE discordMsgId IS NOT NULL AND NOT actionTaken")
+	if err != nil {
+		return err
+	}
+
+	defer results.Close()
+
+	reportLogMtx.Lock()
+	defer reportLogMtx.Unlock()
+
+	for results.Next() {
+		var targetUuid, ynoMsgId, discordMsgId string
+
+		err := results.Scan(&targetUuid, &ynoMsgId, &discordMsgId)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := reportLog[targetUuid]; !ok {
+			reportLog[targetUuid] = make(map[string]string)
+		}
+		reportLog[targetUuid][ynoMsgId] = discordMsgId
+	}
+
+	return nil
+}
+
+func forgetReportLogMessage(uuid, ynoMsgId string) {
+	reportLogMtx.Lock()
+	defer reportLogMtx.Unlock()
+
+	delete(reportLog[uuid], ynoMsgId)
+}
+
 func createReport(uuid, targetUuid, reason, msgId, originalMsg string) (string, string, error) {
 	var err error
-	row := db.QueryRow("SELECT contents FROM chatMessages WHERE msgId = ? AND uuid = ? AND game = ?", msgId, targetUuid, config.gameName)
+	row := db.QueryRow("SELECT contents, COALESCE(partyId, 0) FROM chatMessages WHERE msgId = ? AND uuid = ? AND game = ?", msgId, targetUuid, config.gameName)
 	var contentsFromDb string
-	err = row.Scan(&contentsFromDb)
+	var partyId int
+	err = row.Scan(&contentsFromDb, &partyId)
 	if err == nil {
 		originalMsg = contentsFromDb
 	} else if err != sql.ErrNoRows {
@@ -743,21 +1016,108 @@ func createReport(uuid, targetUuid, reason, msgId, originalMsg string) (string,
 	}
 
 	var msgIdLink *string
+	var chatContext []byte
 	if msgId != "" {
 		msgIdLink = &msgId
+		chatContext = snapshotReportContext(msgId, partyId, config.gameName)
+	}
+
+	// reporting the same thing again would only bump the existing report
+	var duplicate bool
+	err = db.QueryRow("SELECT EXISTS (SELECT * FROM playerReports WHERE uuid = ? AND targetUuid = ? AND COALESCE(msgId, '') = ? AND NOT actionTaken)", uuid, targetUuid, msgId).Scan(&duplicate)
+	if err != nil {
+		return msgId, originalMsg, err
+	}
+	if duplicate {
+		return msgId, originalMsg, errDuplicateReport
+	}
+
+	// the limit is checked by the insert itself so parallel requests can't slip past it;
+	// reports filed by the server are exempt. every report gets its own row, so resolved reports
+	// of the same target or message keep their outcome; playerReports must not have a unique key
+	// on (uuid, targetUuid, msgId)
+	result, err := db.Exec(`
+INSERT INTO playerReports
+	(uuid, targetUuid, msgId, game, reason, originalMsg, chatContext, timestampReported, actionTaken)
+SELECT ?, ?, ?, ?, ?, ?, ?, NOW(), 0 FROM DUAL
+WHERE ? = ? OR (
+	(SELECT COUNT(*) FROM playerReports WHERE uuid = ? AND timestampReported > DATE_SUB(NOW(), INTERVAL 1 HOUR)) < ? AND
+	(SELECT COUNT(*) FROM playerReports WHERE uuid = ? AND timestampReported > DATE_SUB(NOW(), INTERVAL 1 DAY)) < ?)`,
+		uuid, targetUuid, msgIdLink, config.gameName, urlReplacer.Replace(reason), originalMsg, chatContext,
+		uuid, systemReporterUuid,
+		uuid, config.moderation.reportsPerHour,
+		uuid, config.moderation.reportsPerDay)
+	if err != nil {
+		return msgId, originalMsg, err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return msgId, originalMsg, err
+	}
+	if inserted == 0 {
+		return msgId, originalMsg, errReportRateLimited
 	}
 
-	_, err = db.Exec(`
-REPLACE INTO playerReports
-	(uuid, targetUuid, msgId, game, reason, originalMsg, timestampReported, actionTaken)
-VALUES
-	(?, ?, ?, ?, ?, ?, NOW(), 0)`,
-		uuid, targetUuid, msgIdLink, config.gameName, urlReplacer.Replace(reason), originalMsg)
-	return msgId, originalMsg, err
+	return msgId, originalMsg, nil
 }
 
-func markAsResolved(targetUuid string) {
-	_, err := db.Exec(`UPDATE playerReports SET actionTaken = 1 WHERE targetUuid = ?`, targetUuid)
+// the messages leading up to a reported one, as shown in the report log
+func getReportContext(msgId, game string) string {
+	if msgId == "" {
+		return "-# unavailable"
+	}
+
+	var partyId int
+	err := db.QueryRow("SELECT COALESCE(partyId, 0) FROM chatMessages WHERE msgId = ? AND game = ?", msgId, game).Scan(&partyId)
+	if err != nil {
+		return "-# unavailable"
+	}
+
+	page, err := getChatMessageContext("", msgId, partyId, game, 5, 0, true)
+	if err != nil {
+		log.Printf("getReportContext: %s", err)
+		return "-# unavailable"
+	}
+
+	names := make(map[string]string)
+	for _, player := range page.Players {
+		names[player.Uuid] = player.Name
+	}
+
+	var lines []string
+	for _, msg := range page.Messages {
+		line := fmt.Sprintf("**%s**: %s", names[msg.Uuid], urlReplacer.Replace(msg.Contents))
+		if msg.MsgId == msgId {
+			line = "__" + line + "__"
+		}
+		lines = append(lines, line)
+	}
+
+	// embed fields are limited to 1024 characters, so drop the oldest lines first
+	text := strings.Join(lines, "\n")
+	for len(text) > 1024 && len(lines) > 1 {
+		lines = lines[1:]
+		text = strings.Join(lines, "\n")
+	}
+	if len(text) > 1024 {
+		text = text[:1021] + "..."
+	}
+
+	if text == "" {
+		return "-# unavailable"
+	}
+
+	return text
+}
+
+func markAsResolved(targetUuid, outcome, resolverName string) {
+	_, err := db.Exec(`UPDATE playerReports SET actionTaken = 1, outcome = ?, resolverName = ?, timestampResolved = NOW() WHERE targetUuid = ? AND NOT actionTaken`, outcome, resolverName, targetUuid)
+	if err != nil {
+		log.Printf("markAsResolved: %s", err)
+	}
+
+	err = unclaimReportCase(targetUuid)
 	if err != nil {
 		log.Printf("markAsResolved: %s", err)
 	}
@@ -0,0 +1,608 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	reportStateOpen     = "open"
+	reportStateClaimed  = "claimed"
+	reportStateResolved = "resolved"
+
+	reportOutcomeActioned     = "actioned"
+	reportOutcomeDismissed    = "dismissed"
+	reportOutcomeAcknowledged = "acknowledged" // seen and closed without a verdict; doesn't count towards credibility
+)
+
+// getReporterCredibility as an SQL expression over the reporter uuid in column, for ranking the queue in the database
+const reporterCredibilityExpr = "(SELECT (COUNT(CASE WHEN h.outcome = '" + reportOutcomeActioned + "' THEN 1 END) + 1) / (COUNT(CASE WHEN h.outcome IN ('" + reportOutcomeActioned + "', '" + reportOutcomeDismissed + "') THEN 1 END) + 2) FROM playerReports h WHERE h.uuid = %s)"
+
+// all reports against one player, handled together
+type ReportCase struct {
+	TargetUuid       string                      `json:"targetUuid"`
+	TargetName       string                      `json:"targetName"`
+	State            string                      `json:"state"`
+	ClaimerUuid      string                      `json:"claimerUuid,omitempty"`
+	ClaimerName      string                      `json:"claimerName,omitempty"`
+	TimestampClaimed *time.Time                  `json:"timestampClaimed,omitempty"`
+	Score            float64                     `json:"score"`       // sum of the reporters' credibility
+	LowPriority      bool                        `json:"lowPriority"` // every reporter is below config.moderation.lowCredibility
+	Reports          []*ReportEntry              `json:"reports"`
+	Notes            []*ReportNote               `json:"notes,omitempty"`
+	Context          map[string]*ChatHistoryPage `json:"context,omitempty"` // msgId -> surrounding chat
+}
+
+type ReportEntry struct {
+	ReporterUuid      string     `json:"reporterUuid"`
+	ReporterName      string     `json:"reporterName"`
+	Credibility       float64    `json:"credibility"`
+	Reason            string     `json:"reason"`
+	ReasonText        string     `json:"reasonText"`
+	MsgId             string     `json:"msgId,omitempty"`
+	Game              string     `json:"game"`
+	OriginalMsg       string     `json:"originalMsg,omitempty"`
+	Timestamp         time.Time  `json:"timestamp"`
+	Outcome           string     `json:"outcome,omitempty"`
+	ResolverName      string     `json:"resolverName,omitempty"`
+	TimestampResolved *time.Time `json:"timestampResolved,omitempty"`
+
+	chatContext []byte // snapshot taken when the report was made, for after the chat is pruned
+}
+
+type ReportNote struct {
+	Id         int       `json:"id"`
+	AuthorUuid string    `json:"authorUuid,omitempty"`
+	AuthorName string    `json:"authorName"`
+	Note       string    `json:"note"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// share of a reporter's resolved reports that led to action, smoothed so new reporters start at 0.5
+func getReporterCredibility(uuid string) float64 {
+	var actioned, dismissed int
+	err := db.QueryRow("SELECT COUNT(CASE WHEN outcome = ? THEN 1 END), COUNT(CASE WHEN outcome = ? THEN 1 END) FROM playerReports WHERE uuid = ?", reportOutcomeActioned, reportOutcomeDismissed, uuid).Scan(&actioned, &dismissed)
+	if err != nil {
+		return 0.5
+	}
+
+	return float64(actioned+1) / float64(actioned+dismissed+2)
+}
+
+// whether any open report on targetUuid comes from a reporter above config.moderation.lowCredibility
+func hasCredibleReporter(targetUuid string) (bool, error) {
+	results, err := db.Query("SELECT DISTINCT uuid FROM playerReports WHERE targetUuid = ? AND NOT actionTaken", targetUuid)
+	if err != nil {
+		return false, err
+	}
+
+	defer results.Close()
+
+	var reporterUuids []string
+
+	for results.Next() {
+		var reporterUuid string
+
+		err := results.Scan(&reporterUuid)
+		if err != nil {
+			return false, err
+		}
+
+		reporterUuids = append(reporterUuids, reporterUuid)
+	}
+
+	for _, reporterUuid := range reporterUuids {
+		if getReporterCredibility(reporterUuid) >= config.moderation.lowCredibility {
+			return true, nil
+		}
+	}
+
+	return len(reporterUuids) == 0, nil
+}
+
+// open reports against targetUuid, or those closed by its latest resolution if there are none
+func getReportCase(targetUuid string) (*ReportCase, error) {
+	reportCase := &ReportCase{
+		TargetUuid: targetUuid,
+		TargetName: getNameFromUuid(targetUuid),
+		State:      reportStateOpen,
+		Reports:    []*ReportEntry{},
+	}
+
+	query := "SELECT uuid, reason, COALESCE(msgId, ''), game, originalMsg, timestampReported, COALESCE(outcome, ''), COALESCE(resolverName, ''), timestampResolved, chatContext FROM playerReports WHERE targetUuid = ? AND "
+
+	results, err := db.Query(query+"NOT actionTaken ORDER BY timestampReported", targetUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanReportEntries(results, reportCase)
+	results.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reportCase.Reports) == 0 {
+		reportCase.State = reportStateResolved
+
+		results, err := db.Query(query+"actionTaken AND timestampResolved = (SELECT MAX(timestampResolved) FROM playerReports WHERE targetUuid = ?) ORDER BY timestampReported", targetUuid, targetUuid)
+		if err != nil {
+			return nil, err
+		}
+
+		err = scanReportEntries(results, reportCase)
+		results.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		return reportCase, nil
+	}
+
+	var timestampClaimed time.Time
+	err = db.QueryRow("SELECT claimerUuid, claimerName, timestampClaimed FROM reportClaims WHERE targetUuid = ?", targetUuid).Scan(&reportCase.ClaimerUuid, &reportCase.ClaimerName, &timestampClaimed)
+	if err == nil {
+		reportCase.State = reportStateClaimed
+		reportCase.TimestampClaimed = &timestampClaimed
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return reportCase, nil
+}
+
+func scanReportEntries(results *sql.Rows, reportCase *ReportCase) error {
+	credibility := make(map[string]float64)
+
+	for results.Next() {
+		report := &ReportEntry{}
+
+		err := results.Scan(&report.ReporterUuid, &report.Reason, &report.MsgId, &report.Game, &report.OriginalMsg, &report.Timestamp, &report.Outcome, &report.ResolverName, &report.TimestampResolved, &report.chatContext)
+		if err != nil {
+			return err
+		}
+
+		report.ReasonText = getReadableReportReason(report.Reason)
+
+		if _, ok := credibility[report.ReporterUuid]; !ok {
+			credibility[report.ReporterUuid] = getReporterCredibility(report.ReporterUuid)
+			// each reporter counts once, however many of their reports are in the case
+			reportCase.Score += credibility[report.ReporterUuid]
+		}
+
+		report.ReporterName = getNameFromUuid(report.ReporterUuid)
+		report.Credibility = credibility[report.ReporterUuid]
+
+		reportCase.Reports = append(reportCase.Reports, report)
+	}
+
+	reportCase.LowPriority = len(credibility) != 0
+	for _, reporterCredibility := range credibility {
+		if reporterCredibility >= config.moderation.lowCredibility {
+			reportCase.LowPriority = false
+			break
+		}
+	}
+
+	return nil
+}
+
+// open and claimed cases are ordered by score, resolved ones by when they were resolved.
+// ranking happens in the database so only the requested page of cases is loaded
+func getReportCases(state string, limit, offset int) ([]*ReportCase, error) {
+	var query string
+	var args []any
+	switch state {
+	case reportStateOpen, reportStateClaimed:
+		claimClause := "LEFT JOIN reportClaims rc ON rc.targetUuid = pr.targetUuid WHERE NOT pr.actionTaken AND rc.targetUuid IS NULL"
+		if state == reportStateClaimed {
+			claimClause = "JOIN reportClaims rc ON rc.targetUuid = pr.targetUuid WHERE NOT pr.actionTaken"
+		}
+
+		// each reporter counts once, however many of their reports are in the case;
+		// cases only reported by low credibility reporters are batched at the end
+		query = "SELECT r.targetUuid FROM (SELECT DISTINCT pr.targetUuid, pr.uuid, " + fmt.Sprintf(reporterCredibilityExpr, "pr.uuid") + " AS credibility FROM playerReports pr " + claimClause + ") r GROUP BY r.targetUuid ORDER BY MAX(r.credibility) >= ? DESC, SUM(r.credibility) DESC LIMIT ? OFFSET ?"
+		args = append(args, config.moderation.lowCredibility, limit, offset)
+	case reportStateResolved:
+		query = "SELECT pr.targetUuid FROM playerReports pr WHERE pr.actionTaken AND pr.timestampResolved IS NOT NULL AND NOT EXISTS (SELECT * FROM playerReports pro WHERE pro.targetUuid = pr.targetUuid AND NOT pro.actionTaken) GROUP BY pr.targetUuid ORDER BY MAX(pr.timestampResolved) DESC LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var targetUuids []string
+
+	for results.Next() {
+		var targetUuid string
+
+		err := results.Scan(&targetUuid)
+		if err != nil {
+			results.Close()
+			return nil, err
+		}
+
+		targetUuids = append(targetUuids, targetUuid)
+	}
+
+	results.Close()
+
+	reportCases := []*ReportCase{}
+
+	for _, targetUuid := range targetUuids {
+		reportCase, err := getReportCase(targetUuid)
+		if err != nil {
+			return nil, err
+		}
+
+		reportCases = append(reportCases, reportCase)
+	}
+
+	return reportCases, nil
+}
+
+func getReportNotes(targetUuid string) ([]*ReportNote, error) {
+	results, err := db.Query("SELECT id, COALESCE(authorUuid, ''), authorName, note, timestamp FROM reportNotes WHERE targetUuid = ? ORDER BY id", targetUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer results.Close()
+
+	notes := []*ReportNote{}
+
+	for results.Next() {
+		note := &ReportNote{}
+
+		err := results.Scan(&note.Id, &note.AuthorUuid, &note.AuthorName, &note.Note, &note.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		notes = append(notes, note)
+	}
+
+	return notes, nil
+}
+
+func writeReportNote(targetUuid, authorUuid, authorName, note string) error {
+	var authorUuidArg any
+	if authorUuid != "" {
+		authorUuidArg = authorUuid
+	}
+
+	_, err := db.Exec("INSERT INTO reportNotes (targetUuid, authorUuid, authorName, note, timestamp) VALUES (?, ?, ?, ?, NOW())", targetUuid, authorUuidArg, authorName, note)
+	return err
+}
+
+// claims are exclusive; claiming a case someone else holds fails unless force is set
+func claimReportCase(targetUuid, claimerUuid, claimerName string, force bool) (bool, error) {
+	query := "INSERT INTO reportClaims (targetUuid, claimerUuid, claimerName, timestampClaimed) VALUES (?, ?, ?, NOW()) ON DUPLICATE KEY UPDATE "
+	if force {
+		query += "claimerUuid = VALUES(claimerUuid), claimerName = VALUES(claimerName), timestampClaimed = VALUES(timestampClaimed)"
+	} else {
+		query += "targetUuid = targetUuid"
+	}
+
+	_, err := db.Exec(query, targetUuid, claimerUuid, claimerName)
+	if err != nil {
+		return false, err
+	}
+
+	var currentClaimerUuid string
+	err = db.QueryRow("SELECT claimerUuid FROM reportClaims WHERE targetUuid = ?", targetUuid).Scan(&currentClaimerUuid)
+	if err != nil {
+		return false, err
+	}
+
+	return currentClaimerUuid == claimerUuid, nil
+}
+
+func unclaimReportCase(targetUuid string) error {
+	_, err := db.Exec("DELETE FROM reportClaims WHERE targetUuid = ?", targetUuid)
+	return err
+}
+
+// releases a claim held by claimerUuid, or anyone's if force is set; reports whether there was one to release
+func releaseReportClaim(targetUuid, claimerUuid string, force bool) (bool, error) {
+	query := "DELETE FROM reportClaims WHERE targetUuid = ?"
+	args := []any{targetUuid}
+	if !force {
+		query += " AND claimerUuid = ?"
+		args = append(args, claimerUuid)
+	}
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	released, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return released != 0, nil
+}
+
+// the chat around a reported message, taken when the report is made since chat is pruned long before reports are
+func snapshotReportContext(msgId string, partyId int, game string) []byte {
+	page, err := getChatMessageContext("", msgId, partyId, game, 10, 0, true)
+	if err != nil {
+		return nil
+	}
+
+	pageJson, err := json.Marshal(page)
+	if err != nil {
+		return nil
+	}
+
+	return pageJson
+}
+
+func hasOpenReports(targetUuid string) (bool, error) {
+	var open bool
+	err := db.QueryRow("SELECT EXISTS (SELECT * FROM playerReports WHERE targetUuid = ? AND NOT actionTaken)", targetUuid).Scan(&open)
+	return open, err
+}
+
+// closes the report log messages for targetUuid in the moderation channel, if the bot is running
+func closeReportLogMainServer(targetUuid, content string) error {
+	reportLogMtx.Lock()
+	defer reportLogMtx.Unlock()
+
+	if bot == nil || config.moderation.botToken == "" || config.moderation.channelId == "" {
+		delete(reportLog, targetUuid)
+		return nil
+	}
+
+	var errs []error
+
+	for _, discordMsgId := range reportLog[targetUuid] {
+		payload := discordgo.NewMessageEdit(config.moderation.channelId, discordMsgId)
+		payload.Content = &content
+		payload.Components = &[]discordgo.MessageComponent{}
+
+		_, err := bot.ChannelMessageEditComplex(payload)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	delete(reportLog, targetUuid)
+
+	if len(errs) != 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+func adminReports(w http.ResponseWriter, r *http.Request) {
+	uuid, name, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, permHandleReports) {
+		handleError(w, r, "access denied")
+		return
+	}
+
+	query := r.URL.Query()
+
+	if r.URL.Path == "/admin/reports" {
+		state := query.Get("state")
+		if state == "" {
+			state = reportStateOpen
+		}
+		if state != reportStateOpen && state != reportStateClaimed && state != reportStateResolved {
+			handleError(w, r, "invalid state")
+			return
+		}
+
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > 100 {
+			limit = 50
+		}
+
+		offset, err := strconv.Atoi(query.Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0
+		}
+
+		reportCases, err := getReportCases(state, limit, offset)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		reportCasesJson, err := json.Marshal(reportCases)
+		if err != nil {
+			handleError(w, r, "error while marshaling")
+			return
+		}
+
+		w.Write(reportCasesJson)
+		return
+	}
+
+	targetUuid := query.Get("target")
+	if targetUuid == "" {
+		handleError(w, r, "target not specified")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/admin/reports/case":
+		reportCase, err := getReportCase(targetUuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		reportCase.Notes, err = getReportNotes(targetUuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		reportCase.Context = make(map[string]*ChatHistoryPage)
+		for _, report := range reportCase.Reports {
+			if report.MsgId == "" {
+				continue
+			}
+			if _, ok := reportCase.Context[report.MsgId]; ok {
+				continue
+			}
+
+			var partyId int
+			err := db.QueryRow("SELECT COALESCE(partyId, 0) FROM chatMessages WHERE msgId = ? AND game = ?", report.MsgId, report.Game).Scan(&partyId)
+			if err != nil {
+				// pruned since, so fall back to what was around it when it was reported
+				if len(report.chatContext) != 0 {
+					page := newChatHistoryPage()
+					if json.Unmarshal(report.chatContext, page) == nil {
+						reportCase.Context[report.MsgId] = page
+					}
+				}
+				continue
+			}
+
+			reportCase.Context[report.MsgId], err = getChatMessageContext("", report.MsgId, partyId, report.Game, 10, 5, true)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+		}
+
+		reportCaseJson, err := json.Marshal(reportCase)
+		if err != nil {
+			handleError(w, r, "error while marshaling")
+			return
+		}
+
+		w.Write(reportCaseJson)
+		return
+	case "/admin/reports/claim":
+		open, err := hasOpenReports(targetUuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if !open {
+			handleError(w, r, "no open reports for target")
+			return
+		}
+
+		claimed, err := claimReportCase(targetUuid, uuid, name, query.Has("force"))
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if !claimed {
+			handleError(w, r, "case already claimed")
+			return
+		}
+
+		writeModAuditLog(uuid, name, targetUuid, "claim_reports", "", auditSourceWeb, nil)
+	case "/admin/reports/unclaim":
+		// someone else's claim can only be released on purpose, and that is recorded as such
+		force := query.Has("force")
+
+		released, err := releaseReportClaim(targetUuid, uuid, force)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if !released {
+			handleError(w, r, "case not claimed by player")
+			return
+		}
+
+		action := "unclaim_reports"
+		if force {
+			action = "force_unclaim_reports"
+		}
+		writeModAuditLog(uuid, name, targetUuid, action, "", auditSourceWeb, nil)
+	case "/admin/reports/note":
+		note := strings.TrimSpace(query.Get("note"))
+		if note == "" || len(note) > 1000 {
+			handleError(w, r, "invalid note")
+			return
+		}
+
+		err := writeReportNote(targetUuid, uuid, name, note)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		writeModAuditLog(uuid, name, targetUuid, "note_reports", note, auditSourceWeb, nil)
+	case "/admin/reports/resolve":
+		outcome := query.Get("outcome")
+		if outcome != reportOutcomeActioned && outcome != reportOutcomeDismissed {
+			handleError(w, r, "invalid outcome")
+			return
+		}
+
+		open, err := hasOpenReports(targetUuid)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+		if !open {
+			handleError(w, r, "no open reports for target")
+			return
+		}
+
+		if note := strings.TrimSpace(query.Get("note")); note != "" {
+			if len(note) > 1000 {
+				handleError(w, r, "invalid note")
+				return
+			}
+
+			err = writeReportNote(targetUuid, uuid, name, note)
+			if err != nil {
+				handleInternalError(w, r, err)
+				return
+			}
+		}
+
+		markAsResolved(targetUuid, outcome, name)
+
+		err = closeReportLog(targetUuid, "*Reports on "+getNameFromUuid(targetUuid)+" "+outcome+" by "+name+" from the web queue*")
+		if err != nil {
+			writeErrLog(uuid, r.URL.Path, "closeReportLog failed: "+err.Error())
+		}
+
+		writeModAuditLog(uuid, name, targetUuid, "resolve_reports", outcome, auditSourceWeb, nil)
+	default:
+		handleError(w, r, "unknown command")
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
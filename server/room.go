@@ -160,7 +160,7 @@ func (c *RoomClient) joinRoom(room *Room) {
 
 	c.outbox <- buildMsg("ri", c.room.id) // tell client they've switched rooms serverside
 
-	if config.gameName == "2kki" && c.session.rank == 0 {
+	if config.gameName == "2kki" && !can(c.session.uuid, permBypassDebugChecks) {
 		c.outbox <- buildMsg("ss", 11, 2)
 	}
 	if config.flags.unconscious {
@@ -184,6 +184,8 @@ func (c *RoomClient) joinRoom(room *Room) {
 	if c.session.account {
 		c.getRoomEventData()
 	}
+
+	c.session.publishPresence(presenceMap)
 }
 
 func (c *RoomClient) leaveRoom() {
@@ -386,7 +388,7 @@ func (c *RoomClient) getRoomEventData() {
 	c.checkRoomConditions("", "")
 
 	for _, minigame := range c.room.minigames {
-		if minigame.Dev && c.session.rank < 1 {
+		if minigame.Dev && !can(c.session.uuid, permPlayDevMinigames) {
 			continue
 		}
 		score, err := getPlayerMinigameScore(c.session.uuid, minigame.Id)
@@ -0,0 +1,288 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sanctionWarn = "warn"
+	sanctionMute = "mute"
+	sanctionBan  = "ban"
+)
+
+type SanctionStep struct {
+	action   string
+	duration time.Duration // zero for permanent mutes and bans
+}
+
+type Sanction struct {
+	Action string     `json:"action"`
+	Level  int        `json:"level"`
+	Expiry *time.Time `json:"expiry,omitempty"`
+}
+
+// parses a ladder step such as "warn", "mute 1h" or "ban"
+func parseSanctionStep(str string) (step SanctionStep, err error) {
+	action, durationString, _ := strings.Cut(strings.TrimSpace(str), " ")
+
+	switch action {
+	case sanctionWarn, sanctionMute, sanctionBan:
+		step.action = action
+	default:
+		return step, fmt.Errorf("invalid sanction action %q", action)
+	}
+
+	if durationString != "" {
+		if action == sanctionWarn {
+			return step, errors.New("warnings cannot have a duration")
+		}
+
+		step.duration, err = time.ParseDuration(strings.TrimSpace(durationString))
+		if err != nil {
+			return step, err
+		}
+	}
+
+	return step, nil
+}
+
+// returns the ladder position for the player's next sanction, based on how many they received within the window
+func getNextSanctionStep(uuid string) (level int, step SanctionStep, err error) {
+	err = db.QueryRow("SELECT COUNT(*) FROM playerSanctions WHERE uuid = ? AND timestamp > ?", uuid, time.Now().UTC().Add(-config.sanctions.window)).Scan(&level)
+	if err != nil {
+		return 0, step, err
+	}
+
+	ladder := config.sanctions.ladder
+	if level >= len(ladder) {
+		level = len(ladder) - 1
+	}
+
+	return level, ladder[level], nil
+}
+
+func writePlayerSanction(uuid, action, reason string, expiry *time.Time) error {
+	var expiryArg any
+	if expiry != nil {
+		expiryArg = expiry.UTC()
+	}
+
+	_, err := db.Exec("INSERT INTO playerSanctions (uuid, action, reason, timestamp, expiry, notified) VALUES (?, ?, ?, UTC_TIMESTAMP(), ?, 0)", uuid, action, reason, expiryArg)
+	if err != nil {
+		return err
+	}
+
+	// deliver right away if the player is here, otherwise on their next connection to any game
+	if client, ok := clients.Load(uuid); ok {
+		return client.sendSanctionNotices()
+	}
+
+	return nil
+}
+
+func warnPlayer(actorUuid, actorName, targetUuid, reason, source string) error {
+	err := writePlayerSanction(targetUuid, sanctionWarn, reason, nil)
+	if err != nil {
+		return err
+	}
+
+	writeModAuditLog(actorUuid, actorName, targetUuid, sanctionWarn, reason, source, nil)
+
+	return nil
+}
+
+// applies a step of the sanctions ladder, as returned by getNextSanctionStep, to the player in every game;
+// the step is passed in so it can't escalate past what the caller checked permission for
+func applySanction(actorUuid, actorName, targetUuid, reason, source string, level int, step SanctionStep) (*Sanction, error) {
+	sanction := &Sanction{Action: step.action, Level: level}
+	if step.duration > 0 {
+		expiry := time.Now().Add(step.duration)
+		sanction.Expiry = &expiry
+	}
+	temporary := sanction.Expiry != nil
+
+	var errs []error
+
+	// as with the report bot, games that can't be reached pick the change up from the database on reconnect
+	switch step.action {
+	case sanctionMute:
+		mutePlayerInAllGamesUnchecked(targetUuid, temporary, false)
+		if temporary {
+			errs = append(errs, registerModAction(targetUuid, actionMute, *sanction.Expiry, reason))
+		}
+	case sanctionBan:
+		banPlayerInAllGamesUnchecked(targetUuid, true, temporary, false)
+		if temporary {
+			errs = append(errs, registerModAction(targetUuid, actionBan, *sanction.Expiry, reason))
+		}
+	}
+
+	errs = append(errs, writePlayerSanction(targetUuid, step.action, reason, sanction.Expiry))
+
+	writeModAuditLog(actorUuid, actorName, targetUuid, step.action, fmt.Sprintf("sanction level %d: %s", level+1, reason), source, sanction.Expiry)
+
+	return sanction, errors.Join(errs...)
+}
+
+func (c *SessionClient) sendSanctionNotices() error {
+	results, err := db.Query("SELECT action, reason, expiry FROM playerSanctions WHERE uuid = ? AND notified = 0 ORDER BY timestamp", c.uuid)
+	if err != nil {
+		return err
+	}
+
+	var notices []string
+
+	for results.Next() {
+		var action, reason string
+		var expiry *time.Time
+
+		err := results.Scan(&action, &reason, &expiry)
+		if err != nil {
+			results.Close()
+			return err
+		}
+
+		var notice string
+		switch action {
+		case sanctionWarn:
+			notice = "You have received a warning from a moderator."
+		case sanctionMute:
+			if expiry != nil {
+				notice = fmt.Sprintf("You have been muted until %s.", expiry.UTC().Format("2006-01-02 15:04 MST"))
+			} else {
+				notice = "You have been muted."
+			}
+		default:
+			continue
+		}
+
+		if reason != "" {
+			notice += " Reason: " + reason
+		}
+
+		notices = append(notices, notice)
+	}
+
+	results.Close()
+
+	for _, notice := range notices {
+		systemMessage(notice, c.uuid)
+	}
+
+	_, err = db.Exec("UPDATE playerSanctions SET notified = 1 WHERE uuid = ? AND notified = 0", c.uuid)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func adminSanction(w http.ResponseWriter, r *http.Request) {
+	uuid, name, _, _, _, _ := getPlayerDataFromToken(r.Header.Get("Authorization"))
+	if !can(uuid, permWarn) {
+		handleError(w, r, "access denied")
+		return
+	}
+
+	query := r.URL.Query()
+
+	targetUuid := query.Get("uuid")
+	if targetUuid == "" {
+		user := query.Get("user")
+		if user == "" {
+			handleError(w, r, "uuid or user not specified")
+			return
+		}
+
+		userUuid, err := getUuidFromName(user)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		if userUuid == "" {
+			handleError(w, r, "invalid user specified")
+			return
+		}
+
+		targetUuid = userUuid
+	}
+
+	if targetUuid == uuid {
+		handleError(w, r, "attempted self-sanction")
+		return
+	}
+
+	reason := query.Get("reason")
+
+	if r.URL.Path == "/admin/warn" {
+		if !canActOn(uuid, targetUuid, permWarn) {
+			handleError(w, r, "insufficient rank")
+			return
+		}
+
+		err := warnPlayer(uuid, name, targetUuid, reason, auditSourceWeb)
+		if err != nil {
+			handleInternalError(w, r, err)
+			return
+		}
+
+		w.Write([]byte("ok"))
+		return
+	}
+
+	level, step, err := getNextSanctionStep(targetUuid)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	perm := permWarn
+	switch step.action {
+	case sanctionMute:
+		perm = permMute
+	case sanctionBan:
+		perm = permBan
+	}
+
+	if !canActOn(uuid, targetUuid, perm) {
+		handleError(w, r, "insufficient rank")
+		return
+	}
+
+	sanction, err := applySanction(uuid, name, targetUuid, reason, auditSourceWeb, level, step)
+	if err != nil {
+		handleInternalError(w, r, err)
+		return
+	}
+
+	sanctionJson, err := json.Marshal(sanction)
+	if err != nil {
+		handleError(w, r, "error while marshaling")
+		return
+	}
+
+	w.Write(sanctionJson)
+}
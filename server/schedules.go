@@ -81,7 +81,6 @@ func initSchedules() {
 func handleSchedules(w http.ResponseWriter, r *http.Request) {
 	var uuid string
 	var banned bool
-	var rank int
 
 	commandParam := r.URL.Query().Get("command")
 	if commandParam == "" {
@@ -97,7 +96,7 @@ func handleSchedules(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		uuid, _, rank, _, banned, _ = getPlayerDataFromToken(token)
+		uuid, _, _, _, banned, _ = getPlayerDataFromToken(token)
 		if uuid == "" {
 			handleError(w, r, "invalid token")
 			return
@@ -111,7 +110,7 @@ func handleSchedules(w http.ResponseWriter, r *http.Request) {
 
 	switch commandParam {
 	case "list":
-		schedules, err := listSchedules(uuid, rank)
+		schedules, err := listSchedules(uuid)
 		if err != nil {
 			handleError(w, r, "error listing schedules: "+err.Error())
 			return
@@ -185,7 +184,7 @@ func handleSchedules(w http.ResponseWriter, r *http.Request) {
 				Bilibili: query.Get("bilibili"),
 			},
 		}
-		id, err = updateSchedule(id, rank, uuid, payload)
+		id, err = updateSchedule(id, uuid, payload)
 		if err != nil {
 			fmt.Printf("updateSchedules: %s", err)
 			handleError(w, r, fmt.Sprintf("error creating/updating schedule: %s", err))
@@ -213,7 +212,7 @@ func handleSchedules(w http.ResponseWriter, r *http.Request) {
 			handleError(w, r, "invalid scheduleId")
 			return
 		}
-		err = cancelSchedule(uuid, rank, scheduleId)
+		err = cancelSchedule(uuid, scheduleId)
 		if err != nil {
 			fmt.Printf("cancelSchedules: %s", err)
 			handleError(w, r, "error cancelling schedule")
@@ -234,7 +233,7 @@ func clampDatetime(datetime, now time.Time) time.Time {
 	return datetime
 }
 
-func listSchedules(uuid string, rank int) ([]*ScheduleDisplay, error) {
+func listSchedules(uuid string) ([]*ScheduleDisplay, error) {
 	var schedules []*ScheduleDisplay
 	partyId, err := getPlayerPartyId(uuid)
 	if err != nil {
@@ -253,7 +252,7 @@ JOIN players pd ON pd.uuid = s.ownerUuid
 LEFT JOIN tally ON tally.scheduleId = s.id
 WHERE COALESCE(s.partyId, 0) IN (0, ?) OR ?`
 
-	results, err := db.Query(query, uuid, config.gameName, partyId, rank > 0)
+	results, err := db.Query(query, uuid, config.gameName, partyId, can(uuid, permEditSchedules))
 	if err != nil {
 		return schedules, err
 	}
@@ -270,8 +269,11 @@ WHERE COALESCE(s.partyId, 0) IN (0, ?) OR ?`
 	return schedules, nil
 }
 
-func updateSchedule(id int, rank int, uuid string, s *ScheduleUpdate) (int, error) {
+func updateSchedule(id int, uuid string, s *ScheduleUpdate) (int, error) {
+	isMod := can(uuid, permEditSchedules)
 	if id == 0 {
+		// only staff can create official schedules
+		s.Official = s.Official && isMod
 		query := `
 INSERT INTO schedules
 	(name, description, ownerUuid, partyId, game, official, recurring, intervalValue, intervalType, datetime, systemName, discord, youtube, twitch, niconico, openrec, bilibili)
@@ -291,7 +293,6 @@ VALUES
 		return int(idLarge), nil
 	}
 
-	isMod := rank > 0
 	query := `
 UPDATE schedules SET
 	name = ?, description = ?, partyId = ?, game = ?, recurring = ?, intervalValue = ?, intervalType = ?, datetime = ?, systemName = ?,
@@ -387,8 +388,8 @@ func followSchedule(uuid string, scheduleId int, shouldFollow bool) (followCount
 	return followCount, err
 }
 
-func cancelSchedule(uuid string, rank int, scheduleId int) error {
-	_, err := db.Exec("DELETE FROM schedules WHERE id = (SELECT id FROM schedules WHERE id = ? AND (? OR ownerUuid = ?))", scheduleId, rank > 0, uuid)
+func cancelSchedule(uuid string, scheduleId int) error {
+	_, err := db.Exec("DELETE FROM schedules WHERE id = (SELECT id FROM schedules WHERE id = ? AND (? OR ownerUuid = ?))", scheduleId, can(uuid, permEditSchedules), uuid)
 	if err == nil {
 		if timer, ok := timers[scheduleId]; ok && timer != nil {
 			timer.Stop()
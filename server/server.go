@@ -62,7 +62,7 @@ var (
 	}
 
 	isOkString = regexp.MustCompile("^[A-Za-z0-9]+$").MatchString
-	wordFilter *regexp.Regexp
+	wordFilter *WordFilter
 )
 
 func Start() {
@@ -103,14 +103,23 @@ func Start() {
 	log.SetFlags(log.Ldate | log.Ltime)
 
 	initApi()
+	initLogins()
+	initPermissions()
+	initAccounts()
 	initHistory()
+	initDirectMessages()
+	initChatCommands()
+	initChatSearch()
+	initParties()
 	initScreenshots()
 	initLocations()
 	initSchedules()
 	initEvents()
 	initBadges()
 	initSession()
+	initPresence()
 	initReports()
+	initIdentities()
 	initRpc()
 
 	if config.flags.unconscious {
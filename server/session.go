@@ -53,11 +53,6 @@ func initSession() {
 		}
 	})
 
-	scheduler.Every(10).Seconds().Do(func() {
-		sendPartyUpdate()
-		sendFriendsUpdate()
-	})
-
 	scheduler.Cron("0 2,8,14,20 * * *").Do(func() {
 		writeGamePlayerCount(clients.GetAmount())
 	})
@@ -112,7 +107,24 @@ func joinSessionWs(conn *websocket.Conn, ip string, token string) {
 		c.uuid, c.banned, c.muted = getOrCreatePlayerData(ip)
 	}
 
+	if c.account {
+		var err error
+		c.roles, err = getPlayerRoles(c.uuid)
+		if err != nil {
+			writeErrLog(c.uuid, "sess", err.Error())
+		}
+
+		c.registered, err = getAccountRegistrationTime(c.uuid)
+		if err != nil {
+			writeErrLog(c.uuid, "sess", err.Error())
+		}
+	}
+
+	c.shadowMuted = getPlayerShadowMuted(c.uuid)
+
+	partiesMutex.Lock()
 	c.cacheParty() // don't log error because player is probably not in a party
+	partiesMutex.Unlock()
 
 	if client, ok := clients.Load(c.uuid); ok {
 		client.cancel()
@@ -160,6 +172,43 @@ func joinSessionWs(conn *websocket.Conn, ip string, token string) {
 		writeErrLog(c.uuid, "sess", err.Error())
 	}
 
+	err = presence.Watch(c)
+	if err != nil {
+		writeErrLog(c.uuid, "sess", err.Error())
+	}
+
+	c.publishPresence(presenceOnline)
+
+	err = recordIpIdentitySignals(c.uuid, c.ip)
+	if err != nil {
+		writeErrLog(c.uuid, "sess", err.Error())
+	}
+
+	// compares the identity against every other one sharing its signals, so it's kept off the connect path
+	go func(uuid string) {
+		err := checkLinkedBannedIdentities(uuid)
+		if err != nil {
+			writeErrLog(uuid, "sess", err.Error())
+		}
+	}(c.uuid)
+
+	if c.account {
+		err = c.sendLoginLockoutNotices()
+		if err != nil {
+			writeErrLog(c.uuid, "sess", err.Error())
+		}
+
+		err = c.sendAccountDeletionNotice()
+		if err != nil {
+			writeErrLog(c.uuid, "sess", err.Error())
+		}
+	}
+
+	err = c.sendSanctionNotices()
+	if err != nil {
+		writeErrLog(c.uuid, "sess", err.Error())
+	}
+
 	writeLog(c.uuid, "sess", "connect", 200)
 }
 
@@ -218,6 +267,16 @@ func (c *SessionClient) processMsg(msg []byte) (err error) {
 	case "gsay", "psay": // global say and party say
 		err = c.handleGPSay(msgFields)
 		updateGameActivity = true
+	case "asay": // all games say
+		err = c.handleAsay(msgFields)
+		updateGameActivity = true
+	case "dm": // direct message
+		err = c.handleDm(msgFields)
+		updateGameActivity = true
+	case "gdel": // delete chat message
+		err = c.handleGdel(msgFields)
+	case "gedit": // edit chat message
+		err = c.handleGedit(msgFields)
 	case "l": // enter location(s)
 		err = c.handleL(msgFields)
 		updateGameActivity = true
@@ -251,6 +310,14 @@ func (c *SessionClient) processMsg(msg []byte) (err error) {
 	case "hunp": // hide unnamed players
 		err = c.handleHunp(msgFields)
 		updateGameActivity = true
+	case "pmk": // place party marker
+		err = c.handlePmk(msgFields)
+	case "pmkd": // remove party marker
+		err = c.handlePmkd(msgFields)
+	case "pmkl": // party marker list
+		err = c.handlePmkl()
+	case "ac": // all games chat opt-in
+		err = c.handleAc(msgFields)
 	default:
 		err = errors.New("unknown message type")
 	}
@@ -2,39 +2,373 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	wordFilterCensor = "censor" // replaced in the message
+	wordFilterFlag   = "flag"   // let through, but reported for review
+	wordFilterBlock  = "block"  // the whole message is dropped
+
+	wordFilterReplacement = ":2kkiSign:"
 )
 
+// filterwords.yml, or every .yml file under filterwords/ (one per language), in this format:
+//
+//	exceptions: [scunthorpe]
+//	words:
+//	  - word: example
+//	    severity: block     # censor (default), flag or block
+//	    match: substring    # word (default) or substring
+//	  - regex: "ex[a4]mple"
+//
+// words and exceptions are normalised the same way as messages, so lists only need plain spellings.
+// the legacy filterwords.txt, one regex per line, is still read when neither exists
+type WordFilterFile struct {
+	Exceptions []string         `yaml:"exceptions"`
+	Words      []*WordFilterRaw `yaml:"words"`
+}
+
+type WordFilterRaw struct {
+	Word     string `yaml:"word"`
+	Regex    string `yaml:"regex"`
+	Severity string `yaml:"severity"`
+	Match    string `yaml:"match"`
+
+	legacy bool
+}
+
+type WordFilterEntry struct {
+	pattern   *regexp.Regexp
+	severity  string
+	wholeWord bool
+	legacy    bool // matched against the message as typed, since old patterns were written for it
+}
+
+type WordFilter struct {
+	entries    []*WordFilterEntry
+	exceptions []string
+}
+
+type WordFilterResult struct {
+	Contents string
+	Blocked  bool
+	Flagged  []string
+}
+
+// lookalikes folded onto the letter they usually stand in for
+var leetReplacer = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's', '!': 'i', '|': 'l', '+': 't',
+}
+
+// precomposed accented letters folded onto their base letter, since there's no decomposition table at hand
+var diacriticFolds = func() map[rune]rune {
+	folds := make(map[rune]rune)
+	for base, accented := range map[rune]string{
+		'a': "àáâãäåāăą", 'c': "çćĉċč", 'd': "ďđ", 'e': "èéêëēĕėęě", 'g': "ĝğġģ", 'h': "ĥħ",
+		'i': "ìíîïĩīĭįı", 'j': "ĵ", 'k': "ķ", 'l': "ĺļľŀł", 'n': "ñńņňŉ", 'o': "òóôõöøōŏő",
+		'r': "ŕŗř", 's': "śŝşšß", 't': "ţťŧ", 'u': "ùúûüũūŭůűų", 'w': "ŵ", 'y': "ýÿŷ", 'z': "źżž",
+	} {
+		for _, r := range accented {
+			folds[r] = base
+		}
+	}
+	return folds
+}()
+
 func setWordFilter() error {
-	data, err := os.Open("filterwords.txt")
+	filter, err := loadWordFilter()
 	if err != nil {
 		return err
 	}
 
-	scanner := bufio.NewScanner(data)
+	wordFilter = filter
 
-	scanner.Split(bufio.ScanLines)
+	return nil
+}
 
-	regexStr := "(?i)("
+func loadWordFilter() (*WordFilter, error) {
+	var files []string
+	if _, err := os.Stat("filterwords.yml"); err == nil {
+		files = append(files, "filterwords.yml")
+	}
+	langFiles, _ := filepath.Glob("filterwords/*.yml")
+	files = append(files, langFiles...)
 
-	var wordAdded bool
-	for scanner.Scan() {
-		if wordAdded {
-			regexStr += "|"
+	if len(files) == 0 {
+		return loadLegacyWordFilter("filterwords.txt")
+	}
+
+	filter := &WordFilter{}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
 		}
 
-		regexStr += scanner.Text()
+		var filterFile WordFilterFile
+		err = yaml.Unmarshal(data, &filterFile)
+		if err != nil {
+			return nil, errors.Join(errors.New(file), err)
+		}
 
-		wordAdded = true
+		err = filter.add(&filterFile)
+		if err != nil {
+			return nil, errors.Join(errors.New(file), err)
+		}
 	}
 
-	regex, err := regexp.Compile(regexStr + ")")
+	return filter, nil
+}
+
+func loadLegacyWordFilter(filename string) (*WordFilter, error) {
+	data, err := os.Open(filename)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	defer data.Close()
+
+	var filterFile WordFilterFile
+
+	scanner := bufio.NewScanner(data)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			filterFile.Words = append(filterFile.Words, &WordFilterRaw{Regex: line, Match: "substring", legacy: true})
+		}
+	}
+
+	filter := &WordFilter{}
+
+	return filter, filter.add(&filterFile)
+}
+
+func (f *WordFilter) add(filterFile *WordFilterFile) error {
+	for _, exception := range filterFile.Exceptions {
+		if exception = normalizeFilterText(exception).text; exception != "" {
+			f.exceptions = append(f.exceptions, exception)
+		}
 	}
 
-	wordFilter = regex
+	for _, raw := range filterFile.Words {
+		entry := &WordFilterEntry{
+			severity:  raw.Severity,
+			wholeWord: raw.Match != "substring",
+			legacy:    raw.legacy,
+		}
+
+		switch entry.severity {
+		case "":
+			entry.severity = wordFilterCensor
+		case wordFilterCensor, wordFilterFlag, wordFilterBlock:
+		default:
+			return errors.New("invalid severity " + raw.Severity)
+		}
+
+		expr := raw.Regex
+		if expr == "" {
+			word := normalizeFilterText(raw.Word).text
+			if word == "" {
+				continue
+			}
+			expr = regexp.QuoteMeta(word)
+		}
+
+		pattern, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return err
+		}
+
+		entry.pattern = pattern
+		f.entries = append(f.entries, entry)
+	}
 
 	return nil
 }
+
+type normalizedText struct {
+	text string
+	// for each byte of text, the span of the original string it came from
+	starts, ends []int
+}
+
+// lowercases, folds fullwidth and leet characters, and drops combining marks and invisible characters
+func normalizeFilterText(s string) normalizedText {
+	var n normalizedText
+	var b strings.Builder
+
+	for i, r := range s {
+		end := i + utf8.RuneLen(r)
+
+		switch {
+		case unicode.Is(unicode.Mn, r), unicode.Is(unicode.Cf, r):
+			// attach to the previous character so censoring removes it as well
+			if len(n.ends) > 0 {
+				last := n.ends[len(n.ends)-1]
+				for j := len(n.ends) - 1; j >= 0 && n.ends[j] == last; j-- {
+					n.ends[j] = end
+				}
+			}
+			continue
+		case r >= 0xFF01 && r <= 0xFF5E:
+			r -= 0xFEE0
+		}
+
+		r = unicode.ToLower(r)
+		if replacement, ok := leetReplacer[r]; ok {
+			r = replacement
+		} else if replacement, ok := diacriticFolds[r]; ok {
+			r = replacement
+		}
+
+		size, _ := b.WriteRune(r)
+		for j := 0; j < size; j++ {
+			n.starts = append(n.starts, i)
+			n.ends = append(n.ends, end)
+		}
+	}
+
+	n.text = b.String()
+
+	return n
+}
+
+func isFilterWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// reports whether text[start:end] sits on word boundaries
+func isWholeWordMatch(text string, start, end int) bool {
+	if start > 0 {
+		if r, _ := utf8.DecodeLastRuneInString(text[:start]); isFilterWordChar(r) {
+			return false
+		}
+	}
+
+	if end < len(text) {
+		if r, _ := utf8.DecodeRuneInString(text[end:]); isFilterWordChar(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// returns the spans of text covered by an exception, such as a place name containing a filtered word
+func (f *WordFilter) getExceptionSpans(text string) (spans [][2]int) {
+	for _, exception := range f.exceptions {
+		for offset := 0; ; {
+			i := strings.Index(text[offset:], exception)
+			if i < 0 {
+				break
+			}
+			spans = append(spans, [2]int{offset + i, offset + i + len(exception)})
+			offset += i + len(exception)
+		}
+	}
+
+	return spans
+}
+
+func (f *WordFilter) Filter(s string) WordFilterResult {
+	result := WordFilterResult{Contents: s}
+	if f == nil {
+		return result
+	}
+
+	n := normalizeFilterText(s)
+	exceptionSpans := f.getExceptionSpans(n.text)
+
+	// original byte spans to replace, in no particular order
+	var censored [][2]int
+
+	for _, entry := range f.entries {
+		text := n.text
+		if entry.legacy {
+			text = s
+		}
+
+		for _, match := range entry.pattern.FindAllStringIndex(text, -1) {
+			if match[0] == match[1] {
+				continue
+			}
+
+			start, end := match[0], match[1]
+			if !entry.legacy {
+				start, end = n.starts[match[0]], n.ends[match[1]-1]
+			}
+
+			// boundaries are checked on the message as typed, where a trailing '!' is not a letter
+			if entry.wholeWord && !isWholeWordMatch(s, start, end) {
+				continue
+			}
+
+			if !entry.legacy {
+				// leet folding would otherwise turn plain numbers like scores and map ids into words
+				if !strings.ContainsFunc(s[start:end], unicode.IsLetter) {
+					continue
+				}
+
+				excepted := false
+				for _, span := range exceptionSpans {
+					if match[0] >= span[0] && match[1] <= span[1] {
+						excepted = true
+						break
+					}
+				}
+				if excepted {
+					continue
+				}
+			}
+
+			switch entry.severity {
+			case wordFilterBlock:
+				result.Blocked = true
+			case wordFilterFlag:
+				result.Flagged = append(result.Flagged, s[start:end])
+			default:
+				censored = append(censored, [2]int{start, end})
+			}
+		}
+	}
+
+	if len(censored) == 0 {
+		return result
+	}
+
+	// merge overlapping spans so each censored stretch gets a single replacement
+	covered := make([]bool, len(s))
+	for _, span := range censored {
+		for i := span[0]; i < span[1]; i++ {
+			covered[i] = true
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if !covered[i] {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+
+		b.WriteString(wordFilterReplacement)
+		for i < len(s) && covered[i] {
+			i++
+		}
+	}
+
+	result.Contents = b.String()
+
+	return result
+}
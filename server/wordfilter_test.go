@@ -0,0 +1,199 @@
+/*
+	Copyright (C) 2021-2024  The YNOproject Developers
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func newTestWordFilter(t *testing.T, filterFile *WordFilterFile) *WordFilter {
+	t.Helper()
+
+	filter := &WordFilter{}
+	if err := filter.add(filterFile); err != nil {
+		t.Fatal(err)
+	}
+
+	return filter
+}
+
+func TestWordFilterSeverity(t *testing.T) {
+	filter := newTestWordFilter(t, &WordFilterFile{
+		Words: []*WordFilterRaw{
+			{Word: "darn"},
+			{Word: "spoiler", Severity: wordFilterFlag},
+			{Word: "slur", Severity: wordFilterBlock},
+		},
+	})
+
+	tests := []struct {
+		in       string
+		contents string
+		blocked  bool
+		flagged  []string
+	}{
+		{"hello there", "hello there", false, nil},
+		{"oh darn it", "oh " + wordFilterReplacement + " it", false, nil},
+		{"big spoiler ahead", "big spoiler ahead", false, []string{"spoiler"}},
+		{"some slur here", "some slur here", true, nil},
+		{"darn slur", wordFilterReplacement + " slur", true, nil},
+	}
+
+	for _, tt := range tests {
+		result := filter.Filter(tt.in)
+		if result.Contents != tt.contents || result.Blocked != tt.blocked || !slices.Equal(result.Flagged, tt.flagged) {
+			t.Errorf("Filter(%q) = %+v, want contents %q, blocked %v, flagged %v", tt.in, result, tt.contents, tt.blocked, tt.flagged)
+		}
+	}
+}
+
+func TestWordFilterMatch(t *testing.T) {
+	filter := newTestWordFilter(t, &WordFilterFile{
+		Words: []*WordFilterRaw{
+			{Word: "ass"},
+			{Word: "heck", Match: "substring"},
+		},
+	})
+
+	tests := []struct {
+		in       string
+		contents string
+	}{
+		{"ass", wordFilterReplacement},
+		{"what an ass!", "what an " + wordFilterReplacement + "!"},
+		{"a classic assembly", "a classic assembly"},
+		{"heck", wordFilterReplacement},
+		{"checking", "c" + wordFilterReplacement + "ing"},
+	}
+
+	for _, tt := range tests {
+		if contents := filter.Filter(tt.in).Contents; contents != tt.contents {
+			t.Errorf("Filter(%q).Contents = %q, want %q", tt.in, contents, tt.contents)
+		}
+	}
+}
+
+func TestWordFilterExceptions(t *testing.T) {
+	filter := newTestWordFilter(t, &WordFilterFile{
+		Exceptions: []string{"scunthorpe"},
+		Words: []*WordFilterRaw{
+			{Word: "cunt", Match: "substring"},
+		},
+	})
+
+	tests := []struct {
+		in       string
+		contents string
+	}{
+		{"visiting Scunthorpe today", "visiting Scunthorpe today"},
+		{"SCUNTHORPE", "SCUNTHORPE"},
+		{"cunt", wordFilterReplacement},
+		{"scunthorpe cunt", "scunthorpe " + wordFilterReplacement},
+	}
+
+	for _, tt := range tests {
+		if contents := filter.Filter(tt.in).Contents; contents != tt.contents {
+			t.Errorf("Filter(%q).Contents = %q, want %q", tt.in, contents, tt.contents)
+		}
+	}
+}
+
+func TestWordFilterNormalization(t *testing.T) {
+	filter := newTestWordFilter(t, &WordFilterFile{
+		Words: []*WordFilterRaw{
+			{Word: "idiot"},
+		},
+	})
+
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"case", "IdIoT"},
+		{"leet", "1d10t"},
+		{"symbols", "!d!o+"},
+		{"fullwidth", "ｉｄｉｏｔ"},
+		{"diacritics", "ìdïøt"},
+		{"combining marks", "i\u0301di\u0308ot"},
+		{"invisible characters", "id\u200biot"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if contents := filter.Filter("you " + tt.in + "!").Contents; contents != "you "+wordFilterReplacement+"!" {
+				t.Errorf("Filter(%q).Contents = %q", tt.in, contents)
+			}
+		})
+	}
+}
+
+func TestWordFilterIgnoresNumbers(t *testing.T) {
+	filter := newTestWordFilter(t, &WordFilterFile{
+		Words: []*WordFilterRaw{
+			{Word: "ass", Match: "substring"},
+			{Word: "bob"},
+		},
+	})
+
+	tests := []struct {
+		in       string
+		contents string
+	}{
+		{"I scored 455 points", "I scored 455 points"},
+		{"map 0808 at 5:55", "map 0808 at 5:55"},
+		{"a55", wordFilterReplacement},
+		{"b0b", wordFilterReplacement},
+	}
+
+	for _, tt := range tests {
+		if contents := filter.Filter(tt.in).Contents; contents != tt.contents {
+			t.Errorf("Filter(%q).Contents = %q, want %q", tt.in, contents, tt.contents)
+		}
+	}
+}
+
+func TestLegacyWordFilterMatchesRawText(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "filterwords.txt")
+	if err := os.WriteFile(filename, []byte("b[i1]tch\nf\\$ck\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := loadLegacyWordFilter(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in       string
+		contents string
+	}{
+		{"b1tch", wordFilterReplacement},
+		{"BITCH", wordFilterReplacement},
+		{"f$ck off", wordFilterReplacement + " off"},
+		{"fsck", "fsck"},
+	}
+
+	for _, tt := range tests {
+		if contents := filter.Filter(tt.in).Contents; contents != tt.contents {
+			t.Errorf("Filter(%q).Contents = %q, want %q", tt.in, contents, tt.contents)
+		}
+	}
+}